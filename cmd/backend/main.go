@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/rs/zerolog"
@@ -24,9 +29,36 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to connect to MongoDB")
 	}
 
+	// Create the LLM client once; every request shares it
+	if err := backend.InitLLM(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize LLM provider")
+	}
+
+	// Extract captures that arrived while the LLM provider was unavailable
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	backend.StartCaptureRetryWorker(workerCtx)
+
 	// Setup routes
 	backend.SetupRoutes(app)
 
-	log.Info().Msg("Server listening on http://localhost:8080")
-	log.Fatal().Err(app.Listen(":8080")).Msg("")
+	go func() {
+		log.Info().Msg("Server listening on http://localhost:8080")
+		if err := app.Listen(":8080"); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	}()
+
+	// Wait for a shutdown signal, then let in-flight requests finish
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+
+	log.Info().Msg("Shutting down")
+	if err := app.Shutdown(); err != nil {
+		log.Error().Err(err).Msg("Failed to shut down server")
+	}
+	stopWorker()
+	if err := backend.CloseLLM(); err != nil {
+		log.Error().Err(err).Msg("Failed to close LLM provider")
+	}
 }
@@ -0,0 +1,260 @@
+// Command bma-eval measures how accurately listings are extracted.
+//
+//	bma-eval run -dir eval/cases -out runs/baseline.json
+//	bma-eval diff runs/baseline.json runs/new-prompt.json
+//	bma-eval extractors -dir eval/extractors
+//
+// The run command extracts every <name>.txt in the directory with the
+// provider configured through the usual LLM_* variables, including the
+// replay provider, and compares the result with <name>.expected.json.
+// The extractors command checks the site extractors against saved pages
+// without calling a model.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog"
+	"github.com/szehnder/bma-calculator/pkg/backend"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "run":
+		err = runCommand(os.Args[2:])
+	case "diff":
+		err = diffCommand(os.Args[2:])
+	case "extractors":
+		err = extractorsCommand(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bma-eval:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  bma-eval run [-dir eval/cases] [-out run.json] [-provider name] [-model name] [-db] [-concurrency 2] [-tolerance 0]
+  bma-eval diff old.json new.json
+  bma-eval extractors [-dir eval/extractors]`)
+	os.Exit(2)
+}
+
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	dir := fs.String("dir", "eval/cases", "directory of <name>.txt listings and <name>.expected.json details")
+	out := fs.String("out", "", "write the run as JSON to this file")
+	provider := fs.String("provider", "", "LLM provider, overriding LLM_PROVIDER")
+	model := fs.String("model", "", "extraction model, overriding LLM_EXTRACTION_MODEL")
+	useDB := fs.Bool("db", false, "connect to MongoDB to use the stored prompt templates and task settings")
+	concurrency := fs.Int("concurrency", 2, "listings extracted at the same time")
+	tolerance := fs.Float64("tolerance", 0, "relative tolerance for numeric fields, e.g. 0.01 for 1%")
+	verbose := fs.Bool("v", false, "log every model call")
+	fs.Parse(args)
+
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	if *verbose {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	if *provider != "" {
+		os.Setenv("LLM_PROVIDER", *provider)
+	}
+	if *model != "" {
+		os.Setenv("LLM_EXTRACTION_MODEL", *model)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *useDB {
+		if err := backend.ConnectDB(); err != nil {
+			return err
+		}
+	}
+	if err := backend.InitLLM(ctx); err != nil {
+		return err
+	}
+	defer backend.CloseLLM()
+
+	cases, err := backend.LoadEvalCases(*dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Extracting %d listings...\n", len(cases))
+
+	run, err := backend.RunExtractionEval(ctx, cases, *concurrency, *tolerance)
+	if err != nil {
+		return err
+	}
+	printRun(run)
+
+	if *out != "" {
+		data, err := json.MarshalIndent(run, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*out, data, 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", *out)
+	}
+	return nil
+}
+
+func diffCommand(args []string) error {
+	if len(args) != 2 {
+		usage()
+	}
+	before, err := loadRun(args[0])
+	if err != nil {
+		return err
+	}
+	after, err := loadRun(args[1])
+	if err != nil {
+		return err
+	}
+	printDiff(backend.DiffEvalRuns(before, after))
+	return nil
+}
+
+func extractorsCommand(args []string) error {
+	fs := flag.NewFlagSet("extractors", flag.ExitOnError)
+	dir := fs.String("dir", "eval/extractors", "directory of <host>/ directories of saved pages")
+	fs.Parse(args)
+
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	results, err := backend.CheckExtractorFixtures(*dir)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range results {
+		if len(r.Mismatches) == 0 {
+			fmt.Printf("ok    %s/%s (%s)\n", r.Host, r.Name, r.Extractor)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %s/%s (%s)\n", r.Host, r.Name, r.Extractor)
+		for _, m := range r.Mismatches {
+			fmt.Printf("      %s\n", m)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d pages read differently than expected", failed, len(results))
+	}
+	return nil
+}
+
+func loadRun(path string) (*backend.EvalRun, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var run backend.EvalRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return &run, nil
+}
+
+func printRun(run *backend.EvalRun) {
+	fmt.Printf("%s/%s, extraction prompt v%d: %d listings, %d failed\n\n",
+		run.Provider, run.Model, run.PromptVersion, len(run.Cases), run.Errors)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "field\tprecision\trecall\texact\tmean abs err\tmean abs % err\t")
+	for _, name := range backend.EvalFieldNames() {
+		if score, ok := run.Fields[name]; ok {
+			printScore(w, name, score)
+		}
+	}
+	printScore(w, "overall", run.Overall)
+	w.Flush()
+
+	for _, c := range run.Cases {
+		if c.Error != "" {
+			fmt.Printf("\n%s: %s", c.Name, c.Error)
+		}
+	}
+	fmt.Println()
+}
+
+func printScore(w *tabwriter.Writer, name string, s *backend.FieldScore) {
+	// Precision without predictions and recall without stated values are undefined
+	precision, recall := "-", "-"
+	if s.Predicted > 0 {
+		precision = fmt.Sprintf("%.1f%%", 100*s.Precision)
+	}
+	if s.Expected > 0 {
+		recall = fmt.Sprintf("%.1f%%", 100*s.Recall)
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%.1f%%\t%s\t%s\t\n", name, precision, recall,
+		100*s.ExactMatch, optional(s.MeanAbsError, 1, "%.1f"), optional(s.MeanAbsPctError, 100, "%.1f%%"))
+}
+
+func optional(v *float64, scale float64, format string) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf(format, *v*scale)
+}
+
+func printDiff(diff *backend.EvalDiff) {
+	fmt.Printf("old: %s\nnew: %s\n\n", diff.Old, diff.New)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "field\tprecision\t\trecall\t\texact\t\tmean abs % err\t\t")
+	for _, f := range diff.Fields {
+		pctDelta := "-"
+		if f.MeanAbsPctErrorDelta != nil {
+			pctDelta = fmt.Sprintf("%+.1f", 100**f.MeanAbsPctErrorDelta)
+		}
+		fmt.Fprintf(w, "%s\t%.1f%%\t%+.1f\t%.1f%%\t%+.1f\t%.1f%%\t%+.1f\t%s\t%s\t\n", f.Field,
+			100*f.Precision, 100*f.PrecisionDelta,
+			100*f.Recall, 100*f.RecallDelta,
+			100*f.ExactMatch, 100*f.ExactMatchDelta,
+			optional(f.MeanAbsPctError, 100, "%.1f%%"), pctDelta)
+	}
+	w.Flush()
+
+	if len(diff.Cases) == 0 {
+		fmt.Println("\nNo listing changed.")
+		return
+	}
+	fmt.Println()
+	for _, c := range diff.Cases {
+		switch {
+		case c.OnlyInRun != "":
+			fmt.Printf("%s: only in the %s run\n", c.Name, c.OnlyInRun)
+		case c.NewError != "":
+			fmt.Printf("%s: now fails: %s\n", c.Name, c.NewError)
+		default:
+			fmt.Printf("%s:", c.Name)
+			if c.ErrorFixed {
+				fmt.Print(" no longer fails;")
+			}
+			if len(c.Fixed) > 0 {
+				fmt.Printf(" fixed %v", c.Fixed)
+			}
+			if len(c.Regressed) > 0 {
+				fmt.Printf(" regressed %v", c.Regressed)
+			}
+			fmt.Println()
+		}
+	}
+}
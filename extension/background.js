@@ -6,14 +6,16 @@ chrome.runtime.onInstalled.addListener(() => {
 // Listen for messages from content script
 chrome.runtime.onMessage.addListener((message, sender, sendResponse) => {
     if (message.type === 'PAGE_DATA') {
-        const { url, content } = message.data;
+        const { url, content, html } = message.data;
         
-        // Send data to backend
-        fetch("http://localhost:8080/api/extension/page-data", {
+        // Send data to backend, with the markup compressed when the browser can
+        gzipBase64(html)
+        .then(htmlGzip => ({ url, content, htmlGzip }), () => ({ url, content, html }))
+        .then(payload => fetch("http://localhost:8080/api/extension/page-data", {
             method: "POST",
             headers: { "Content-Type": "application/json" },
-            body: JSON.stringify({ url, content })
-        })
+            body: JSON.stringify(payload)
+        }))
         .then(response => response.json())
         .then(data => {
             console.log("Data sent to backend successfully:", data);
@@ -27,4 +29,15 @@ chrome.runtime.onMessage.addListener((message, sender, sendResponse) => {
         // Return true to indicate we'll send a response asynchronously
         return true;
     }
-}); 
\ No newline at end of file
+}); 
+
+// Listing pages run to megabytes of markup; gzip shrinks them about tenfold
+async function gzipBase64(text) {
+    const stream = new Blob([text]).stream().pipeThrough(new CompressionStream('gzip'));
+    const bytes = new Uint8Array(await new Response(stream).arrayBuffer());
+    let binary = '';
+    for (let i = 0; i < bytes.length; i += 0x8000) {
+        binary += String.fromCharCode.apply(null, bytes.subarray(i, i + 0x8000));
+    }
+    return btoa(binary);
+}
@@ -3,11 +3,13 @@
 function collectPageData() {
     const url = window.location.href;
     const content = document.documentElement.innerText || "";
+    // The markup carries the listing's structured data (JSON-LD, microdata)
+    const html = document.documentElement.outerHTML || "";
 
     // Send message to background script
     chrome.runtime.sendMessage({
         type: 'PAGE_DATA',
-        data: { url, content }
+        data: { url, content, html }
     }, response => {
         if (chrome.runtime.lastError) {
             console.error('Error:', chrome.runtime.lastError);
@@ -0,0 +1,115 @@
+import { API_URL } from './constants';
+
+export type StreamStatus = {
+	stage: 'loading_comps' | 'cached' | 'prompt_sent' | 'repairing' | 'fact_check';
+	model?: string;
+	attempt?: number;
+	discrepancies?: Discrepancy[];
+};
+
+export type Discrepancy = {
+	field: string;
+	address: string;
+	property: string;
+	claim: string;
+	stated: number;
+	actual: number;
+};
+
+export type ToolCall = {
+	round: number;
+	tool: string;
+	address?: string;
+	compareTo?: string;
+	field?: string;
+	result?: Record<string, number>;
+	error?: string;
+};
+
+export type StreamHandlers = {
+	onStatus?: (status: StreamStatus) => void;
+	onProperties?: (properties: any) => void;
+	onTool?: (call: ToolCall) => void;
+	onToken?: (text: string) => void;
+	onSection?: (name: string, value: unknown) => void;
+	onReport: (report: any) => void;
+	onError: (message: string) => void;
+};
+
+// streamBMAReport opens the server-sent event stream for the BMA report and
+// dispatches its events. profile selects the instruction profile; the default
+// profile is used without one, and locale the language of the report. It
+// returns a function that closes the stream.
+export function streamBMAReport(
+	refresh: boolean,
+	handlers: StreamHandlers,
+	profile = '',
+	locale = ''
+): () => void {
+	const params = new URLSearchParams();
+	if (refresh) params.set('refresh', 'true');
+	if (profile) params.set('profile', profile);
+	if (locale) params.set('locale', locale);
+	const query = params.toString();
+	const source = new EventSource(`${API_URL}/api/bma-report/stream${query ? `?${query}` : ''}`);
+	let finished = false;
+	const close = () => {
+		finished = true;
+		source.close();
+	};
+	const on = (event: string, handler: (data: any) => void) => {
+		source.addEventListener(event, (e) => handler(JSON.parse((e as MessageEvent).data)));
+	};
+
+	on('status', (data) => handlers.onStatus?.(data));
+	on('properties', (data) => handlers.onProperties?.(data));
+	on('tool', (data) => handlers.onTool?.(data));
+	on('token', (data) => handlers.onToken?.(data.text));
+	on('section', (data) => handlers.onSection?.(data.name, data.value));
+	on('report', (data) => {
+		close();
+		handlers.onReport(data);
+	});
+
+	// Named "error" events carry a payload; connection failures do not.
+	source.addEventListener('error', (e) => {
+		const data = (e as MessageEvent).data;
+		const wasFinished = finished;
+		close();
+		if (data) {
+			handlers.onError(JSON.parse(data).error);
+		} else if (!wasFinished) {
+			handlers.onError('Lost connection to the report stream.');
+		}
+	});
+
+	return close;
+}
+
+export function describeStatus(status: StreamStatus): string {
+	switch (status.stage) {
+		case 'loading_comps':
+			return 'Loading comparison properties...';
+		case 'cached':
+			return 'Loading cached report...';
+		case 'prompt_sent':
+			return status.attempt && status.attempt > 1
+				? `Regenerating analysis with ${status.model} (attempt ${status.attempt})...`
+				: `Generating analysis with ${status.model}...`;
+		case 'repairing':
+			return 'Correcting the analysis format...';
+		case 'fact_check':
+			return `Correcting ${status.discrepancies?.length ?? 0} figures that contradict the listings...`;
+		default:
+			return 'Generating report...';
+	}
+}
+
+export function describeDiscrepancy(d: Discrepancy): string {
+	return `"${d.claim}" for ${d.address}: the listing gives ${d.property} ${d.actual}, not ${d.stated}`;
+}
+
+export function describeToolCall(call: ToolCall): string {
+	const subject = call.field || call.address || 'the comparisons';
+	return `Calculated ${call.tool.replace(/_/g, ' ')} for ${subject}...`;
+}
@@ -0,0 +1,554 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultToolRounds is how many times the model may request calculations
+// before writing the analysis.
+const defaultToolRounds = 3
+
+// maxCallsPerRound bounds the calculations run for a single request.
+const maxCallsPerRound = 20
+
+// toolRounds returns LLM_TOOL_ROUNDS. Zero disables the tools and the check
+// of cited figures.
+func toolRounds() int {
+	return envInt("LLM_TOOL_ROUNDS", defaultToolRounds)
+}
+
+// Names of the calculations the model can request.
+const (
+	ToolPricePerSqFt  = "price_per_sqft"
+	ToolMedian        = "median"
+	ToolAdjustedPrice = "adjusted_price"
+	ToolDistance      = "distance"
+)
+
+// toolFields are the comparison fields the median tool summarizes. Days on
+// market is left out, as it is removed from the comparisons.
+var toolFields = []string{"price", "pricePerSqFt", "squareFootage", "bedrooms", "bathrooms", "yearBuilt", "conditionScore", "soldPrice", "lotSizeSqFt", "hoaDues", "annualTaxes"}
+
+// toolRequest is one calculation requested by the model. Unused arguments are null.
+type toolRequest struct {
+	Tool      string `json:"tool" llm:"enum=price_per_sqft|median|adjusted_price|distance"`
+	Address   string `json:"address" llm:"nullable"`
+	CompareTo string `json:"compareTo" llm:"nullable"`
+	Field     string `json:"field" llm:"nullable,enum=price|pricePerSqFt|squareFootage|bedrooms|bathrooms|yearBuilt|conditionScore|soldPrice|lotSizeSqFt|hoaDues|annualTaxes"`
+}
+
+// toolStep is the model's answer in a tool round; no calls means it has every
+// figure it needs.
+type toolStep struct {
+	Calls []toolRequest `json:"calls"`
+}
+
+// ToolCall records one calculation run for the model while it wrote a report.
+type ToolCall struct {
+	Round     int                `json:"round"`
+	Tool      string             `json:"tool"`
+	Address   string             `json:"address,omitempty"`
+	CompareTo string             `json:"compareTo,omitempty"`
+	Field     string             `json:"field,omitempty"`
+	Result    map[string]float64 `json:"result,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// String renders the call and its result the way the prompts show them.
+func (c ToolCall) String() string {
+	var args []string
+	if c.Address != "" {
+		args = append(args, fmt.Sprintf("address=%q", c.Address))
+	}
+	if c.CompareTo != "" {
+		args = append(args, fmt.Sprintf("compareTo=%q", c.CompareTo))
+	}
+	if c.Field != "" {
+		args = append(args, fmt.Sprintf("field=%q", c.Field))
+	}
+	call := c.Tool + "(" + strings.Join(args, ", ") + ")"
+	if c.Error != "" {
+		return call + " failed: " + c.Error
+	}
+	result, _ := json.Marshal(c.Result)
+	return call + " = " + string(result)
+}
+
+// analysisTools runs calculations over the property details a report is based on.
+type analysisTools struct {
+	primary PropertyDetails
+	comps   []PropertyDetails
+}
+
+// run executes one request. Results are rounded to cents.
+func (t *analysisTools) run(req toolRequest, round int) ToolCall {
+	call := ToolCall{Round: round, Tool: req.Tool, Address: req.Address, CompareTo: req.CompareTo, Field: req.Field}
+
+	var result map[string]float64
+	var err error
+	switch req.Tool {
+	case ToolPricePerSqFt:
+		result, err = t.pricePerSqFt(req.Address)
+	case ToolMedian:
+		result, err = t.median(req.Field)
+	case ToolAdjustedPrice:
+		result, err = t.adjustedPrice(req.Address)
+	case ToolDistance:
+		result, err = t.distance(req.Address, req.CompareTo)
+	default:
+		err = fmt.Errorf("unknown tool %q", req.Tool)
+	}
+	if err != nil {
+		call.Error = err.Error()
+		return call
+	}
+	for name, v := range result {
+		result[name] = math.Round(v*100) / 100
+	}
+	call.Result = result
+	return call
+}
+
+// find returns the property with the address; an empty address or "primary"
+// selects the primary property.
+func (t *analysisTools) find(address string) (*PropertyDetails, error) {
+	key := addressKey(address)
+	if key == "" || key == "primary" {
+		return &t.primary, nil
+	}
+	all := append([]PropertyDetails{t.primary}, t.comps...)
+	for i := range all {
+		if addressKey(all[i].Address) == key {
+			return &all[i], nil
+		}
+	}
+	// Models often drop the city or ZIP code
+	for i := range all {
+		if strings.HasPrefix(addressKey(all[i].Address), key) {
+			return &all[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no property with address %q", address)
+}
+
+// addressKey reduces an address to its lowercase letters and digits.
+func addressKey(address string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(address) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (t *analysisTools) pricePerSqFt(address string) (map[string]float64, error) {
+	p, err := t.find(address)
+	if err != nil {
+		return nil, err
+	}
+	perSqFt, err := pricePerSqFt(p)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]float64{
+		"price":         p.Price,
+		"squareFootage": float64(p.SquareFootage),
+		"pricePerSqFt":  perSqFt,
+	}, nil
+}
+
+func pricePerSqFt(p *PropertyDetails) (float64, error) {
+	if p.Price <= 0 {
+		return 0, fmt.Errorf("price of %s is unknown", p.Address)
+	}
+	if p.SquareFootage <= 0 {
+		return 0, fmt.Errorf("square footage of %s is unknown", p.Address)
+	}
+	return p.Price / float64(p.SquareFootage), nil
+}
+
+// fieldValue returns a numeric field of the property; false when it is unknown.
+func fieldValue(p *PropertyDetails, field string) (float64, bool) {
+	var v float64
+	switch field {
+	case "price":
+		v = p.Price
+	case "pricePerSqFt":
+		perSqFt, err := pricePerSqFt(p)
+		if err != nil {
+			return 0, false
+		}
+		v = perSqFt
+	case "squareFootage":
+		v = float64(p.SquareFootage)
+	case "bedrooms":
+		v = float64(p.Bedrooms)
+	case "bathrooms":
+		v = p.Bathrooms
+	case "yearBuilt":
+		v = float64(p.YearBuilt)
+	case "daysOnMarket":
+		v = float64(p.DaysOnMarket)
+	case "soldPrice":
+		v = p.SoldPrice
+	case "lotSizeSqFt":
+		v = float64(p.LotSizeSqFt)
+	case "hoaDues":
+		v = p.HOADues
+	case "annualTaxes":
+		v = p.AnnualTaxes
+	case "conditionScore":
+		if p.Condition != nil {
+			v = float64(p.Condition.OverallScore)
+		}
+	}
+	return v, v > 0
+}
+
+func (t *analysisTools) median(field string) (map[string]float64, error) {
+	known := false
+	for _, f := range toolFields {
+		known = known || f == field
+	}
+	if !known {
+		return nil, fmt.Errorf("field must be one of %s", strings.Join(toolFields, ", "))
+	}
+
+	var values []float64
+	for i := range t.comps {
+		if v, ok := fieldValue(&t.comps[i], field); ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no comparison property states %s", field)
+	}
+	sort.Float64s(values)
+	return map[string]float64{
+		"median": median(values),
+		"min":    values[0],
+		"max":    values[len(values)-1],
+		"count":  float64(len(values)),
+	}, nil
+}
+
+// median returns the median of sorted values.
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// adjustedPrice adjusts a comparison's price for the difference in square
+// footage with the primary property, valued at the comparisons' median price
+// per square foot.
+func (t *analysisTools) adjustedPrice(address string) (map[string]float64, error) {
+	comp, err := t.find(address)
+	if err != nil {
+		return nil, err
+	}
+	if comp.Price <= 0 {
+		return nil, fmt.Errorf("price of %s is unknown", comp.Address)
+	}
+	if comp.SquareFootage <= 0 || t.primary.SquareFootage <= 0 {
+		return nil, fmt.Errorf("square footage of %s or of the primary property is unknown", comp.Address)
+	}
+	stats, err := t.median("pricePerSqFt")
+	if err != nil {
+		return nil, err
+	}
+
+	sqFtDiff := float64(t.primary.SquareFootage - comp.SquareFootage)
+	adjustment := sqFtDiff * stats["median"]
+	result := map[string]float64{
+		"compPrice":               comp.Price,
+		"squareFootageDifference": sqFtDiff,
+		"medianPricePerSqFt":      stats["median"],
+		"squareFootageAdjustment": adjustment,
+		"adjustedPrice":           comp.Price + adjustment,
+	}
+	if t.primary.Price > 0 {
+		diff := t.primary.Price - (comp.Price + adjustment)
+		result["primaryPriceDifference"] = diff
+		result["primaryPriceDifferencePercent"] = 100 * diff / (comp.Price + adjustment)
+	}
+	return result, nil
+}
+
+func (t *analysisTools) distance(address, compareTo string) (map[string]float64, error) {
+	from, err := t.find(address)
+	if err != nil {
+		return nil, err
+	}
+	to, err := t.find(compareTo)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []*PropertyDetails{from, to} {
+		if p.Latitude == 0 && p.Longitude == 0 {
+			return nil, fmt.Errorf("location of %s is unknown", p.Address)
+		}
+	}
+	return map[string]float64{"miles": haversineMiles(from.Latitude, from.Longitude, to.Latitude, to.Longitude)}, nil
+}
+
+// haversineMiles returns the great-circle distance between two coordinates.
+func haversineMiles(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusMiles = 3958.8
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLng := rad(lat2-lat1), rad(lng2-lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMiles * math.Asin(math.Sqrt(a))
+}
+
+// toolCatalog describes the tools in the prompt.
+const toolCatalog = `Tools:
+- price_per_sqft(address): the property's price divided by its square footage
+- median(field): median, min, max and count of a field over the comparison properties; field is one of price, pricePerSqFt, squareFootage, bedrooms, bathrooms, yearBuilt, conditionScore, soldPrice, lotSizeSqFt, hoaDues, annualTaxes
+- adjusted_price(address): a comparison's price adjusted to the primary property's square footage at the comparisons' median price per square foot, and how the primary's price differs from it (in dollars and percent)
+- distance(address, compareTo): miles between two properties; compareTo defaults to the primary property`
+
+// toolPrompt asks the model which calculations it needs, given the results so far.
+func toolPrompt(prompt string, calls []ToolCall) string {
+	var b strings.Builder
+	b.WriteString(prompt)
+	b.WriteString("\n\nDo not write the analysis yet. First request the calculations it needs: all arithmetic is done by the tools below, ")
+	b.WriteString("computed from the property data above, and the analysis may only cite figures from the property data or from tool results.\n\n")
+	b.WriteString(toolCatalog)
+	if len(calls) > 0 {
+		b.WriteString("\n\nResults so far:\n")
+		writeToolCalls(&b, calls)
+	}
+	b.WriteString("\nAnswer ONLY with a JSON object {\"calls\": [...]} listing the further calculations you need, ")
+	b.WriteString("each {\"tool\", \"address\", \"compareTo\", \"field\"} with null for unused arguments. ")
+	b.WriteString("Return {\"calls\": []} once you have every figure you need.")
+	return b.String()
+}
+
+// toolResultsPrompt adds the calculations to the analysis prompt.
+func toolResultsPrompt(prompt string, calls []ToolCall) string {
+	var b strings.Builder
+	b.WriteString(prompt)
+	b.WriteString("\n\nCalculations, computed from the property data:\n")
+	if len(calls) == 0 {
+		b.WriteString("(none)\n")
+	}
+	writeToolCalls(&b, calls)
+	b.WriteString("\nEvery figure in the analysis must come from the property data or these calculations; ")
+	b.WriteString("you may round them, but never compute new figures.")
+	return b.String()
+}
+
+func writeToolCalls(b *strings.Builder, calls []ToolCall) {
+	for i, call := range calls {
+		fmt.Fprintf(b, "%d. %s\n", i+1, call)
+	}
+}
+
+// requestToolCalls lets the model request calculations for up to toolRounds
+// rounds, stopping early when it asks for nothing new.
+func requestToolCalls(ctx context.Context, prompt string, tools *analysisTools, obs *generationObserver) ([]ToolCall, error) {
+	// The planning answers are not part of the analysis, so they are not streamed
+	var stepObs *generationObserver
+	if obs != nil {
+		stepObs = &generationObserver{PromptSent: obs.PromptSent}
+	}
+
+	var calls []ToolCall
+	seen := map[toolRequest]bool{}
+	for round := 1; round <= toolRounds(); round++ {
+		var step toolStep
+		if err := generateValidated(ctx, TaskAnalysis, toolPrompt(prompt, calls), SchemaFor(toolStep{}), &step, stepObs); err != nil {
+			return nil, err
+		}
+
+		added := 0
+		for _, req := range step.Calls {
+			if seen[req] || added == maxCallsPerRound {
+				continue
+			}
+			seen[req] = true
+			added++
+
+			call := tools.run(req, round)
+			calls = append(calls, call)
+			log.Info().Str("tool", call.Tool).Str("address", call.Address).Str("field", call.Field).
+				Str("error", call.Error).Msg("Ran analysis tool")
+			if obs != nil && obs.ToolCalled != nil {
+				obs.ToolCalled(call)
+			}
+		}
+		if added == 0 {
+			break
+		}
+	}
+	return calls, nil
+}
+
+// citedNumber is a figure found in generated text.
+type citedNumber struct {
+	Text  string
+	Value float64
+	// Tolerance is how far a known value may be from Value, allowing for rounding.
+	Tolerance float64
+	// Money is set for dollar amounts, Plain for integers without separators or suffix.
+	Money bool
+	Plain bool
+	// Suffix is the lowercase "k", "m" or "%" written after the figure, if any.
+	Suffix string
+}
+
+// citedNumbers returns the figures in text written for the locale that must be
+// backed by the data, such as 512000, $512,000, 287.54, 5.2%, $512K or $1.2M.
+// Plain small integers, such as bedroom counts, and years are not checked.
+func citedNumbers(text string, locale *ReportLocale) []citedNumber {
+	var out []citedNumber
+	for _, m := range locale.figures.FindAllStringSubmatch(text, -1) {
+		n, ok := citedFigure(m, locale)
+		if !ok || (n.Plain && (n.Value < 100 || (n.Value >= 1800 && n.Value <= 2100))) {
+			continue
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// citedFigure reads a match of the locale's figures pattern.
+func citedFigure(m []string, locale *ReportLocale) (citedNumber, bool) {
+	value, ok := locale.parseFigure(m)
+	if !ok {
+		return citedNumber{}, false
+	}
+	dollar, whole, fraction, suffix := m[1] != "", m[2], m[3], strings.ToLower(m[4])
+	n := citedNumber{
+		Text:  strings.TrimSpace(m[0]),
+		Money: dollar || strings.HasSuffix(suffix, "$"),
+		Plain: !dollar && fraction == "" && suffix == "" && !strings.Contains(whole, locale.Group),
+	}
+
+	// The precision of the figure bounds the rounding it may hide: 287.6 is
+	// within 0.05, 290 within 5 and $1.2M within $50,000. Trailing zeros
+	// count as rounding up to two significant digits.
+	unit := 1.0
+	if fraction != "" {
+		unit = math.Pow(10, -float64(len(fraction)-1))
+	} else {
+		digits := strings.ReplaceAll(whole, locale.Group, "")
+		zeros := len(digits) - len(strings.TrimRight(digits, "0"))
+		unit = math.Pow(10, float64(max(0, min(zeros, len(digits)-2))))
+	}
+	switch suffix {
+	case "k":
+		value, unit = value*1e3, unit*1e3
+	case "m":
+		value, unit = value*1e6, unit*1e6
+	}
+	if suffix == "k" || suffix == "m" || suffix == "%" {
+		n.Suffix = suffix
+	}
+	n.Value, n.Tolerance = value, unit/2
+	return n, true
+}
+
+// knownNumbers collects every figure the analysis may cite: the values and
+// any numbers in the text of the property details and instructions, the
+// comparison statistics and the tool results.
+func knownNumbers(primary PropertyDetails, comps []PropertyDetails, instructions string, calls []ToolCall) []float64 {
+	var known []float64
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case float64:
+			known = append(known, v)
+		case string:
+			// Listings are captured from US portals
+			us := defaultReportLocale()
+			for _, m := range us.figures.FindAllStringSubmatch(v, -1) {
+				if f, ok := us.parseFigure(m); ok {
+					known = append(known, f)
+				}
+			}
+		case map[string]interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	var data interface{}
+	raw, _ := json.Marshal(map[string]interface{}{
+		"primary":      primary,
+		"comps":        comps,
+		"stats":        computeCompStats(comps),
+		"instructions": instructions,
+	})
+	json.Unmarshal(raw, &data)
+	walk(data)
+
+	for _, call := range calls {
+		for _, v := range call.Result {
+			known = append(known, v)
+		}
+	}
+	return known
+}
+
+// uncitedFigures returns a validation error for every figure in the analysis
+// text that matches no known number, so the repair loop can ask for a fix.
+func uncitedFigures(answer []byte, known []float64, locale *ReportLocale) []FieldError {
+	var analysis DetailedAnalysis
+	if err := json.Unmarshal(answer, &analysis); err != nil {
+		return []FieldError{{Message: fmt.Sprintf("invalid JSON: %v", err)}}
+	}
+
+	texts := []struct{ path, text string }{
+		{"priceAnalysis", analysis.PriceAnalysis},
+		{"marketTrends", analysis.MarketTrends},
+		{"recommendation", analysis.Recommendation},
+	}
+	for i, fc := range analysis.FeatureComparison {
+		texts = append(texts,
+			struct{ path, text string }{fmt.Sprintf("featureComparison[%d].primaryValue", i), fc.PrimaryValue},
+			struct{ path, text string }{fmt.Sprintf("featureComparison[%d].analysis", i), fc.Analysis})
+		for j, cv := range fc.Comparison {
+			texts = append(texts, struct{ path, text string }{fmt.Sprintf("featureComparison[%d].comparison[%d].value", i, j), cv.Value})
+		}
+	}
+
+	var errs []FieldError
+	for _, t := range texts {
+		for _, n := range citedNumbers(t.text, locale) {
+			if !matchesKnown(n, known) {
+				errs = append(errs, FieldError{
+					Path:    t.path,
+					Message: fmt.Sprintf("cites %s, which is neither in the property data nor produced by a calculation", n.Text),
+				})
+			}
+		}
+	}
+	return errs
+}
+
+func matchesKnown(n citedNumber, known []float64) bool {
+	for _, k := range known {
+		// Differences may be cited without their sign
+		if math.Abs(math.Abs(k)-n.Value) <= n.Tolerance {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,284 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Pending capture states.
+const (
+	CapturePending = "pending"
+	CaptureFailed  = "failed"
+)
+
+const (
+	defaultCaptureRetryInterval = 30 * time.Second
+	defaultCaptureMaxAttempts   = 10
+	maxCaptureRetryDelay        = time.Hour
+	// captureLease keeps other workers off a capture while it is extracted.
+	captureLease = 10 * time.Minute
+)
+
+// PendingCapture is a page the extension sent while the LLM provider was
+// unavailable. It is extracted in the background once the provider recovers.
+type PendingCapture struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	URL           string             `bson:"url" json:"url"`
+	Content       string             `bson:"content" json:"-"`
+	HTML          string             `bson:"html,omitempty" json:"-"`
+	Status        string             `bson:"status" json:"status"`
+	Attempts      int                `bson:"attempts" json:"attempts"`
+	LastError     string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	NextAttemptAt time.Time          `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// storedCapture is what storeCapture wrote.
+type storedCapture struct {
+	Upserted      bool
+	ReviewFields  []string
+	InjectionRisk InjectionRisk
+}
+
+// storeCapture saves the extracted page in raw_page_data and creates or
+// updates the address it describes.
+func storeCapture(ctx context.Context, data *RawPageData, details *PropertyDetails, provenance map[string]FieldProvenance, usage *usageScope) (*storedCapture, error) {
+	data.PropertyDetails = details
+	data.Provenance = provenance
+
+	// Flag pages that try to instruct the model; reports honour the flag
+	risk := detectInjection(data.Content)
+	if risk.Level != InjectionRiskNone {
+		log.Warn().Str("url", data.URL).Str("level", risk.Level).Int("score", risk.Score).Msg("Captured page contains instruction-like text")
+	}
+
+	// Check if we already have this address in the database
+	rawCol := BmaDB.Collection("raw_page_data")
+	filter := bson.M{"propertyDetails.address": details.Address}
+	set := bson.M{
+		"url":             data.URL,
+		"content":         data.Content,
+		"propertyDetails": details,
+		"provenance":      provenance,
+		"injectionRisk":   risk,
+	}
+	if data.HTML != "" {
+		set["html"] = data.HTML
+	}
+	if data.Extractor != "" {
+		set["extractor"] = data.Extractor
+	}
+	// A capture without markup keeps the photos found before
+	data.Photos = listingPhotos(ctx, data, details.Address)
+	if len(data.Photos) > 0 {
+		set["photos"] = data.Photos
+	}
+	update := bson.M{"$set": set}
+	opts := options.Update().SetUpsert(true)
+
+	result, err := rawCol.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		log.Error().Err(err).Str("address", details.Address).Msg("Failed to update raw page data")
+		return nil, err
+	}
+
+	// Consensus runs that disagreed mark the address for human review
+	reviewFields := ReviewFields(provenance)
+
+	// If this was an insert (not an update), create a new Address record
+	if result.UpsertedID != nil {
+		addr := Address{
+			RawPageID:    result.UpsertedID.(primitive.ObjectID),
+			AddressStr:   details.Address,
+			Enabled:      false, // default to false
+			Primary:      false,
+			NeedsReview:  len(reviewFields) > 0,
+			ReviewFields: reviewFields,
+		}
+		addrCol := BmaDB.Collection("addresses")
+		_, err = addrCol.InsertOne(ctx, addr)
+		if err != nil {
+			log.Error().Err(err).Str("address", details.Address).Msg("Failed to create new address record")
+			return nil, err
+		}
+		log.Info().Str("address", details.Address).Msg("Created new address record")
+	} else {
+		_, err = BmaDB.Collection("addresses").UpdateOne(ctx, bson.M{"addressStr": details.Address}, bson.M{
+			"$set": bson.M{"needsReview": len(reviewFields) > 0, "reviewFields": reviewFields},
+		})
+		if err != nil {
+			log.Error().Err(err).Str("address", details.Address).Msg("Failed to update address review flag")
+		}
+		log.Info().Str("address", details.Address).Msg("Updated existing address record")
+	}
+
+	// Attribute the extraction cost to the address it produced
+	var linked Address
+	if err := BmaDB.Collection("addresses").FindOne(ctx, bson.M{"addressStr": details.Address}).Decode(&linked); err == nil {
+		linkUsage(ctx, usage, bson.M{"addressId": linked.ID})
+	}
+
+	// Downloading and assessing the photos can take a while, so it happens in the background
+	if len(data.Photos) > 0 {
+		processCapturePhotos(context.WithoutCancel(ctx), details.Address, data.Photos)
+	}
+
+	return &storedCapture{
+		Upserted:      result.UpsertedID != nil,
+		ReviewFields:  reviewFields,
+		InjectionRisk: risk,
+	}, nil
+}
+
+// processCapturePhotos stores the photos of a capture and, with
+// CONDITION_ASSESSMENT enabled, then assesses the property's condition.
+func processCapturePhotos(ctx context.Context, address string, photos []Photo) {
+	store, err := configuredPhotoStore()
+	if err != nil {
+		log.Error().Err(err).Msg("Photo storage unavailable")
+		return
+	}
+	assess := conditionAssessmentEnabled()
+	if store == nil && !assess {
+		return
+	}
+	photos = append([]Photo(nil), photos...)
+	go func() {
+		if store != nil {
+			persistPhotos(ctx, store, address, photos)
+		}
+		if assess {
+			assessCaptureCondition(ctx, store, address, photos)
+		}
+	}()
+}
+
+// pendingCaptureFilter matches the captures still waiting for extraction.
+func pendingCaptureFilter() bson.M {
+	return bson.M{"status": CapturePending}
+}
+
+// enqueueCapture stores a page whose extraction failed because the provider
+// was unavailable.
+func enqueueCapture(ctx context.Context, data *RawPageData, cause error) (*PendingCapture, error) {
+	now := time.Now()
+	pending := &PendingCapture{
+		URL:           data.URL,
+		Content:       data.Content,
+		HTML:          data.HTML,
+		Status:        CapturePending,
+		Attempts:      1,
+		LastError:     cause.Error(),
+		NextAttemptAt: now.Add(captureRetryDelay(1)),
+		CreatedAt:     now,
+	}
+	res, err := pendingCapturesCollection.InsertOne(ctx, pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue capture: %v", err)
+	}
+	pending.ID = res.InsertedID.(primitive.ObjectID)
+	log.Warn().Str("url", data.URL).Str("id", pending.ID.Hex()).Msg("LLM provider unavailable, queued capture for retry")
+	return pending, nil
+}
+
+// captureRetryDelay doubles LLM_CAPTURE_RETRY_INTERVAL with every attempt, up to an hour.
+func captureRetryDelay(attempts int) time.Duration {
+	delay := envDuration("LLM_CAPTURE_RETRY_INTERVAL", defaultCaptureRetryInterval)
+	for i := 1; i < attempts && delay < maxCaptureRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxCaptureRetryDelay)
+}
+
+// StartCaptureRetryWorker extracts queued captures in the background until
+// ctx is cancelled. It waits while the circuit breaker of a provider that
+// extraction calls is open.
+func StartCaptureRetryWorker(ctx context.Context) {
+	if pendingCapturesCollection == nil {
+		return
+	}
+	interval := envDuration("LLM_CAPTURE_RETRY_INTERVAL", defaultCaptureRetryInterval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				retryPendingCaptures(ctx)
+			}
+		}
+	}()
+}
+
+// retryPendingCaptures processes every capture that is due, one at a time.
+func retryPendingCaptures(ctx context.Context) {
+	for ctx.Err() == nil && extractionAvailable() {
+		pending, err := claimPendingCapture(ctx)
+		if err == mongo.ErrNoDocuments {
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to claim pending capture")
+			return
+		}
+		retryPendingCapture(ctx, pending)
+	}
+}
+
+// claimPendingCapture leases the next due capture so that concurrent workers skip it.
+func claimPendingCapture(ctx context.Context) (*PendingCapture, error) {
+	now := time.Now()
+	filter := pendingCaptureFilter()
+	filter["nextAttemptAt"] = bson.M{"$lte": now}
+
+	var pending PendingCapture
+	err := pendingCapturesCollection.FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"nextAttemptAt": now.Add(captureLease)}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}),
+	).Decode(&pending)
+	if err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
+
+func retryPendingCapture(ctx context.Context, pending *PendingCapture) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout())
+	defer cancel()
+	ctx, usage := withUsageScope(ctx, pending.URL, nil)
+
+	data := RawPageData{URL: pending.URL, Content: pending.Content, HTML: pending.HTML}
+	details, provenance, _, err := ExtractPropertyDetailsCached(ctx, &data, false)
+	if err == nil {
+		_, err = storeCapture(ctx, &data, details, provenance, usage)
+	}
+	if err == nil {
+		log.Info().Str("url", pending.URL).Str("address", details.Address).Int("attempts", pending.Attempts+1).Msg("Extracted queued capture")
+		if _, err := pendingCapturesCollection.DeleteOne(ctx, bson.M{"_id": pending.ID}); err != nil {
+			log.Error().Err(err).Str("id", pending.ID.Hex()).Msg("Failed to remove extracted capture from queue")
+		}
+		return
+	}
+
+	attempts := pending.Attempts + 1
+	set := bson.M{"attempts": attempts, "lastError": err.Error()}
+	if ErrUpstreamUnavailable(err) && attempts < envInt("LLM_CAPTURE_MAX_ATTEMPTS", defaultCaptureMaxAttempts) {
+		set["nextAttemptAt"] = time.Now().Add(captureRetryDelay(attempts))
+		log.Warn().Err(err).Str("url", pending.URL).Int("attempts", attempts).Msg("Queued capture still unavailable")
+	} else {
+		set["status"] = CaptureFailed
+		log.Error().Err(err).Str("url", pending.URL).Int("attempts", attempts).Msg("Giving up on queued capture")
+	}
+	if _, uerr := pendingCapturesCollection.UpdateOne(context.WithoutCancel(ctx), bson.M{"_id": pending.ID}, bson.M{"$set": set}); uerr != nil {
+		log.Error().Err(uerr).Str("id", pending.ID.Hex()).Msg("Failed to update queued capture")
+	}
+}
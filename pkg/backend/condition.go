@@ -0,0 +1,213 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// defaultConditionPhotos caps the photos sent to the vision model.
+	defaultConditionPhotos = 8
+	// conditionImageWidth is the width larger photos are scaled down to
+	// before they are sent, which keeps requests within the providers' limits.
+	conditionImageWidth = 1024
+)
+
+// conditionAssessmentEnabled tells whether captures with photos are assessed
+// automatically, set with CONDITION_ASSESSMENT=true.
+func conditionAssessmentEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("CONDITION_ASSESSMENT"))
+	return enabled
+}
+
+// visionMIMETypes are the image formats every supported provider accepts.
+var visionMIMETypes = map[string]bool{
+	"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true,
+}
+
+// assessCondition sends up to CONDITION_MAX_PHOTOS of the photos to the
+// vision model and returns its assessment of the property's condition.
+// Stored binaries are used when there are any, otherwise the photos are
+// downloaded.
+func assessCondition(ctx context.Context, store photoStore, address string, photos []Photo) (*ConditionAssessment, error) {
+	images := visionImages(ctx, store, photos, envInt("CONDITION_MAX_PHOTOS", defaultConditionPhotos))
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no listing photos could be loaded")
+	}
+
+	schema := SchemaFor(ConditionAssessment{})
+	prompt := fmt.Sprintf(`The %d attached images are listing photos of %s. Assess the condition of the home as an
+appraiser would for a broker market analysis, judging only what the photos show. Staging, lighting
+and photo quality are not condition.
+
+Score the kitchen, the bathrooms and the exterior from 1 (needs major work) to 10 (new or fully
+renovated) and note what the photos show: finishes, fixtures, materials and visible wear. When no
+photo shows an area, set its score to null and say so in its notes. Give an overall score on the
+same scale with a rationale citing what you saw, and list the renovations and updates that are
+visible, such as "quartz countertops" or "new roof", or an empty list when there are none.
+
+Return ONLY a JSON object matching this JSON Schema:
+%s`, len(images), address, schema.String())
+
+	_, model, err := providerForTask(ctx, TaskVision)
+	if err != nil {
+		return nil, err
+	}
+	var assessment ConditionAssessment
+	if err := generateChecked(ctx, TaskVision, prompt, images, schema, nil, &assessment, nil); err != nil {
+		return nil, err
+	}
+	assessment.Photos = len(images)
+	assessment.Model = model
+	assessment.AssessedAt = time.Now().UTC()
+	return &assessment, nil
+}
+
+// visionImages loads up to max photos, scaled down to conditionImageWidth.
+// Photos that cannot be loaded or are too large to decode are skipped.
+func visionImages(ctx context.Context, store photoStore, photos []Photo, max int) []LLMImage {
+	var images []LLMImage
+	for _, photo := range photos {
+		if len(images) >= max {
+			break
+		}
+		var data []byte
+		var contentType string
+		var err error
+		if store != nil && photo.Blob != "" {
+			data, contentType, err = store.open(ctx, photo.Blob)
+		} else {
+			data, contentType, err = downloadPhoto(ctx, photo.URL)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("url", photo.URL).Msg("Failed to load listing photo for condition assessment")
+			continue
+		}
+
+		img, err := decodePhoto(data)
+		if errors.Is(err, errPhotoTooLarge) {
+			log.Warn().Err(err).Str("url", photo.URL).Msg("Skipping listing photo for condition assessment")
+			continue
+		}
+		if err == nil && img.Bounds().Dx() > conditionImageWidth {
+			var scaled bytes.Buffer
+			if err := jpeg.Encode(&scaled, thumbnail(img, conditionImageWidth), &jpeg.Options{Quality: 85}); err == nil {
+				data, contentType = scaled.Bytes(), "image/jpeg"
+			}
+		}
+		if !visionMIMETypes[contentType] {
+			continue
+		}
+		images = append(images, LLMImage{MIMEType: contentType, Data: data})
+	}
+	return images
+}
+
+// assessCaptureCondition assesses the photos of a new capture and stores the
+// result. It runs in the background after the photos were stored.
+func assessCaptureCondition(ctx context.Context, store photoStore, address string, photos []Photo) {
+	var addr Address
+	if err := addressesCollection.FindOne(ctx, bson.M{"addressStr": address}).Decode(&addr); err == nil {
+		ctx, _ = withUsageScope(ctx, "", &addr.ID)
+	}
+	assessment, err := assessCondition(ctx, store, address, photos)
+	if err != nil {
+		log.Error().Err(err).Str("address", address).Msg("Condition assessment failed")
+		return
+	}
+	_, err = BmaDB.Collection("raw_page_data").UpdateOne(ctx,
+		bson.M{"propertyDetails.address": address},
+		bson.M{"$set": bson.M{"condition": assessment}})
+	if err != nil {
+		log.Error().Err(err).Str("address", address).Msg("Failed to store condition assessment")
+		return
+	}
+	log.Info().Str("address", address).Int("score", assessment.OverallScore).Msg("Assessed listing condition")
+}
+
+// addressCapture loads the address named by the :id parameter and its capture.
+// When either is missing it sends the error response and returns no address.
+func addressCapture(c *fiber.Ctx) (*Address, *RawPageData, error) {
+	ctx := c.UserContext()
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return nil, nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid address ID"})
+	}
+	var addr Address
+	if err := addressesCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&addr); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Address not found"})
+		}
+		return nil, nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	var raw RawPageData
+	if err := BmaDB.Collection("raw_page_data").FindOne(ctx, bson.M{"_id": addr.RawPageID}).Decode(&raw); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Capture not found"})
+		}
+		return nil, nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return &addr, &raw, nil
+}
+
+// handleGetAddressCondition returns the stored condition assessment of an
+// address; condition is null when none was made.
+func handleGetAddressCondition(c *fiber.Ctx) error {
+	addr, raw, err := addressCapture(c)
+	if addr == nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"address": addr.AddressStr, "condition": raw.Condition})
+}
+
+// handleAssessAddressCondition assesses the photos of an address now and
+// stores the result, replacing an earlier assessment.
+func handleAssessAddressCondition(c *fiber.Ctx) error {
+	addr, raw, err := addressCapture(c)
+	if addr == nil {
+		return err
+	}
+	if len(raw.Photos) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Address has no listing photos"})
+	}
+	store, err := configuredPhotoStore()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx, _ := withUsageScope(c.UserContext(), raw.URL, &addr.ID)
+	assessment, err := assessCondition(ctx, store, addr.AddressStr, raw.Photos)
+	if err != nil {
+		log.Error().Err(err).Str("address", addr.AddressStr).Msg("Condition assessment failed")
+		if verr, ok := asValidationError(err); ok {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error":      "Condition assessment failed validation",
+				"validation": verr,
+			})
+		}
+		if ErrUpstreamUnavailable(err) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(upstreamRetryAfter(err)))
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "LLM provider is unavailable, try again shortly"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	_, err = BmaDB.Collection("raw_page_data").UpdateOne(ctx,
+		bson.M{"_id": raw.ID},
+		bson.M{"$set": bson.M{"condition": assessment}})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"address": addr.AddressStr, "condition": assessment})
+}
@@ -0,0 +1,311 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ProviderConsensus is the provider name extraction cache entries are stored
+// under when extraction runs in consensus mode.
+const ProviderConsensus = "consensus"
+
+// consensusFields are voted on in consensus mode. Free-text fields such as the
+// description are worded differently by every model, so they take the most
+// confident answer instead.
+var consensusFields = []string{
+	"address", "price", "bedrooms", "bathrooms", "squareFootage",
+	"yearBuilt", "daysOnMarket", "lastPriceChange", "mlsNumber",
+	"listingStatus", "listPrice", "soldPrice", "hoaDues", "annualTaxes",
+}
+
+// ConsensusRef is one extraction run in consensus mode: a provider, a model
+// and optionally a stored extraction prompt version.
+type ConsensusRef struct {
+	Provider      string
+	Model         string
+	PromptVersion *int
+}
+
+func (r ConsensusRef) String() string {
+	s := r.Provider + "/" + r.Model
+	if r.PromptVersion != nil {
+		s += "@" + strconv.Itoa(*r.PromptVersion)
+	}
+	return s
+}
+
+// parseConsensusRef parses "provider[/model][@promptVersion]". The model
+// defaults to the provider's extraction model and may itself contain slashes.
+func parseConsensusRef(s string) (ConsensusRef, error) {
+	var ref ConsensusRef
+	if i := strings.LastIndex(s, "@"); i != -1 {
+		version, err := strconv.Atoi(s[i+1:])
+		if err != nil || version < 0 {
+			return ref, fmt.Errorf("invalid prompt version in %q", s)
+		}
+		ref.PromptVersion = &version
+		s = s[:i]
+	}
+	ref.Provider, ref.Model, _ = strings.Cut(s, "/")
+	ref.Provider = strings.ToLower(ref.Provider)
+	if ref.Provider == "" {
+		return ref, fmt.Errorf("missing provider in %q", s)
+	}
+	if ref.Model == "" {
+		ref.Model = modelForTask(ref.Provider, TaskExtraction)
+	}
+	return ref, nil
+}
+
+// consensusRefs returns the runs configured in LLM_EXTRACTION_CONSENSUS, a
+// comma-separated list such as "gemini/gemini-1.5-flash,openai/gpt-4o-mini" or
+// "gemini,gemini@3". Consensus needs at least two runs; otherwise nil is returned.
+func consensusRefs() []ConsensusRef {
+	raw := strings.TrimSpace(os.Getenv("LLM_EXTRACTION_CONSENSUS"))
+	if raw == "" {
+		return nil
+	}
+
+	var refs []ConsensusRef
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		ref, err := parseConsensusRef(part)
+		if err != nil {
+			log.Warn().Err(err).Msg("Ignoring invalid LLM_EXTRACTION_CONSENSUS entry")
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	if len(refs) < 2 {
+		log.Warn().Int("runs", len(refs)).Msg("LLM_EXTRACTION_CONSENSUS needs at least two runs, using single extraction")
+		return nil
+	}
+	return refs
+}
+
+// consensusIdentity describes the runs for the extraction cache key.
+func consensusIdentity(refs []ConsensusRef) string {
+	names := make([]string, len(refs))
+	for i, ref := range refs {
+		names[i] = ref.String()
+	}
+	return strings.Join(names, ",")
+}
+
+var (
+	// namedProviders holds the extra providers used by consensus runs.
+	namedProviders   = map[string]LLMProvider{}
+	namedProvidersMu sync.Mutex
+)
+
+// providerByName returns the current provider when it has the given name, and
+// otherwise a provider created on first use and shared afterwards.
+func providerByName(name string) (LLMProvider, error) {
+	current, err := currentLLMProvider()
+	if err != nil {
+		return nil, err
+	}
+	if current.Name() == name {
+		return current, nil
+	}
+
+	namedProvidersMu.Lock()
+	defer namedProvidersMu.Unlock()
+	if p, ok := namedProviders[name]; ok {
+		return p, nil
+	}
+	p, err := NewLLMProvider(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	namedProviders[name] = p
+	return p, nil
+}
+
+// closeNamedProviders releases the providers created for consensus runs.
+func closeNamedProviders() error {
+	namedProvidersMu.Lock()
+	defer namedProvidersMu.Unlock()
+	var firstErr error
+	for name, p := range namedProviders {
+		if closer, ok := p.(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(namedProviders, name)
+	}
+	return firstErr
+}
+
+// consensusExtraction runs every configured extraction concurrently and
+// reconciles the results by vote. A run that fails counts as disagreeing on
+// every field, so the address is flagged for review rather than trusted.
+func consensusExtraction(ctx context.Context, content string, refs []ConsensusRef, fields []string) (*PropertyDetails, map[string]FieldProvenance, error) {
+	runs := make([]map[string]FieldProvenance, len(refs))
+	errs := make([]error, len(refs))
+
+	var wg sync.WaitGroup
+	for i, ref := range refs {
+		wg.Add(1)
+		go func(i int, ref ConsensusRef) {
+			defer wg.Done()
+			provider, err := providerByName(ref.Provider)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			runCtx := withLLMTarget(ctx, &llmTarget{
+				provider:      provider,
+				model:         ref.Model,
+				promptVersion: ref.PromptVersion,
+			})
+			_, runs[i], errs[i] = extractSingle(runCtx, content, fields)
+		}(i, ref)
+	}
+	wg.Wait()
+
+	var succeeded []map[string]FieldProvenance
+	for i, err := range errs {
+		if err != nil {
+			log.Warn().Err(err).Str("run", refs[i].String()).Msg("Consensus extraction run failed")
+			continue
+		}
+		succeeded = append(succeeded, runs[i])
+	}
+	if len(succeeded) == 0 {
+		return nil, nil, errs[0]
+	}
+
+	provenance := voteProvenance(succeeded, len(refs))
+	if wantsField(fields, "address") && provenance["address"].Value == nil {
+		return nil, nil, fmt.Errorf("no address found in listing")
+	}
+	details, err := detailsFromProvenance(provenance)
+	if err != nil {
+		return nil, nil, err
+	}
+	return details, provenance, nil
+}
+
+// voteProvenance reconciles the runs field by field. For consensus fields the
+// value returned by the most runs wins, ties going to the higher combined
+// confidence; its Agreement is the share of all configured runs that returned
+// it. Other fields take the most confident value.
+func voteProvenance(runs []map[string]FieldProvenance, total int) map[string]FieldProvenance {
+	voted := map[string]bool{}
+	for _, name := range consensusFields {
+		voted[name] = true
+	}
+
+	names := map[string]bool{}
+	for _, run := range runs {
+		for name := range run {
+			names[name] = true
+		}
+	}
+
+	merged := map[string]FieldProvenance{}
+	for name := range names {
+		type candidate struct {
+			prov       FieldProvenance
+			votes      int
+			confidence float64
+		}
+		var candidates []*candidate
+		for _, run := range runs {
+			prov := run[name]
+			var match *candidate
+			for _, c := range candidates {
+				if consensusEqual(c.prov.Value, prov.Value) {
+					match = c
+					break
+				}
+			}
+			if match == nil {
+				match = &candidate{prov: prov}
+				candidates = append(candidates, match)
+			}
+			match.votes++
+			match.confidence += prov.Confidence
+			if prov.Confidence > match.prov.Confidence {
+				match.prov = prov
+			}
+		}
+
+		sort.SliceStable(candidates, func(i, j int) bool {
+			a, b := candidates[i], candidates[j]
+			if voted[name] && a.votes != b.votes {
+				return a.votes > b.votes
+			}
+			if !voted[name] && (a.prov.Value == nil) != (b.prov.Value == nil) {
+				return a.prov.Value != nil
+			}
+			if voted[name] {
+				return a.confidence > b.confidence
+			}
+			return a.prov.Confidence > b.prov.Confidence
+		})
+
+		winner := candidates[0]
+		prov := winner.prov
+		prov.Alternatives = nil
+		for _, c := range candidates[1:] {
+			if c.prov.Value != nil {
+				prov.Alternatives = append(prov.Alternatives, c.prov.Value)
+			}
+		}
+		if voted[name] {
+			prov.Agreement = float64(winner.votes) / float64(total)
+		} else {
+			prov.Alternatives = nil
+		}
+		merged[name] = prov
+	}
+	return merged
+}
+
+// consensusEqual compares values from different runs. Strings match when
+// their letters and digits match, so "123 Main St." equals "123 main st".
+func consensusEqual(a, b interface{}) bool {
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		return alphanumeric(as) == alphanumeric(bs)
+	}
+	return a == b
+}
+
+func alphanumeric(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+// ReviewFields lists the fields on which consensus runs disagreed. An address
+// with review fields is kept out of BMA reports until someone has checked it.
+func ReviewFields(provenance map[string]FieldProvenance) []string {
+	var fields []string
+	for name, prov := range provenance {
+		if prov.Agreement > 0 && prov.Agreement < 1 {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,183 @@
+package backend
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultChunkTokens is the token budget for the listing text of one extraction call.
+	defaultChunkTokens = 6000
+	// defaultMaxChunks caps the extraction calls per page. Listing details are
+	// near the top of a page, so the tail is dropped first.
+	defaultMaxChunks = 6
+	// charsPerToken is a rough estimate that holds for English text across tokenizers.
+	charsPerToken = 4
+	// chunkOverlapLines are repeated at the start of the next chunk so a value
+	// split from its label is still seen together.
+	chunkOverlapLines = 3
+)
+
+func chunkTokens() int {
+	if n, err := strconv.Atoi(os.Getenv("LLM_EXTRACTION_CHUNK_TOKENS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultChunkTokens
+}
+
+func maxChunks() int {
+	if n, err := strconv.Atoi(os.Getenv("LLM_EXTRACTION_MAX_CHUNKS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxChunks
+}
+
+// estimateTokens approximates the number of tokens in s.
+func estimateTokens(s string) int {
+	return (len(s) + charsPerToken - 1) / charsPerToken
+}
+
+// boilerplateLine matches page chrome that never holds listing details.
+var boilerplateLine = regexp.MustCompile(`(?i)^(` +
+	`sign in|sign up|log in|register|menu|search|skip to (main )?content|back to (search|top)|` +
+	`share|save|saved|print|hide|more|close|next|previous|` +
+	`accept( all)?( cookies)?|cookie (settings|preferences|policy)|we use cookies.*|` +
+	`privacy( policy)?|terms( of (use|service))?|do not sell.*|accessibility( statement)?|` +
+	`(©|\(c\)|copyright).*|all rights reserved.*|equal housing opportunity.*|` +
+	`download the app.*|get the app.*|follow us.*|contact us|about us|careers|help( center)?|site ?map` +
+	`)$`)
+
+// carouselHeading matches sections that list other homes, whose prices and
+// sizes must not be mistaken for the listing's own.
+var carouselHeading = regexp.MustCompile(`(?i)^(` +
+	`similar homes.*|nearby homes.*|homes (for sale )?near.*|nearby (similar )?(homes|listings|properties).*|` +
+	`recently (sold|viewed).*|you (might|may) (also )?like.*|recommended (homes|for you).*|` +
+	`more homes.*|other homes.*|explore (nearby|more).*|new listings near.*|` +
+	`similar (listings|properties).*|people also viewed.*` +
+	`)$`)
+
+// sectionHeading matches headings of the listing's own sections. One ends a
+// carousel, since what follows describes the listed home again.
+var sectionHeading = regexp.MustCompile(`(?i)^(` +
+	`facts (and|&) features|(home|property|building|listing|lot|hoa|community) (facts|details|information|overview)|` +
+	`about (this|the) (home|property)|overview|description|(interior|exterior)( features| details)?|features|` +
+	`price history|(public )?tax history|schools?( nearby)?|neighborhood( details| overview)?|` +
+	`monthly (payment|cost)s?|payment calculator|price insights|market (insights|trends)|open houses?` +
+	`)$`)
+
+// carouselControl matches the buttons of a carousel and its cards, which are
+// boilerplate that does not end the carousel.
+var carouselControl = regexp.MustCompile(`(?i)^(save|saved|share|hide|more|next|previous|see all.*|view all.*)$`)
+
+// minRepeatedLine is the shortest line dropped when it repeats. Shorter lines
+// are often values such as "No" or "2" that must stay beside their labels.
+const minRepeatedLine = 40
+
+// carouselCardLine is the longest line treated as part of a home card after a
+// carousel heading. A longer, prose line ends the carousel, as do a heading of
+// the listing's own sections and page chrome other than carousel controls.
+const carouselCardLine = 60
+
+// cleanListingContent strips navigation, footers, repeated long lines and
+// carousels of other homes from the page text.
+func cleanListingContent(content string) string {
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+
+	seen := map[string]bool{}
+	inCarousel := false
+	var out []string
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			continue
+		}
+		if carouselHeading.MatchString(line) {
+			inCarousel = true
+			continue
+		}
+		if inCarousel {
+			ends := len(line) > carouselCardLine || sectionHeading.MatchString(line) ||
+				(boilerplateLine.MatchString(line) && !carouselControl.MatchString(line))
+			if !ends {
+				continue
+			}
+			inCarousel = false
+		}
+		if boilerplateLine.MatchString(line) {
+			continue
+		}
+		// Footers and disclaimers often repeat; the first occurrence is kept
+		if len(line) >= minRepeatedLine {
+			key := strings.ToLower(line)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+// chunkContent splits content on line boundaries into chunks of at most
+// maxTokens estimated tokens. Lines longer than a chunk are split themselves.
+func chunkContent(content string, maxTokens int) []string {
+	if estimateTokens(content) <= maxTokens {
+		return []string{content}
+	}
+	maxChars := maxTokens * charsPerToken
+
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		for len(line) > maxChars {
+			cut := maxChars
+			// Do not split a UTF-8 sequence
+			for cut > 0 && line[cut]&0xC0 == 0x80 {
+				cut--
+			}
+			lines = append(lines, line[:cut])
+			line = line[cut:]
+		}
+		lines = append(lines, line)
+	}
+
+	var chunks []string
+	var current []string
+	size := 0
+	for _, line := range lines {
+		if size+len(line)+1 > maxChars && len(current) > 0 {
+			chunks = append(chunks, strings.Join(current, "\n"))
+			// Carry the last lines over when they leave room for new content
+			overlap := current[max(0, len(current)-chunkOverlapLines):]
+			current, size = nil, 0
+			for _, l := range overlap {
+				if size+len(l)+1 > maxChars/2 {
+					break
+				}
+				current = append(current, l)
+				size += len(l) + 1
+			}
+		}
+		current = append(current, line)
+		size += len(line) + 1
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, strings.Join(current, "\n"))
+	}
+	return chunks
+}
+
+// listingChunks cleans the page text and splits it into the chunks that are
+// extracted, dropping the tail beyond LLM_EXTRACTION_MAX_CHUNKS.
+func listingChunks(content string) []string {
+	chunks := chunkContent(cleanListingContent(content), chunkTokens())
+	if len(chunks) > maxChunks() {
+		log.Warn().Int("chunks", len(chunks)).Int("max", maxChunks()).Msg("Listing too long, extracting from the start of the page only")
+		chunks = chunks[:maxChunks()]
+	}
+	return chunks
+}
@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanListingContent(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{
+			name:    "chrome and whitespace",
+			content: "Sign in\nMenu\n  123 Maple St,   Columbus, OH  \r\n\n$349,900\nPrivacy Policy\n© 2024 Portal Inc.",
+			want:    "123 Maple St, Columbus, OH\n$349,900",
+		},
+		{
+			name:    "repeated long lines keep the first",
+			content: "Listing provided by Columbus REALTORS MLS\n3 beds\nListing provided by Columbus REALTORS MLS",
+			want:    "Listing provided by Columbus REALTORS MLS\n3 beds",
+		},
+		{
+			name:    "repeated short values stay beside their labels",
+			content: "Basement\nNo\nPool\nNo\nStories\n2\nGarage spaces\n2",
+			want:    "Basement\nNo\nPool\nNo\nStories\n2\nGarage spaces\n2",
+		},
+		{
+			name:    "carousel ends at a long line",
+			content: "$349,900\nSimilar homes\n$415,000\n3 beds\nSave\nThis charming ranch sits on a quiet street close to parks and shops.",
+			want:    "$349,900\nThis charming ranch sits on a quiet street close to parks and shops.",
+		},
+		{
+			name:    "carousel ends at a section heading",
+			content: "Recently sold nearby\n$400,000\n2 beds\nNext\nFacts and features\n3 beds\n$450,000\n1,820 sq ft",
+			want:    "Facts and features\n3 beds\n$450,000\n1,820 sq ft",
+		},
+		{
+			name:    "carousel ends at page chrome",
+			content: "123 Maple St\nNearby homes\n$415,000\n3 beds\nSign in\n$450,000",
+			want:    "123 Maple St\n$450,000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanListingContent(tt.content); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkContent(t *testing.T) {
+	t.Run("short content is one chunk", func(t *testing.T) {
+		if got := chunkContent("a\nb", 10); len(got) != 1 || got[0] != "a\nb" {
+			t.Errorf("got %q", got)
+		}
+	})
+
+	t.Run("chunks overlap by the last lines", func(t *testing.T) {
+		var lines []string
+		for i := 0; i < 40; i++ {
+			lines = append(lines, strings.Repeat(string(rune('a'+i%26)), 9))
+		}
+		chunks := chunkContent(strings.Join(lines, "\n"), 25) // 100 characters, 10 lines
+		if len(chunks) < 2 {
+			t.Fatalf("got %d chunks, want several", len(chunks))
+		}
+		for i, chunk := range chunks {
+			if len(chunk) > 100 {
+				t.Errorf("chunk %d has %d characters, want at most 100", i, len(chunk))
+			}
+		}
+		for i := 1; i < len(chunks); i++ {
+			prev := strings.Split(chunks[i-1], "\n")
+			next := strings.Split(chunks[i], "\n")
+			want := prev[len(prev)-chunkOverlapLines:]
+			for j, line := range want {
+				if next[j] != line {
+					t.Fatalf("chunk %d starts with %q, want the overlap %q", i, next[:chunkOverlapLines], want)
+				}
+			}
+		}
+	})
+
+	t.Run("long lines are split between UTF-8 sequences", func(t *testing.T) {
+		// 61 bytes, so a 20-byte cut lands inside a two-byte rune
+		line := "a" + strings.Repeat("é", 30)
+		chunks := chunkContent(line, 5)
+		for i, chunk := range chunks {
+			for _, part := range strings.Split(chunk, "\n") {
+				if !utf8.ValidString(part) || !strings.Contains(line, part) {
+					t.Errorf("chunk %d has a broken part %q", i, part)
+				}
+			}
+		}
+	})
+}
+
+func TestListingChunksDropsTheTail(t *testing.T) {
+	t.Setenv("LLM_EXTRACTION_CHUNK_TOKENS", "25")
+	t.Setenv("LLM_EXTRACTION_MAX_CHUNKS", "2")
+
+	var lines []string
+	for i := 0; i < 60; i++ {
+		lines = append(lines, "Line "+strings.Repeat("x", 4)+string(rune('A'+i%26))+strings.Repeat("y", i/26))
+	}
+	all := chunkContent(cleanListingContent(strings.Join(lines, "\n")), 25)
+	if len(all) <= 2 {
+		t.Fatalf("test content makes %d chunks, want more than 2", len(all))
+	}
+	chunks := listingChunks(strings.Join(lines, "\n"))
+	if len(chunks) != 2 || chunks[0] != all[0] || chunks[1] != all[1] {
+		t.Errorf("got %d chunks, want the first 2 of %d", len(chunks), len(all))
+	}
+}
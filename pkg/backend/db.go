@@ -16,6 +16,11 @@ var BmaDB *mongo.Database
 var addressesCollection *mongo.Collection
 var cachedBMAReportsCollection *mongo.Collection
 var llmInstructionsCollection *mongo.Collection
+var llmUsageCollection *mongo.Collection
+var promptTemplatesCollection *mongo.Collection
+var extractionCacheCollection *mongo.Collection
+var pendingCapturesCollection *mongo.Collection
+var llmSettingsCollection *mongo.Collection
 
 func ConnectDB() error {
 	var err error
@@ -50,6 +55,11 @@ func ConnectDB() error {
 	addressesCollection = BmaDB.Collection("addresses")
 	cachedBMAReportsCollection = BmaDB.Collection("cached_bma_reports")
 	llmInstructionsCollection = BmaDB.Collection("llm_instructions")
+	llmUsageCollection = BmaDB.Collection("llm_usage")
+	promptTemplatesCollection = BmaDB.Collection("prompt_templates")
+	extractionCacheCollection = BmaDB.Collection("extraction_cache")
+	pendingCapturesCollection = BmaDB.Collection("pending_captures")
+	llmSettingsCollection = BmaDB.Collection("llm_settings")
 
 	return nil
 }
@@ -68,6 +78,9 @@ func initCollections() error {
 	if err != nil {
 		return fmt.Errorf("failed to create index on raw_page_data: %v", err)
 	}
+	if err := migrateListingFields(ctx, rawCol); err != nil {
+		return fmt.Errorf("failed to migrate raw_page_data: %v", err)
+	}
 
 	// Initialize addresses collection
 	addrCol := BmaDB.Collection("addresses")
@@ -81,12 +94,41 @@ func initCollections() error {
 		return fmt.Errorf("failed to create index on addresses: %v", err)
 	}
 
-	// Initialize cached_bma_reports collection
+	// Initialize llm_instructions collection; the single document of older
+	// versions becomes the default profile
+	instructionsCol := BmaDB.Collection("llm_instructions")
+	if err := migrateInstructionProfiles(ctx, instructionsCol); err != nil {
+		return fmt.Errorf("failed to migrate llm_instructions: %v", err)
+	}
+	_, err = instructionsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create index on llm_instructions: %v", err)
+	}
+
+	// Initialize cached_bma_reports collection. Reports are cached per
+	// instruction profile and locale; those cached before profiles existed are
+	// dropped, and those cached before locales existed are in English.
 	cachedCol := BmaDB.Collection("cached_bma_reports")
+	_, _ = cachedCol.Indexes().DropOne(ctx, "primaryAddressId_1_comparisonAddressIds_1")
+	_, _ = cachedCol.Indexes().DropOne(ctx, "primaryAddressId_1_comparisonAddressIds_1_profileId_1")
+	if _, err := cachedCol.DeleteMany(ctx, bson.M{"profileId": bson.M{"$exists": false}}); err != nil {
+		return fmt.Errorf("failed to migrate cached_bma_reports: %v", err)
+	}
+	_, err = cachedCol.UpdateMany(ctx, bson.M{"locale": bson.M{"$exists": false}}, bson.M{
+		"$set": bson.M{"locale": DefaultLocale, "report.locale": DefaultLocale},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate cached_bma_reports: %v", err)
+	}
 	_, err = cachedCol.Indexes().CreateOne(ctx, mongo.IndexModel{
 		Keys: bson.D{
 			{Key: "primaryAddressId", Value: 1},
 			{Key: "comparisonAddressIds", Value: 1},
+			{Key: "profileId", Value: 1},
+			{Key: "locale", Value: 1},
 		},
 		Options: options.Index().SetUnique(true),
 	})
@@ -94,5 +136,64 @@ func initCollections() error {
 		return fmt.Errorf("failed to create index on cached_bma_reports: %v", err)
 	}
 
+	// Initialize llm_usage collection
+	usageCol := BmaDB.Collection("llm_usage")
+	_, err = usageCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "requestId", Value: 1}}},
+		{Keys: bson.D{{Key: "addressId", Value: 1}}},
+		{Keys: bson.D{{Key: "reportId", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create indexes on llm_usage: %v", err)
+	}
+
+	// Initialize prompt_templates collection
+	promptCol := BmaDB.Collection("prompt_templates")
+	_, err = promptCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "name", Value: 1},
+			{Key: "version", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create index on prompt_templates: %v", err)
+	}
+
+	// Initialize extraction_cache collection
+	extractionCol := BmaDB.Collection("extraction_cache")
+	_, err = extractionCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create indexes on extraction_cache: %v", err)
+	}
+
+	// Initialize pending_captures collection
+	pendingCol := BmaDB.Collection("pending_captures")
+	_, err = pendingCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "status", Value: 1},
+			{Key: "nextAttemptAt", Value: 1},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create index on pending_captures: %v", err)
+	}
+
+	// Initialize llm_settings collection
+	settingsCol := BmaDB.Collection("llm_settings")
+	_, err = settingsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "task", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create index on llm_settings: %v", err)
+	}
+
 	return nil
 }
@@ -0,0 +1,461 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// evalFields are the PropertyDetails fields scored by the evaluation. The
+// description is free text that no two runs word alike, so it is left out.
+var evalFields = []string{
+	"address", "price", "bedrooms", "bathrooms", "squareFootage", "yearBuilt",
+	"propertyType", "lotSize", "mlsNumber", "daysOnMarket", "lastPriceChange",
+	"listingStatus", "listPrice", "soldPrice", "listDate", "soldDate", "closeDate",
+	"hoaDues", "annualTaxes", "garageSpaces", "stories", "basement", "pool",
+	"lotSizeSqFt", "subdivision", "schoolDistrict",
+}
+
+// EvalFieldNames returns the scored fields in display order.
+func EvalFieldNames() []string {
+	return append([]string(nil), evalFields...)
+}
+
+// evalNumericFields are compared as numbers and get error statistics.
+var evalNumericFields = map[string]bool{
+	"price": true, "bedrooms": true, "bathrooms": true, "squareFootage": true,
+	"yearBuilt": true, "daysOnMarket": true, "lastPriceChange": true,
+	"listPrice": true, "soldPrice": true, "hoaDues": true, "annualTaxes": true,
+	"garageSpaces": true, "stories": true, "lotSizeSqFt": true,
+}
+
+// EvalCase is one saved listing page with the details it should yield.
+// Fields missing from Expected, or null, are not stated in the listing.
+type EvalCase struct {
+	Name    string
+	Content string
+	// HTML is the page markup from an optional <name>.html, whose structured data is read first.
+	HTML     string
+	Expected map[string]interface{}
+}
+
+// EvalResult is the outcome of extracting one case.
+type EvalResult struct {
+	Name      string                 `json:"name"`
+	Expected  map[string]interface{} `json:"expected"`
+	Predicted map[string]interface{} `json:"predicted,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	LatencyMs int64                  `json:"latencyMs"`
+	// Correct tells for each scored field whether the prediction matched,
+	// counting a null prediction for a field the listing does not state.
+	Correct map[string]bool `json:"correct"`
+}
+
+// FieldScore aggregates one field over all cases.
+type FieldScore struct {
+	Cases     int `json:"cases"`
+	Expected  int `json:"expected"`
+	Predicted int `json:"predicted"`
+	Correct   int `json:"correct"`
+	Matched   int `json:"matched"`
+	// Precision is the share of non-null predictions that were right.
+	Precision float64 `json:"precision"`
+	// Recall is the share of stated values that were extracted correctly.
+	Recall float64 `json:"recall"`
+	// ExactMatch is the share of cases where the prediction, null or not, matched.
+	ExactMatch float64 `json:"exactMatch"`
+	// MeanAbsError and MeanAbsPctError cover numeric fields where both the
+	// expected and the predicted value are present.
+	MeanAbsError    *float64 `json:"meanAbsError,omitempty"`
+	MeanAbsPctError *float64 `json:"meanAbsPctError,omitempty"`
+
+	absErrors []float64
+	pctErrors []float64
+}
+
+// EvalRun is a complete evaluation, saved as JSON so runs can be diffed.
+type EvalRun struct {
+	StartedAt     time.Time              `json:"startedAt"`
+	Provider      string                 `json:"provider"`
+	Model         string                 `json:"model"`
+	PromptVersion int                    `json:"promptVersion"`
+	Tolerance     float64                `json:"tolerance"`
+	Cases         []EvalResult           `json:"cases"`
+	Errors        int                    `json:"errors"`
+	Fields        map[string]*FieldScore `json:"fields"`
+	Overall       *FieldScore            `json:"overall"`
+}
+
+// LoadEvalCases reads every <name>.txt listing in dir that has a matching
+// <name>.expected.json, with <name>.html when there is one. The listing text is
+// what the extension captures, e.g. the content of a raw_page_data record.
+func LoadEvalCases(dir string) ([]EvalCase, error) {
+	expectedFiles, err := filepath.Glob(filepath.Join(dir, "*.expected.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(expectedFiles)
+
+	var cases []EvalCase
+	for _, expectedFile := range expectedFiles {
+		name := strings.TrimSuffix(filepath.Base(expectedFile), ".expected.json")
+		content, err := os.ReadFile(filepath.Join(dir, name+".txt"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read listing for %s: %v", name, err)
+		}
+		raw, err := os.ReadFile(expectedFile)
+		if err != nil {
+			return nil, err
+		}
+		var expected map[string]interface{}
+		if err := json.Unmarshal(raw, &expected); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", filepath.Base(expectedFile), err)
+		}
+		page, err := os.ReadFile(filepath.Join(dir, name+".html"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		cases = append(cases, EvalCase{Name: name, Content: string(content), HTML: string(page), Expected: expected})
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("no *.expected.json cases in %s", dir)
+	}
+	return cases, nil
+}
+
+// RunExtractionEval extracts every case with the configured provider, at most
+// concurrency at a time, and scores the results. Numbers within tolerance
+// (relative, e.g. 0.01 for 1%) of the expected value count as correct.
+func RunExtractionEval(ctx context.Context, cases []EvalCase, concurrency int, tolerance float64) (*EvalRun, error) {
+	run := &EvalRun{StartedAt: time.Now(), Tolerance: tolerance}
+	provider, model, err := providerForTask(ctx, TaskExtraction)
+	if err != nil {
+		return nil, err
+	}
+	run.Provider, run.Model = provider.Name(), model
+	if refs := consensusRefs(); refs != nil {
+		run.Provider, run.Model = ProviderConsensus, consensusIdentity(refs)
+	}
+	tmpl, err := activePromptTemplate(ctx, PromptExtraction)
+	if err != nil {
+		return nil, err
+	}
+	run.PromptVersion = tmpl.Version
+
+	run.Cases = make([]EvalResult, len(cases))
+	slots := make(chan struct{}, max(1, concurrency))
+	var wg sync.WaitGroup
+	for i, c := range cases {
+		wg.Add(1)
+		go func(i int, c EvalCase) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			start := time.Now()
+			_, provenance, err := ExtractPageDetails(ctx, &RawPageData{Content: c.Content, HTML: c.HTML})
+			result := EvalResult{
+				Name:      c.Name,
+				Expected:  c.Expected,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Predicted = map[string]interface{}{}
+				for _, name := range evalFields {
+					if v := provenance[name].Value; v != nil {
+						result.Predicted[name] = v
+					}
+				}
+			}
+			run.Cases[i] = result
+		}(i, c)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	scoreEvalRun(run)
+	return run, nil
+}
+
+// scoreEvalRun fills in Correct for every case and the field scores. A case
+// whose extraction failed counts as predicting nothing.
+func scoreEvalRun(run *EvalRun) {
+	run.Fields = map[string]*FieldScore{}
+	run.Overall = &FieldScore{}
+	run.Errors = 0
+	for _, name := range evalFields {
+		run.Fields[name] = &FieldScore{}
+	}
+
+	for i := range run.Cases {
+		result := &run.Cases[i]
+		if result.Error != "" {
+			run.Errors++
+		}
+		result.Correct = map[string]bool{}
+		for _, name := range evalFields {
+			expected, predicted := result.Expected[name], result.Predicted[name]
+			score := run.Fields[name]
+			for _, s := range []*FieldScore{score, run.Overall} {
+				s.Cases++
+				if expected != nil {
+					s.Expected++
+				}
+				if predicted != nil {
+					s.Predicted++
+				}
+			}
+
+			match := evalValuesMatch(name, expected, predicted, run.Tolerance)
+			result.Correct[name] = match
+			if match {
+				score.Matched++
+				run.Overall.Matched++
+				if predicted != nil {
+					score.Correct++
+					run.Overall.Correct++
+				}
+			}
+
+			if evalNumericFields[name] && expected != nil && predicted != nil {
+				want, wok := evalNumber(expected)
+				got, gok := evalNumber(predicted)
+				if wok && gok {
+					score.absErrors = append(score.absErrors, math.Abs(got-want))
+					if want != 0 {
+						score.pctErrors = append(score.pctErrors, math.Abs(got-want)/math.Abs(want))
+					}
+				}
+			}
+		}
+	}
+
+	for _, score := range run.Fields {
+		score.finish()
+	}
+	run.Overall.finish()
+}
+
+func (s *FieldScore) finish() {
+	ratio := func(a, b int) float64 {
+		if b == 0 {
+			return 0
+		}
+		return float64(a) / float64(b)
+	}
+	mean := func(values []float64) *float64 {
+		if len(values) == 0 {
+			return nil
+		}
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		m := sum / float64(len(values))
+		return &m
+	}
+	s.Precision = ratio(s.Correct, s.Predicted)
+	s.Recall = ratio(s.Correct, s.Expected)
+	s.ExactMatch = ratio(s.Matched, s.Cases)
+	s.MeanAbsError = mean(s.absErrors)
+	s.MeanAbsPctError = mean(s.pctErrors)
+}
+
+// evalValuesMatch compares an expected and a predicted value. Strings match
+// when their letters and digits do, numbers within the relative tolerance.
+func evalValuesMatch(field string, expected, predicted interface{}, tolerance float64) bool {
+	if expected == nil || predicted == nil {
+		return expected == nil && predicted == nil
+	}
+	if evalNumericFields[field] {
+		want, wok := evalNumber(expected)
+		got, gok := evalNumber(predicted)
+		if !wok || !gok {
+			return false
+		}
+		return math.Abs(got-want) <= tolerance*math.Abs(want)+1e-9
+	}
+	return alphanumeric(fmt.Sprint(expected)) == alphanumeric(fmt.Sprint(predicted))
+}
+
+func evalNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// FieldDiff compares one field between two runs; deltas are new minus old.
+type FieldDiff struct {
+	Field                string   `json:"field"`
+	Precision            float64  `json:"precision"`
+	PrecisionDelta       float64  `json:"precisionDelta"`
+	Recall               float64  `json:"recall"`
+	RecallDelta          float64  `json:"recallDelta"`
+	ExactMatch           float64  `json:"exactMatch"`
+	ExactMatchDelta      float64  `json:"exactMatchDelta"`
+	MeanAbsPctError      *float64 `json:"meanAbsPctError,omitempty"`
+	MeanAbsPctErrorDelta *float64 `json:"meanAbsPctErrorDelta,omitempty"`
+}
+
+// CaseDiff lists the fields of one case that got better or worse.
+type CaseDiff struct {
+	Name        string   `json:"name"`
+	Fixed       []string `json:"fixed,omitempty"`
+	Regressed   []string `json:"regressed,omitempty"`
+	NewError    string   `json:"newError,omitempty"`
+	ErrorFixed  bool     `json:"errorFixed,omitempty"`
+	OnlyInRun   string   `json:"onlyInRun,omitempty"`
+	LatencyDiff int64    `json:"latencyDiffMs"`
+}
+
+// EvalDiff compares two runs over the cases they share.
+type EvalDiff struct {
+	Old    string      `json:"old"`
+	New    string      `json:"new"`
+	Fields []FieldDiff `json:"fields"`
+	Cases  []CaseDiff  `json:"cases,omitempty"`
+}
+
+// DiffEvalRuns compares two runs field by field and case by case. Only cases
+// whose results changed are listed.
+func DiffEvalRuns(before, after *EvalRun) *EvalDiff {
+	describe := func(r *EvalRun) string {
+		return fmt.Sprintf("%s/%s prompt v%d (%s)", r.Provider, r.Model, r.PromptVersion, r.StartedAt.Format(time.RFC3339))
+	}
+	diff := &EvalDiff{Old: describe(before), New: describe(after)}
+
+	fieldDiff := func(name string, o, n *FieldScore) FieldDiff {
+		d := FieldDiff{
+			Field:           name,
+			Precision:       n.Precision,
+			PrecisionDelta:  n.Precision - o.Precision,
+			Recall:          n.Recall,
+			RecallDelta:     n.Recall - o.Recall,
+			ExactMatch:      n.ExactMatch,
+			ExactMatchDelta: n.ExactMatch - o.ExactMatch,
+			MeanAbsPctError: n.MeanAbsPctError,
+		}
+		if o.MeanAbsPctError != nil && n.MeanAbsPctError != nil {
+			delta := *n.MeanAbsPctError - *o.MeanAbsPctError
+			d.MeanAbsPctErrorDelta = &delta
+		}
+		return d
+	}
+	for _, name := range evalFields {
+		o, n := before.Fields[name], after.Fields[name]
+		if o == nil || n == nil {
+			continue
+		}
+		diff.Fields = append(diff.Fields, fieldDiff(name, o, n))
+	}
+	if before.Overall != nil && after.Overall != nil {
+		diff.Fields = append(diff.Fields, fieldDiff("overall", before.Overall, after.Overall))
+	}
+
+	oldCases := map[string]*EvalResult{}
+	for i := range before.Cases {
+		oldCases[before.Cases[i].Name] = &before.Cases[i]
+	}
+	seen := map[string]bool{}
+	for i := range after.Cases {
+		n := &after.Cases[i]
+		seen[n.Name] = true
+		o, ok := oldCases[n.Name]
+		if !ok {
+			diff.Cases = append(diff.Cases, CaseDiff{Name: n.Name, OnlyInRun: "new"})
+			continue
+		}
+		cd := CaseDiff{Name: n.Name, LatencyDiff: n.LatencyMs - o.LatencyMs}
+		for _, name := range evalFields {
+			switch {
+			case n.Correct[name] && !o.Correct[name]:
+				cd.Fixed = append(cd.Fixed, name)
+			case !n.Correct[name] && o.Correct[name]:
+				cd.Regressed = append(cd.Regressed, name)
+			}
+		}
+		if n.Error != "" && o.Error == "" {
+			cd.NewError = n.Error
+		}
+		cd.ErrorFixed = n.Error == "" && o.Error != ""
+		if len(cd.Fixed) > 0 || len(cd.Regressed) > 0 || cd.NewError != "" || cd.ErrorFixed {
+			diff.Cases = append(diff.Cases, cd)
+		}
+	}
+	for _, o := range before.Cases {
+		if !seen[o.Name] {
+			diff.Cases = append(diff.Cases, CaseDiff{Name: o.Name, OnlyInRun: "old"})
+		}
+	}
+	return diff
+}
+
+// ExtractorFixtureResult is the outcome of running the extractor for a host
+// on one saved page.
+type ExtractorFixtureResult struct {
+	Host      string `json:"host"`
+	Name      string `json:"name"`
+	Extractor string `json:"extractor"`
+	// Mismatches describe each field read differently than expected.
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+// CheckExtractorFixtures runs the registered site extractors on the saved
+// pages in dir/<host>/, laid out like evaluation cases, and compares the
+// fields they and the structured data read with <name>.expected.json. Fields
+// missing from Expected, or null, must be left to the LLM. No LLM is called.
+func CheckExtractorFixtures(dir string) ([]ExtractorFixtureResult, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ExtractorFixtureResult
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		host := entry.Name()
+		cases, err := LoadEvalCases(filepath.Join(dir, host))
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cases {
+			page := &RawPageData{URL: "https://" + host + "/", Content: c.Content, HTML: c.HTML}
+			known := readPage(page)
+			result := ExtractorFixtureResult{Host: host, Name: c.Name, Extractor: page.Extractor}
+			if page.Extractor == ExtractorGeneric {
+				result.Mismatches = append(result.Mismatches, "no site extractor read the page")
+			}
+			for _, name := range evalFields {
+				expected, got := c.Expected[name], known[name].Value
+				if !evalValuesMatch(name, expected, got, 0) {
+					result.Mismatches = append(result.Mismatches, fmt.Sprintf("%s: expected %v, got %v", name, expected, got))
+				}
+			}
+			results = append(results, result)
+		}
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no host directories with fixtures in %s", dir)
+	}
+	return results, nil
+}
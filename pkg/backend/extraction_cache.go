@@ -0,0 +1,320 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ExtractionCacheEntry is a stored extraction result, reused when the same
+// listing text is captured again with the same prompt version and model.
+type ExtractionCacheEntry struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Key           string             `bson:"key" json:"key"`
+	ContentHash   string             `bson:"contentHash" json:"contentHash"`
+	PromptVersion int                `bson:"promptVersion" json:"promptVersion"`
+	// PromptHash hashes the prompt text and schema, which change between
+	// releases while the built-in prompt stays version 0.
+	PromptHash string `bson:"promptHash" json:"promptHash"`
+	Provider   string `bson:"provider" json:"provider"`
+	Model      string `bson:"model" json:"model"`
+	// Fields are the fields extracted by the LLM when the page's structured
+	// data stated the others; empty when all fields were extracted.
+	Fields     []string                   `bson:"fields,omitempty" json:"fields,omitempty"`
+	Address    string                     `bson:"address" json:"address"`
+	Details    *PropertyDetails           `bson:"details" json:"details"`
+	Provenance map[string]FieldProvenance `bson:"provenance,omitempty" json:"provenance,omitempty"`
+	Hits       int                        `bson:"hits" json:"hits"`
+	CreatedAt  time.Time                  `bson:"createdAt" json:"createdAt"`
+	LastHitAt  *time.Time                 `bson:"lastHitAt,omitempty" json:"lastHitAt,omitempty"`
+}
+
+// Lookups since the process started; the stored entries keep all-time hit counts.
+var extractionCacheHits, extractionCacheMisses atomic.Int64
+
+// contentHash hashes the listing text after boilerplate removal and whitespace
+// normalization, so captures that differ only in page chrome share an entry.
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(cleanListingContent(content)))
+	return hex.EncodeToString(sum[:])
+}
+
+// extractionPromptHash hashes the extraction prompt text and the schema the
+// fields are extracted with. The built-in text is included as consensus runs
+// may use it whichever version is active.
+func extractionPromptHash(tmpl *PromptTemplate, fields []string) string {
+	sum := sha256.Sum256([]byte(tmpl.Template + "\x00" + defaultPromptTemplates[PromptExtraction] + "\x00" + chunkExtractionSchema(fields...).String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// extractionCacheKey identifies an extraction by content, prompt version and
+// text, provider, model and, when not all fields were extracted, the extracted
+// fields.
+func extractionCacheKey(hash string, promptVersion int, promptHash, provider, model string, fields []string) string {
+	key := hash + "\x00" + strconv.Itoa(promptVersion) + "\x00" + promptHash + "\x00" + provider + "\x00" + model
+	if fields != nil {
+		key += "\x00" + strings.Join(fields, ",")
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ExtractPropertyDetailsCached is ExtractPageDetails returning the stored
+// extraction for identical content when there is one, and otherwise extracting
+// and storing the result. With refresh, the stored entry is ignored and replaced.
+// The site extractor and structured data are always read again and win over
+// stored values.
+func ExtractPropertyDetailsCached(ctx context.Context, page *RawPageData, refresh bool) (*PropertyDetails, map[string]FieldProvenance, bool, error) {
+	if extractionCacheCollection == nil {
+		details, provenance, err := ExtractPageDetails(ctx, page)
+		return details, provenance, false, err
+	}
+
+	content := page.Content
+	known := readPage(page)
+	fields := missingFields(known)
+	if known != nil && len(fields) == 0 {
+		details, provenance, err := detailsWithStructuredData(known, nil)
+		return details, provenance, false, err
+	}
+
+	tmpl, err := activePromptTemplate(ctx, PromptExtraction)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	entry := ExtractionCacheEntry{
+		ContentHash:   contentHash(content),
+		PromptVersion: tmpl.Version,
+		PromptHash:    extractionPromptHash(tmpl, fields),
+		Fields:        fields,
+	}
+	if refs := consensusRefs(); refs != nil {
+		entry.Provider = ProviderConsensus
+		entry.Model = consensusIdentity(refs)
+	} else {
+		provider, model, err := providerForTask(ctx, TaskExtraction)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		entry.Provider = provider.Name()
+		entry.Model = model
+	}
+	entry.Key = extractionCacheKey(entry.ContentHash, entry.PromptVersion, entry.PromptHash, entry.Provider, entry.Model, fields)
+
+	if !refresh {
+		var cached ExtractionCacheEntry
+		now := time.Now()
+		err := extractionCacheCollection.FindOneAndUpdate(ctx,
+			bson.M{"key": entry.Key},
+			bson.M{"$inc": bson.M{"hits": 1}, "$set": bson.M{"lastHitAt": now}},
+		).Decode(&cached)
+		if err == nil && cached.Details != nil {
+			extractionCacheHits.Add(1)
+			log.Info().Str("address", cached.Details.Address).Msg("Reusing cached extraction")
+			// The raw text may differ in whitespace, so evidence is located again
+			for name, prov := range cached.Provenance {
+				if prov.Evidence != "" {
+					prov.Span = locateEvidence(content, prov.Evidence)
+					cached.Provenance[name] = prov
+				}
+			}
+			if known == nil {
+				return cached.Details, cached.Provenance, true, nil
+			}
+			details, provenance, err := detailsWithStructuredData(known, cached.Provenance)
+			return details, provenance, true, err
+		}
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Error().Err(err).Msg("Failed to read extraction cache")
+		}
+	}
+	extractionCacheMisses.Add(1)
+
+	_, extracted, err := extractListing(ctx, content, fields)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	details, provenance, err := detailsWithStructuredData(known, extracted)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	entry.Address = details.Address
+	entry.Details = details
+	entry.Provenance = provenance
+	entry.CreatedAt = time.Now()
+	_, err = extractionCacheCollection.ReplaceOne(ctx, bson.M{"key": entry.Key}, entry, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to store extraction in cache")
+	}
+	return details, provenance, false, nil
+}
+
+// extractionCacheFilter builds a filter from the provider, model,
+// promptVersion, address and olderThan (days) query parameters.
+func extractionCacheFilter(c *fiber.Ctx) (bson.M, error) {
+	filter := bson.M{}
+	for _, field := range []string{"provider", "model", "address"} {
+		if v := c.Query(field); v != "" {
+			filter[field] = v
+		}
+	}
+	if v := c.Query("promptVersion"); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid promptVersion")
+		}
+		filter["promptVersion"] = version
+	}
+	if v := c.Query("olderThan"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid olderThan, expected a number of days")
+		}
+		filter["createdAt"] = bson.M{"$lt": time.Now().AddDate(0, 0, -days)}
+	}
+	return filter, nil
+}
+
+// handleGetExtractionCache reports the extraction cache size and hit rates,
+// grouped by provider, model and prompt version.
+func handleGetExtractionCache(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	filter, err := extractionCacheFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"provider":      "$provider",
+				"model":         "$model",
+				"promptVersion": "$promptVersion",
+			},
+			"entries":   bson.M{"$sum": 1},
+			"hits":      bson.M{"$sum": "$hits"},
+			"lastHitAt": bson.M{"$max": "$lastHitAt"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "entries", Value: -1}}}},
+	}
+	cursor, err := extractionCacheCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Key struct {
+			Provider      string `bson:"provider" json:"provider"`
+			Model         string `bson:"model" json:"model"`
+			PromptVersion int    `bson:"promptVersion" json:"promptVersion"`
+		} `bson:"_id" json:"key"`
+		Entries   int        `bson:"entries" json:"entries"`
+		Hits      int        `bson:"hits" json:"hits"`
+		LastHitAt *time.Time `bson:"lastHitAt" json:"lastHitAt,omitempty"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Every entry was stored after a miss, so hits / (hits + entries) is the
+	// all-time hit rate of the entries still cached.
+	entries, hits := 0, 0
+	for _, g := range groups {
+		entries += g.Entries
+		hits += g.Hits
+	}
+	rate := func(hits, misses int64) float64 {
+		if hits+misses == 0 {
+			return 0
+		}
+		return float64(hits) / float64(hits+misses)
+	}
+
+	sessionHits, sessionMisses := extractionCacheHits.Load(), extractionCacheMisses.Load()
+	return c.JSON(fiber.Map{
+		"entries": entries,
+		"hits":    hits,
+		"hitRate": rate(int64(hits), int64(entries)),
+		"sinceStart": fiber.Map{
+			"hits":    sessionHits,
+			"misses":  sessionMisses,
+			"hitRate": rate(sessionHits, sessionMisses),
+		},
+		"groups": groups,
+	})
+}
+
+// handleListExtractionCacheEntries returns the most recently used entries
+// matching the filters, without their provenance.
+func handleListExtractionCacheEntries(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	filter, err := extractionCacheFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	limit := int64(c.QueryInt("limit", 50))
+
+	cursor, err := extractionCacheCollection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "lastHitAt", Value: -1}, {Key: "createdAt", Value: -1}}).
+		SetLimit(limit).
+		SetProjection(bson.M{"provenance": 0}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer cursor.Close(ctx)
+
+	entries := []ExtractionCacheEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(entries)
+}
+
+// handlePurgeExtractionCache deletes the entries matching the same filters as
+// handleGetExtractionCache; without filters the whole cache is cleared.
+func handlePurgeExtractionCache(c *fiber.Ctx) error {
+	filter, err := extractionCacheFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	res, err := extractionCacheCollection.DeleteMany(c.UserContext(), filter)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"deleted": res.DeletedCount})
+}
+
+// handleDeleteExtractionCacheEntry deletes one entry by ID.
+func handleDeleteExtractionCacheEntry(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cache entry ID"})
+	}
+
+	res, err := extractionCacheCollection.DeleteOne(c.UserContext(), bson.M{"_id": objID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if res.DeletedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Cache entry not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Cache entry deleted"})
+}
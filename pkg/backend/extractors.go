@@ -0,0 +1,274 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Extractor reads PropertyDetails fields from captured pages of the sites it
+// is registered for. Fields it cannot read are extracted by the LLM.
+type Extractor interface {
+	// Name is recorded in raw_page_data.extractor and FieldProvenance.Source.
+	Name() string
+	// Extract returns the fields it read from the page. An error makes the
+	// capture fall back to the generic extractor.
+	Extract(page *RawPageData) (map[string]FieldProvenance, error)
+}
+
+// ExtractorGeneric names the fallback for hosts without an extractor of their
+// own: only structured data is read and the LLM extracts the rest.
+const ExtractorGeneric = "generic"
+
+type genericExtractor struct{}
+
+func (genericExtractor) Name() string { return ExtractorGeneric }
+
+func (genericExtractor) Extract(*RawPageData) (map[string]FieldProvenance, error) {
+	return nil, nil
+}
+
+// hostExtractor registers an extractor for the hosts matching pattern.
+type hostExtractor struct {
+	pattern   string
+	extractor Extractor
+}
+
+var (
+	extractorsMu sync.RWMutex
+	extractors   = []hostExtractor{
+		{"zillow.com", zillowExtractor},
+		{"redfin.com", redfinExtractor},
+		{"realtor.com", realtorExtractor},
+	}
+)
+
+// RegisterExtractor adds an extractor for the hosts matching pattern: a
+// hostname, which also matches its subdomains, or a glob such as
+// "*.example.com". Later registrations take precedence.
+func RegisterExtractor(pattern string, e Extractor) {
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	extractors = append(extractors, hostExtractor{strings.ToLower(pattern), e})
+}
+
+// extractorFor returns the extractor registered for the host of rawURL, or
+// the generic one.
+func extractorFor(rawURL string) Extractor {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Hostname() == "" {
+		return genericExtractor{}
+	}
+	host := strings.ToLower(u.Hostname())
+
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+	for i := len(extractors) - 1; i >= 0; i-- {
+		if hostMatches(extractors[i].pattern, host) {
+			return extractors[i].extractor
+		}
+	}
+	return genericExtractor{}
+}
+
+func hostMatches(pattern, host string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, host)
+		return ok
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// readPage runs the extractor for the page's host, falling back to the
+// generic one when it fails, and records its name in page.Extractor.
+// Structured data in the HTML wins over the fields the extractor read.
+func readPage(page *RawPageData) map[string]FieldProvenance {
+	extractor := extractorFor(page.URL)
+	values, err := extractor.Extract(page)
+	if err != nil {
+		log.Warn().Err(err).Str("url", page.URL).Str("extractor", extractor.Name()).Msg("Site extractor failed, using the generic extractor")
+		extractor, values = genericExtractor{}, nil
+	}
+	page.Extractor = extractor.Name()
+
+	known := withStructuredData(parseStructuredData(page.HTML), values)
+	if len(known) == 0 {
+		return nil
+	}
+	return known
+}
+
+// textRule reads one field from the first match of pattern in the listing
+// text. The first submatch holds the value.
+type textRule struct {
+	field   string
+	pattern *regexp.Regexp
+	parse   func(string) (interface{}, bool)
+}
+
+// textExtractor reads fields from the visible listing text with patterns that
+// fit the layout of one site. The first rule that matches a field wins.
+type textExtractor struct {
+	name  string
+	rules []textRule
+}
+
+func (e *textExtractor) Name() string { return e.name }
+
+func (e *textExtractor) Extract(page *RawPageData) (map[string]FieldProvenance, error) {
+	// Carousels of other homes are dropped so their figures are not matched
+	text := cleanListingContent(page.Content)
+	schema := SchemaFor(PropertyDetails{})
+
+	provenance := map[string]FieldProvenance{}
+	for _, rule := range e.rules {
+		if _, ok := provenance[rule.field]; ok {
+			continue
+		}
+		m := rule.pattern.FindStringSubmatch(text)
+		if m == nil {
+			continue
+		}
+		value, ok := rule.parse(m[1])
+		if !ok {
+			continue
+		}
+		raw, _ := json.Marshal(value)
+		if errs := ValidateJSON(schema.Properties[rule.field], raw); len(errs) > 0 {
+			continue
+		}
+		evidence := strings.Join(strings.Fields(m[0]), " ")
+		provenance[rule.field] = FieldProvenance{
+			Value:      value,
+			Confidence: 1,
+			Evidence:   evidence,
+			Span:       locateEvidence(page.Content, evidence),
+			Source:     e.name,
+		}
+	}
+	if len(provenance) == 0 {
+		return nil, fmt.Errorf("no listing details found on the page")
+	}
+	return provenance, nil
+}
+
+func parseText(s string) (interface{}, bool) {
+	s = strings.Join(strings.Fields(s), " ")
+	return s, s != ""
+}
+
+// parseNumber reads a number with thousands separators. Whole numbers are
+// float64 like the values decoded from LLM answers.
+func parseNumber(s string) (interface{}, bool) {
+	f, err := strconv.ParseFloat(strings.ReplaceAll(s, ",", ""), 64)
+	return f, err == nil
+}
+
+// parseReduction reads a price cut as a negative change.
+func parseReduction(s string) (interface{}, bool) {
+	v, ok := parseNumber(s)
+	if !ok {
+		return nil, false
+	}
+	return -v.(float64), true
+}
+
+// listingStatuses map the status labels of the portals to ListingStatus values.
+var listingStatuses = map[string]string{
+	"for sale": "active", "active": "active", "new": "active", "coming soon": "active",
+	"pending": "pending", "under contract": "pending", "contingent": "pending",
+	"sold": "sold", "recently sold": "sold",
+}
+
+func parseStatus(s string) (interface{}, bool) {
+	status, ok := listingStatuses[strings.ToLower(strings.Join(strings.Fields(s), " "))]
+	return status, ok
+}
+
+// parseDate reads a M/D/YYYY date as YYYY-MM-DD.
+func parseDate(s string) (interface{}, bool) {
+	t, err := time.Parse("1/2/2006", strings.TrimSpace(s))
+	if err != nil {
+		return nil, false
+	}
+	return t.Format(time.DateOnly), true
+}
+
+func parseLotSquareFeet(s string) (interface{}, bool) {
+	sqft, ok := lotSizeSquareFeet(s)
+	return sqft, ok
+}
+
+// parseYesNo reads whether a feature is present: "No" and "None" mean it is
+// not, any other description that it is.
+func parseYesNo(s string) (interface{}, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return nil, false
+	case "no", "none", "n":
+		return false, true
+	}
+	return true, true
+}
+
+// listingRules read the summary and facts that the supported portals lay out
+// alike. Site rules come first so they win.
+var listingRules = []textRule{
+	{"address", regexp.MustCompile(`(?m)^(\d+[^,\n]*,\s*[^,\n]+,\s*[A-Z]{2}\s+\d{5}(?:-\d{4})?)$`), parseText},
+	{"price", regexp.MustCompile(`(?m)^\$(\d{1,3}(?:,\d{3})+)$`), parseNumber},
+	{"bedrooms", regexp.MustCompile(`(?i)\b(\d+)\s*(?:bds?|beds?)\b`), parseNumber},
+	{"bathrooms", regexp.MustCompile(`(?i)\b(\d+(?:\.\d+)?)\s*(?:ba|baths?)\b`), parseNumber},
+	{"squareFootage", regexp.MustCompile(`(?i)\b(\d{1,3}(?:,\d{3})+|\d+)\s*(?:sqft|sq\.?\s?ft)\b`), parseNumber},
+	{"yearBuilt", regexp.MustCompile(`(?i)\b(?:built in|year built:?)\s*(\d{4})\b`), parseNumber},
+	{"propertyType", regexp.MustCompile(`(?m)^(Single Family Residence|Single Family|Single-family|Condominium|Condo|Townhouse|Townhome|Multi[- ]Family|Manufactured|Mobile Home|Cooperative|Co-op|Apartment|Land)$`), parseText},
+	{"propertyType", regexp.MustCompile(`(?i)\b(?:property|home) type:?\s*([^\n]+)`), parseText},
+	{"lotSize", regexp.MustCompile(`(?i)\blot\s+size:?\s*(\d[\d.,]*\s*(?:acres?|sqft|sq\.?\s?ft))`), parseText},
+	{"lotSize", regexp.MustCompile(`(?i)\b(\d[\d.,]*\s*(?:acres?|sqft|sq\.?\s?ft))\.?\s+lot\b`), parseText},
+	{"mlsNumber", regexp.MustCompile(`(?i)\bMLS\s*(?:#|number|ID\s*#?)\s*:?\s*([A-Z0-9][A-Z0-9-]*)`), parseText},
+	{"listingStatus", regexp.MustCompile(`(?im)^(for sale|active|new|coming soon|pending|under contract|contingent|sold|recently sold)$`), parseStatus},
+	{"listPrice", regexp.MustCompile(`(?i)\blist(?:ing)? price:?\s*\$(\d{1,3}(?:,\d{3})+)`), parseNumber},
+	{"soldPrice", regexp.MustCompile(`(?i)\bsold (?:price|for):?\s*\$(\d{1,3}(?:,\d{3})+)`), parseNumber},
+	{"listDate", regexp.MustCompile(`(?i)\b(?:listed on|list date|listing date|date on market):?\s*(\d{1,2}/\d{1,2}/\d{4})`), parseDate},
+	{"soldDate", regexp.MustCompile(`(?i)\b(?:sold on|sold date|date sold):?\s*(\d{1,2}/\d{1,2}/\d{4})`), parseDate},
+	{"closeDate", regexp.MustCompile(`(?i)\b(?:closed on|close date|closing date):?\s*(\d{1,2}/\d{1,2}/\d{4})`), parseDate},
+	{"hoaDues", regexp.MustCompile(`(?im)\bHOA (?:fees?|dues):?\s*\$(\d[\d,]*)(?:\s*/\s*mo(?:nth)?\b|\s*(?:monthly|per month)\b|[ \t]*$)`), parseNumber},
+	{"hoaDues", regexp.MustCompile(`(?im)^\$(\d[\d,]*)(?:/mo)? HOA$`), parseNumber},
+	{"annualTaxes", regexp.MustCompile(`(?im)\b(?:annual tax amount|annual taxes|property taxes?):?\s*\$(\d[\d,]*)(?:\s*(?:/\s*yr|per year|annually)\b|[ \t]*$)`), parseNumber},
+	{"garageSpaces", regexp.MustCompile(`(?im)\bgarage(?: spaces)?:?\s*(\d+)(?:\s*cars?\b|[ \t]*$)`), parseNumber},
+	{"stories", regexp.MustCompile(`(?i)\b(?:stories|levels):?\s*(\d+(?:\.\d+)?)\b`), parseNumber},
+	{"basement", regexp.MustCompile(`(?im)^basement(?: features)?:?[ \t]*\n?[ \t]*([^\n]+)$`), parseYesNo},
+	{"pool", regexp.MustCompile(`(?im)^pool(?: features)?:?[ \t]*\n?[ \t]*([^\n]+)$`), parseYesNo},
+	{"lotSizeSqFt", regexp.MustCompile(`(?i)\blot\s+size:?\s*(\d[\d.,]*\s*(?:acres?|sqft|sq\.?\s?ft))`), parseLotSquareFeet},
+	{"lotSizeSqFt", regexp.MustCompile(`(?i)\b(\d[\d.,]*\s*(?:acres?|sqft|sq\.?\s?ft))\.?\s+lot\b`), parseLotSquareFeet},
+	{"subdivision", regexp.MustCompile(`(?im)^subdivision(?: name)?:?[ \t]*\n?[ \t]*([^\n]+)$`), parseText},
+	{"schoolDistrict", regexp.MustCompile(`(?im)^school district(?: name)?:?[ \t]*\n?[ \t]*([^\n]+)$`), parseText},
+}
+
+func siteRules(rules ...textRule) []textRule {
+	return append(rules, listingRules...)
+}
+
+var zillowExtractor = &textExtractor{name: "zillow", rules: siteRules(
+	textRule{"daysOnMarket", regexp.MustCompile(`(?i)\b(\d+)\s+days?\s+on\s+Zillow\b`), parseNumber},
+	textRule{"lastPriceChange", regexp.MustCompile(`(?i)\bprice cut:?\s*-?\$(\d[\d,]*)`), parseReduction},
+)}
+
+var redfinExtractor = &textExtractor{name: "redfin", rules: siteRules(
+	textRule{"daysOnMarket", regexp.MustCompile(`(?i)\btime on Redfin:?\s*(\d+)\s+days?\b`), parseNumber},
+	textRule{"daysOnMarket", regexp.MustCompile(`(?i)\b(\d+)\s+days?\s+on\s+Redfin\b`), parseNumber},
+	textRule{"lastPriceChange", regexp.MustCompile(`(?i)\bprice (?:cut|drop|reduced)(?: by)?:?\s*-?\$(\d[\d,]*)`), parseReduction},
+)}
+
+var realtorExtractor = &textExtractor{name: "realtor", rules: siteRules(
+	textRule{"daysOnMarket", regexp.MustCompile(`(?i)\btime on realtor\.com:?\s*(\d+)\s+days?\b`), parseNumber},
+	textRule{"daysOnMarket", regexp.MustCompile(`(?i)\b(\d+)\s+days?\s+on\s+realtor\.com\b`), parseNumber},
+	textRule{"lastPriceChange", regexp.MustCompile(`(?i)\bprice (?:cut|reduced)(?: by)?:?\s*-?\$(\d[\d,]*)`), parseReduction},
+)}
@@ -0,0 +1,126 @@
+package backend
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// extractorFixtures are the saved portal pages checked by bma-eval extractors.
+var extractorFixtures = filepath.Join("..", "..", "eval", "extractors")
+
+func TestExtractorFixtures(t *testing.T) {
+	results, err := CheckExtractorFixtures(extractorFixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		t.Run(r.Host+"/"+r.Name, func(t *testing.T) {
+			if want := strings.TrimSuffix(r.Host, ".com"); r.Extractor != want {
+				t.Errorf("page read by %q, want %q", r.Extractor, want)
+			}
+			for _, m := range r.Mismatches {
+				t.Error(m)
+			}
+		})
+	}
+}
+
+func TestSiteExtractorFields(t *testing.T) {
+	cases, err := LoadEvalCases(filepath.Join(extractorFixtures, "zillow.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		values, err := zillowExtractor.Extract(&RawPageData{URL: "https://www.zillow.com/", Content: c.Content})
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name, err)
+		}
+		for name, prov := range values {
+			if prov.Source != "zillow" || prov.Confidence != 1 || prov.Evidence == "" {
+				t.Errorf("%s: %s has provenance %+v, want the zillow source, confidence 1 and evidence", c.Name, name, prov)
+			}
+		}
+	}
+}
+
+func TestLabelValueLinesKeepTheirLabels(t *testing.T) {
+	content := "123 Maple St, Columbus, OH 43215\n$300,000\nBasement\nNo\nPool\nNo\nSubdivision\nMaple Grove\nStories\n2\nGarage spaces\n2"
+	values, err := zillowExtractor.Extract(&RawPageData{Content: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"basement": false, "pool": false, "subdivision": "Maple Grove", "stories": 2.0}
+	for name, expected := range want {
+		if got := values[name].Value; got != expected {
+			t.Errorf("%s = %v, want %v", name, got, expected)
+		}
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"zillow.com", "zillow.com", true},
+		{"zillow.com", "www.zillow.com", true},
+		{"zillow.com", "notzillow.com", false},
+		{"zillow.com", "zillow.com.example.org", false},
+		{"*.example.com", "homes.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"listings-?.example.com", "listings-1.example.com", true},
+	}
+	for _, tt := range tests {
+		if got := hostMatches(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("hostMatches(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestExtractorFor(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"https://www.zillow.com/homedetails/123", "zillow"},
+		{"https://REDFIN.COM/OH/Columbus/77-Birch-Ave", "redfin"},
+		{"https://www.realtor.com/realestateandhomes-detail/48", "realtor"},
+		{"https://www.homes.com/property/1", ExtractorGeneric},
+		{"not a url", ExtractorGeneric},
+		{"", ExtractorGeneric},
+	}
+	for _, tt := range tests {
+		if got := extractorFor(tt.url).Name(); got != tt.want {
+			t.Errorf("extractorFor(%q) = %s, want %s", tt.url, got, tt.want)
+		}
+	}
+}
+
+type failingExtractor struct{}
+
+func (failingExtractor) Name() string { return "failing" }
+
+func (failingExtractor) Extract(*RawPageData) (map[string]FieldProvenance, error) {
+	return nil, errors.New("layout changed")
+}
+
+func TestReadPageFallsBackToGeneric(t *testing.T) {
+	extractorsMu.RLock()
+	registered := extractors
+	extractorsMu.RUnlock()
+	t.Cleanup(func() {
+		extractorsMu.Lock()
+		extractors = registered
+		extractorsMu.Unlock()
+	})
+	RegisterExtractor("*.example.com", failingExtractor{})
+
+	page := &RawPageData{URL: "https://homes.example.com/1", Content: "Basement\nNo"}
+	if known := readPage(page); known != nil {
+		t.Errorf("readPage = %v, want no fields", known)
+	}
+	if page.Extractor != ExtractorGeneric {
+		t.Errorf("page.Extractor = %q, want %q", page.Extractor, ExtractorGeneric)
+	}
+}
@@ -0,0 +1,381 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// factCheckRegenerations reads FACT_CHECK_REGENERATIONS, how many times an
+// analysis with too many discrepancies is regenerated; 0, the default, never.
+func factCheckRegenerations() int {
+	return envInt("FACT_CHECK_REGENERATIONS", 0)
+}
+
+// factCheckThreshold reads FACT_CHECK_THRESHOLD, the number of discrepancies
+// an analysis may have before it is regenerated.
+func factCheckThreshold() int {
+	return envInt("FACT_CHECK_THRESHOLD", 0)
+}
+
+// Discrepancy is a claim in the analysis text that contradicts the property
+// details the analysis was generated from, e.g. "4 bedrooms" for a 3 bedroom home.
+type Discrepancy struct {
+	// Field is the path of the text in the analysis, e.g. "priceAnalysis".
+	Field   string `json:"field"`
+	Address string `json:"address"`
+	// Property is the PropertyDetails field the claim is about, e.g. "bedrooms".
+	Property string  `json:"property"`
+	Claim    string  `json:"claim"`
+	Stated   float64 `json:"stated"`
+	Actual   float64 `json:"actual"`
+}
+
+// String describes the discrepancy the way the regeneration prompt shows it.
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%q about %s: the property details give %s %g, not %g",
+		d.Claim, d.Address, d.Property, math.Round(d.Actual*100)/100, d.Stated)
+}
+
+// claimUnits recognise what a figure is about from the words after it, in
+// English and Spanish. pricePerSqFt only applies to dollar amounts.
+var claimUnits = []struct {
+	property string
+	pattern  *regexp.Regexp
+}{
+	{"pricePerSqFt", regexp.MustCompile(`(?i)^\s*(?:/|per|por|a)\s*(?:sq\.?\s*ft\.?|square\s+(?:foot|feet)|sf\b|ft²|pies?\s+cuadrados?|pie²)`)},
+	{"squareFootage", regexp.MustCompile(`(?i)^[\s-]*(?:sq\.?\s*ft\.?|square[\s-]+(?:feet|foot)|sf\b|ft²|pies\s+cuadrados|pies²)`)},
+	{"bedrooms", regexp.MustCompile(`(?i)^[\s-]*(?:bed(?:room)?s?\b|br\b|bd\b|habitaci(?:ón|ones)|recámaras?|dormitorios?)`)},
+	{"bathrooms", regexp.MustCompile(`(?i)^[\s-]*(?:bath(?:room)?s?\b|ba\b|baños?)`)},
+	{"daysOnMarket", regexp.MustCompile(`(?i)^\s*(?:days?\s+on\s+(?:the\s+)?market|dom\b|días\s+en\s+el\s+mercado)`)},
+}
+
+var (
+	// claimPrice and claimYear end the text before a listing price or the
+	// year a home was built.
+	claimPrice = regexp.MustCompile(`(?i)\b(?:list(?:ed|ing)?|priced?|asking|precio|listad[ao]|ofrecid[ao]|cuesta)\b[^$\d.;]{0,25}$`)
+	claimYear  = regexp.MustCompile(`(?i)\b(?:built|constructed|year\s+built:?|construid[ao]|edificad[ao]|año\s+de\s+construcción:?)\s+(?:in\s+|en\s+(?:el\s+)?)?$`)
+	// claimAggregate ends text that makes the figure a statistic or a bound
+	// rather than the value of one property.
+	claimAggregate = regexp.MustCompile(`(?i)\b(?:average|avg|median|mean|typical|up\s+to|over|under|more\s+than|less\s+than|fewer\s+than|at\s+least|between|promedio|mediana|media|más\s+de|menos\s+de|hasta|entre)\b(?:\s+[\p{L}\-]+){0,3}\s*$`)
+	// claimApproximate ends text that rounds the figure loosely.
+	claimApproximate = regexp.MustCompile(`(?i)\b(?:about|approximately|approx\.?|roughly|nearly|around|almost|aproximadamente|casi|cerca\s+de|unos|unas)\s*$`)
+	// claimComparative starts text that makes the figure a difference.
+	claimComparative = regexp.MustCompile(`(?i)^\s*(?:more|fewer|less|larger|smaller|bigger|higher|lower|above|below|over|under|cheaper|difference|premium|discount|gap|increase|decrease|reduction|drop|más|menos|mayor|menor|por\s+(?:encima|debajo)|de\s+diferencia)\b`)
+	// claimOwner joins a claim to the address that follows it, as in
+	// "4 bedrooms at 12 Oak St".
+	claimOwner = regexp.MustCompile(`(?i)^\s*(?:at|in|for|of|on|en|de|del|para)\s+(?:the\s+|la\s+|el\s+)?`)
+	// sentenceBreak ends a sentence before a capital or a digit, so that
+	// "123 Main St. offers" does not.
+	sentenceBreak = regexp.MustCompile(`[.!?;](?:\s+[\p{Lu}\d¿¡]|\s*$)`)
+	// subjectAlias refers to the primary property without its address.
+	subjectAlias = regexp.MustCompile(`(?i)\b(?:subject(?:\s+property)?|primary\s+property|propiedad\s+principal|inmueble\s+principal)\b`)
+)
+
+// featureExcluded matches feature comparison names that mention a field but
+// compare something else, e.g. "Lot size (sq ft)" or "Price reduction".
+var featureExcluded = regexp.MustCompile(`(?i)\b(?:lot|terreno|lote|parcela|change|reduction|cut|drop|diff\w*|vs|per\s+bed\w*|tax\w*|hoa|fees?|cambio|reducción|diferencia|impuestos?|cuotas?)\b`)
+
+// featureProperties map feature comparison names to PropertyDetails fields;
+// the first match wins.
+var featureProperties = []struct {
+	property string
+	pattern  *regexp.Regexp
+}{
+	{"pricePerSqFt", regexp.MustCompile(`(?i)(?:price|precio).*(?:sq|square|pie)`)},
+	{"price", regexp.MustCompile(`(?i)\b(?:list\s+)?(?:price|precio)\b`)},
+	{"bedrooms", regexp.MustCompile(`(?i)bed|habitaci|recámara|dormitorio`)},
+	{"bathrooms", regexp.MustCompile(`(?i)bath|baño`)},
+	{"squareFootage", regexp.MustCompile(`(?i)square|sq\.?\s*ft|living\s+area|superficie|pies\s+cuadrados`)},
+	{"yearBuilt", regexp.MustCompile(`(?i)year\s+built|built|año\s+de\s+construcción|construcción`)},
+	{"daysOnMarket", regexp.MustCompile(`(?i)days\s+on\s+market|días\s+en\s+el\s+mercado`)},
+	{"conditionScore", regexp.MustCompile(`(?i)^\s*(?:overall\s+)?condition(?:\s+score)?\s*$|^\s*(?:condición|estado)(?:\s+general)?\s*$`)},
+}
+
+// addressMention is where an address, or the subject alias, appears in text.
+type addressMention struct {
+	start, end int
+	property   *PropertyDetails
+}
+
+// factChecker cross-checks the analysis text against the property details.
+type factChecker struct {
+	tools  *analysisTools
+	locale *ReportLocale
+	// mentions match the street number and name of each property.
+	mentions []*regexp.Regexp
+}
+
+func newFactChecker(primary PropertyDetails, comps []PropertyDetails, locale *ReportLocale) *factChecker {
+	f := &factChecker{tools: &analysisTools{primary: primary, comps: comps}, locale: locale}
+	for _, p := range f.properties() {
+		f.mentions = append(f.mentions, mentionPattern(p.Address))
+	}
+	return f
+}
+
+// properties returns the primary property followed by the comparisons.
+func (f *factChecker) properties() []*PropertyDetails {
+	all := []*PropertyDetails{&f.tools.primary}
+	for i := range f.tools.comps {
+		all = append(all, &f.tools.comps[i])
+	}
+	return all
+}
+
+// mentionPattern matches the street number and first word of the street name
+// of an address, e.g. "123 Main" for "123 Main St, Springfield"; nil when the
+// address does not start with a number.
+func mentionPattern(address string) *regexp.Regexp {
+	fields := strings.Fields(address)
+	if len(fields) < 2 || strings.IndexAny(fields[0], "0123456789") == -1 {
+		return nil
+	}
+	street := strings.Trim(fields[1], ".,")
+	return regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(fields[0]) + `\s+` + regexp.QuoteMeta(street) + `\b`)
+}
+
+// checkFacts returns the claims in the analysis text that contradict the
+// property details: listing prices, prices per square foot, sizes, bedroom and
+// bathroom counts, years built and days on market. Claims that cannot be tied
+// to one property, statistics and differences are not checked.
+func checkFacts(analysis *DetailedAnalysis, primary PropertyDetails, comps []PropertyDetails, locale *ReportLocale) []Discrepancy {
+	f := newFactChecker(primary, comps, locale)
+
+	var out []Discrepancy
+	out = append(out, f.checkText("priceAnalysis", analysis.PriceAnalysis)...)
+	for i, fc := range analysis.FeatureComparison {
+		path := fmt.Sprintf("featureComparison[%d]", i)
+		out = append(out, f.checkFeature(path, fc)...)
+		out = append(out, f.checkText(path+".analysis", fc.Analysis)...)
+	}
+	out = append(out, f.checkText("marketTrends", analysis.MarketTrends)...)
+	out = append(out, f.checkText("recommendation", analysis.Recommendation)...)
+	return out
+}
+
+// checkText checks the claims of narrative text.
+func (f *factChecker) checkText(field, text string) []Discrepancy {
+	mentions := f.findMentions(text)
+
+	var out []Discrepancy
+	for _, idx := range f.locale.figures.FindAllStringSubmatchIndex(text, -1) {
+		m := make([]string, len(idx)/2)
+		for i := range m {
+			if idx[2*i] >= 0 {
+				m[i] = text[idx[2*i]:idx[2*i+1]]
+			}
+		}
+		n, ok := citedFigure(m, f.locale)
+		if !ok || n.Suffix == "%" {
+			continue
+		}
+		start, end := idx[0], idx[1]
+		before, after := text[:start], text[end:]
+
+		property := ""
+		switch {
+		case n.Money:
+			if loc := claimUnits[0].pattern.FindStringIndex(after); loc != nil {
+				property, end = "pricePerSqFt", end+loc[1]
+			} else if claimPrice.MatchString(tail(before, 60)) {
+				property = "price"
+			}
+		case n.Plain && n.Value >= 1600 && n.Value <= 2100 && claimYear.MatchString(tail(before, 40)):
+			property = "yearBuilt"
+		default:
+			for _, u := range claimUnits[1:] {
+				if loc := u.pattern.FindStringIndex(after); loc != nil {
+					property, end = u.property, end+loc[1]
+					break
+				}
+			}
+		}
+		if property == "" || claimAggregate.MatchString(tail(before, 60)) || claimComparative.MatchString(text[end:]) {
+			continue
+		}
+
+		p := claimOwnerAt(text, start, end, mentions)
+		if p == nil {
+			continue
+		}
+		approximate := claimApproximate.MatchString(tail(before, 20))
+		if d, ok := f.compare(field, p, property, strings.TrimSpace(text[start:end]), n, approximate); ok {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// checkFeature checks the values of a feature comparison whose feature is a
+// known PropertyDetails field, e.g. "Bedrooms" with primaryValue "4".
+func (f *factChecker) checkFeature(path string, fc FeatureComparison) []Discrepancy {
+	if featureExcluded.MatchString(fc.Feature) {
+		return nil
+	}
+	property := ""
+	for _, fp := range featureProperties {
+		if fp.pattern.MatchString(fc.Feature) {
+			property = fp.property
+			break
+		}
+	}
+	if property == "" {
+		return nil
+	}
+
+	var out []Discrepancy
+	check := func(field, value string, p *PropertyDetails) {
+		m := f.locale.figures.FindStringSubmatch(value)
+		if m == nil || claimComparative.MatchString(value[strings.Index(value, m[0])+len(m[0]):]) {
+			return
+		}
+		n, ok := citedFigure(m, f.locale)
+		if !ok || n.Suffix == "%" {
+			return
+		}
+		approximate := claimApproximate.MatchString(value[:strings.Index(value, m[0])])
+		if d, ok := f.compare(field, p, property, strings.TrimSpace(value), n, approximate); ok {
+			out = append(out, d)
+		}
+	}
+	check(path+".primaryValue", fc.PrimaryValue, &f.tools.primary)
+	for j, cv := range fc.Comparison {
+		if strings.TrimSpace(cv.Address) == "" {
+			continue
+		}
+		p, err := f.tools.find(cv.Address)
+		if err != nil {
+			continue
+		}
+		check(fmt.Sprintf("%s.comparison[%d].value", path, j), cv.Value, p)
+	}
+	return out
+}
+
+// compare returns a discrepancy when the stated figure does not match the
+// property's value within the figure's rounding; unknown values are not checked.
+func (f *factChecker) compare(field string, p *PropertyDetails, property, claim string, n citedNumber, approximate bool) (Discrepancy, bool) {
+	actual, ok := fieldValue(p, property)
+	if !ok {
+		return Discrepancy{}, false
+	}
+	tolerance := n.Tolerance
+	if approximate {
+		tolerance = math.Max(tolerance, actual*0.05)
+	}
+	// Prices per square foot are often rounded to whole dollars
+	if property == "pricePerSqFt" {
+		tolerance = math.Max(tolerance, 1)
+	}
+	if math.Abs(actual-n.Value) <= tolerance {
+		return Discrepancy{}, false
+	}
+	return Discrepancy{
+		Field:    field,
+		Address:  p.Address,
+		Property: property,
+		Claim:    claim,
+		Stated:   n.Value,
+		Actual:   actual,
+	}, true
+}
+
+// findMentions returns the addresses named in text in order of appearance.
+func (f *factChecker) findMentions(text string) []addressMention {
+	var out []addressMention
+	for i, p := range f.properties() {
+		if f.mentions[i] == nil {
+			continue
+		}
+		for _, loc := range f.mentions[i].FindAllStringIndex(text, -1) {
+			out = append(out, addressMention{loc[0], loc[1], p})
+		}
+	}
+	for _, loc := range subjectAlias.FindAllStringIndex(text, -1) {
+		out = append(out, addressMention{loc[0], loc[1], &f.tools.primary})
+	}
+	return out
+}
+
+// claimOwnerAt returns the property a claim at [start, end) is about: the
+// address joined to it by a preposition right after it, otherwise the last
+// address named before it in its sentence, the first named after it in its
+// sentence or the last named before it at all.
+func claimOwnerAt(text string, start, end int, mentions []addressMention) *PropertyDetails {
+	if loc := claimOwner.FindStringIndex(text[end:]); loc != nil {
+		for _, m := range mentions {
+			if m.start == end+loc[1] {
+				return m.property
+			}
+		}
+	}
+
+	sentenceStart, sentenceEnd := 0, len(text)
+	for _, loc := range sentenceBreak.FindAllStringIndex(text, -1) {
+		if loc[0] < start {
+			sentenceStart = loc[0] + 1
+		} else if loc[0] >= end {
+			sentenceEnd = loc[0]
+			break
+		}
+	}
+
+	var before, after, earlier *PropertyDetails
+	lastBefore, firstAfter := -1, len(text)
+	for _, m := range mentions {
+		switch {
+		case m.end <= start && m.end > lastBefore:
+			earlier, lastBefore = m.property, m.end
+		case m.start >= end && m.end <= sentenceEnd && m.start < firstAfter:
+			after, firstAfter = m.property, m.start
+		}
+	}
+	if lastBefore >= sentenceStart {
+		before = earlier
+	}
+	switch {
+	case before != nil:
+		return before
+	case after != nil:
+		return after
+	}
+	return earlier
+}
+
+// tail returns at most the last n bytes of s, starting at a rune boundary.
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	i := len(s) - n
+	for i < len(s) && !utf8.RuneStart(s[i]) {
+		i++
+	}
+	return s[i:]
+}
+
+// discrepancyErrors turns discrepancies into validation errors for the
+// regeneration prompt.
+func discrepancyErrors(discrepancies []Discrepancy) []FieldError {
+	errs := make([]FieldError, len(discrepancies))
+	for i, d := range discrepancies {
+		errs[i] = FieldError{Path: d.Field, Message: d.String()}
+	}
+	return errs
+}
+
+// analysisAnswer is the JSON the model wrote for an analysis, without the
+// property details that are filled in afterwards.
+func analysisAnswer(analysis DetailedAnalysis) string {
+	b, _ := json.Marshal(struct {
+		PriceAnalysis     string              `json:"priceAnalysis"`
+		FeatureComparison []FeatureComparison `json:"featureComparison"`
+		MarketTrends      string              `json:"marketTrends"`
+		Recommendation    string              `json:"recommendation"`
+	}{analysis.PriceAnalysis, analysis.FeatureComparison, analysis.MarketTrends, analysis.Recommendation})
+	return string(b)
+}
@@ -0,0 +1,221 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+// factCheckProperties are a 3 bedroom primary at $200 per square foot and a
+// 4 bedroom comparison.
+func factCheckProperties() (PropertyDetails, []PropertyDetails) {
+	primary := PropertyDetails{
+		Address:       "123 Maple St, Columbus, OH 43004",
+		Price:         350000,
+		Bedrooms:      3,
+		Bathrooms:     2,
+		SquareFootage: 1750,
+		YearBuilt:     1995,
+		DaysOnMarket:  12,
+	}
+	comps := []PropertyDetails{{
+		Address:       "45 Oak Ave, Columbus, OH 43004",
+		Price:         420000,
+		Bedrooms:      4,
+		Bathrooms:     2.5,
+		SquareFootage: 2100,
+		YearBuilt:     2004,
+	}}
+	return primary, comps
+}
+
+// checkedClaim is the part of a discrepancy the tests compare.
+type checkedClaim struct {
+	Address  string
+	Property string
+	Stated   float64
+}
+
+func checkedClaims(discrepancies []Discrepancy) []checkedClaim {
+	var out []checkedClaim
+	for _, d := range discrepancies {
+		out = append(out, checkedClaim{d.Address, d.Property, d.Stated})
+	}
+	return out
+}
+
+func TestCheckFactsText(t *testing.T) {
+	primary, comps := factCheckProperties()
+	maple, oak := primary.Address, comps[0].Address
+
+	tests := []struct {
+		name   string
+		locale string
+		text   string
+		want   []checkedClaim
+	}{
+		{
+			name: "matching figures",
+			text: "123 Maple St has 3 bedrooms, 2 baths and 1,750 sq ft, was built in 1995 and is listed at $350,000.",
+		},
+		{
+			name: "contradicted bedroom count",
+			text: "123 Maple St has 4 bedrooms.",
+			want: []checkedClaim{{maple, "bedrooms", 4}},
+		},
+		{
+			name: "contradicted price",
+			text: "45 Oak Ave is listed at $450,000, above 123 Maple St.",
+			want: []checkedClaim{{oak, "price", 450000}},
+		},
+		{
+			name: "contradicted price per square foot",
+			text: "At $250 per sq ft, 123 Maple St is the better value.",
+			want: []checkedClaim{{maple, "pricePerSqFt", 250}},
+		},
+		{
+			name: "price per square foot rounded to whole dollars",
+			text: "123 Maple St is priced at $200.40/sq ft.",
+		},
+		{
+			name: "claim joined to the address after it",
+			text: "The 3 bedrooms at 123 Maple St compare with 5 bedrooms at 45 Oak Ave.",
+			want: []checkedClaim{{oak, "bedrooms", 5}},
+		},
+		{
+			name: "aggregate",
+			text: "Homes near 123 Maple St have a median list price of $450,000 and an average of 4 bedrooms.",
+		},
+		{
+			name: "aggregate control",
+			text: "123 Maple St has a list price of $450,000.",
+			want: []checkedClaim{{maple, "price", 450000}},
+		},
+		{
+			name: "approximate",
+			text: "123 Maple St is listed at about $360,000.",
+		},
+		{
+			name: "approximate control",
+			text: "123 Maple St is listed at $360,000.",
+			want: []checkedClaim{{maple, "price", 360000}},
+		},
+		{
+			name: "comparative",
+			text: "45 Oak Ave offers 2 more bedrooms and 350 sq ft more than 123 Maple St, which has 1 bedroom fewer.",
+		},
+		{
+			name: "subject alias",
+			text: "The subject property has 5 bedrooms, while 45 Oak Ave has 4 bedrooms.",
+			want: []checkedClaim{{maple, "bedrooms", 5}},
+		},
+		{
+			name: "no address",
+			text: "Buyers in the area want 4 bedrooms.",
+		},
+		{
+			name:   "Spanish",
+			locale: "es-ES",
+			text:   "La propiedad principal tiene 4 habitaciones y 1.750 pies cuadrados. 45 Oak Ave está listada a 420.000 US$ y tiene 4 baños.",
+			want:   []checkedClaim{{maple, "bedrooms", 4}, {oak, "bathrooms", 4}},
+		},
+		{
+			name:   "Spanish aggregate",
+			locale: "es-ES",
+			text:   "Cerca de 123 Maple St el precio promedio es de 450.000 US$.",
+		},
+		{
+			name:   "Spanish aggregate control",
+			locale: "es-ES",
+			text:   "En 123 Maple St el precio es de 450.000 US$.",
+			want:   []checkedClaim{{maple, "price", 450000}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locale, err := findReportLocale(tt.locale)
+			if err != nil {
+				t.Fatal(err)
+			}
+			analysis := &DetailedAnalysis{PriceAnalysis: tt.text}
+			got := checkedClaims(checkFacts(analysis, primary, comps, locale))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFactsFeatureComparison(t *testing.T) {
+	primary, comps := factCheckProperties()
+	oak := comps[0].Address
+
+	tests := []struct {
+		name    string
+		feature FeatureComparison
+		want    []string
+	}{
+		{
+			name: "matching values",
+			feature: FeatureComparison{Feature: "Bedrooms", PrimaryValue: "3",
+				Comparison: []ComparisonValue{{Address: oak, Value: "4 beds"}}},
+		},
+		{
+			name: "contradicted values",
+			feature: FeatureComparison{Feature: "List price", PrimaryValue: "$350,000",
+				Comparison: []ComparisonValue{{Address: oak, Value: "$400,000"}}},
+			want: []string{"featureComparison[0].comparison[0].value"},
+		},
+		{
+			name: "price per square foot",
+			feature: FeatureComparison{Feature: "Price per sq ft", PrimaryValue: "$230",
+				Comparison: []ComparisonValue{{Address: oak, Value: "$200"}}},
+			want: []string{"featureComparison[0].primaryValue"},
+		},
+		{
+			name: "difference",
+			feature: FeatureComparison{Feature: "Square footage", PrimaryValue: "1,750",
+				Comparison: []ComparisonValue{{Address: oak, Value: "350 more"}}},
+		},
+		{
+			name:    "excluded feature",
+			feature: FeatureComparison{Feature: "Lot size (sq ft)", PrimaryValue: "8,000"},
+		},
+		{
+			name: "unknown comparison address",
+			feature: FeatureComparison{Feature: "Bedrooms", PrimaryValue: "3",
+				Comparison: []ComparisonValue{{Address: "9 Elm Rd", Value: "6"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis := &DetailedAnalysis{FeatureComparison: []FeatureComparison{tt.feature}}
+			var got []string
+			for _, d := range checkFacts(analysis, primary, comps, defaultReportLocale()) {
+				got = append(got, d.Field)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMentionPattern(t *testing.T) {
+	tests := []struct {
+		address string
+		text    string
+		want    bool
+	}{
+		{"123 Main St, Springfield", "the home at 123 main street", true},
+		{"123 Main St, Springfield", "1123 Main St", false},
+		{"123 Main St, Springfield", "123 Mainline Rd", false},
+		{"12B Harbor View, Unit 5", "12B Harbor View", true},
+		{"St. 5, Springfield", "St. 5", false},
+	}
+	for _, tt := range tests {
+		pattern := mentionPattern(tt.address)
+		if got := pattern != nil && pattern.MatchString(tt.text); got != tt.want {
+			t.Errorf("mentionPattern(%q) matches %q = %v, want %v", tt.address, tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Injection risk levels stored on raw page records.
+const (
+	InjectionRiskNone = "none"
+	InjectionRiskLow  = "low"
+	InjectionRiskHigh = "high"
+)
+
+// Injection policies for reports that include a high-risk page, set with INJECTION_POLICY.
+const (
+	InjectionPolicyWarn   = "warn"
+	InjectionPolicyRefuse = "refuse"
+)
+
+// InjectionRisk is the result of scanning captured page text for instructions
+// aimed at the model.
+type InjectionRisk struct {
+	Level   string           `bson:"level" json:"level"`
+	Score   int              `bson:"score" json:"score"`
+	Matches []InjectionMatch `bson:"matches,omitempty" json:"matches,omitempty"`
+}
+
+// InjectionMatch is one suspicious passage.
+type InjectionMatch struct {
+	Rule   string `bson:"rule" json:"rule"`
+	Text   string `bson:"text" json:"text"`
+	Offset int    `bson:"offset" json:"offset"`
+}
+
+type injectionRule struct {
+	name    string
+	weight  int
+	pattern *regexp.Regexp
+}
+
+// injectionRules score instruction-like text. Phrases that only make sense
+// when addressed to a model weigh 3, which alone makes a page high risk;
+// phrases that also occur in ordinary listings weigh 1.
+var injectionRules = []injectionRule{
+	{"override", 3, regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\b.{0,30}\b(previous|prior|above|earlier|all|any|your)\b.{0,20}\b(instructions?|prompts?|rules|directions|context)\b`)},
+	{"role", 3, regexp.MustCompile(`(?i)\byou are (now |no longer )?(an? )?(ai|assistant|language model|llm|chatbot|gpt|gemini|claude)\b`)},
+	{"system-prompt", 3, regexp.MustCompile(`(?i)\b(system prompt|developer message|system message|hidden instructions?)\b`)},
+	{"chat-markup", 3, regexp.MustCompile(`(?i)(<\|?(im_start|im_end|system|endoftext)\|?>|\[/?INST\]|</?(system|assistant|user)>|^\s*(system|assistant)\s*:)`)},
+	{"new-instructions", 2, regexp.MustCompile(`(?i)\b(new|updated|real|actual|additional) instructions?\s*:`)},
+	{"model-address", 2, regexp.MustCompile(`(?i)\b(as an ai|ai (model|assistant)s?|language models?|llms?)\b.{0,40}\b(must|should|will|need to|are required to)\b`)},
+	{"output-control", 2, regexp.MustCompile(`(?i)\b(respond|reply|answer|output|return)\b.{0,20}\b(only|exactly|with the following)\b.{0,30}\b(json|text|value|price|words?)\b`)},
+	{"field-steering", 2, regexp.MustCompile(`(?i)\b(set|report|list|state|extract)\b.{0,15}\b(the )?(price|value|square footage|bedrooms|bathrooms|recommendation)\b.{0,10}\b(as|to|is)\b\s*\$?\d`)},
+	{"secrecy", 1, regexp.MustCompile(`(?i)\bdo not (mention|reveal|tell|disclose)\b`)},
+	{"act-as", 1, regexp.MustCompile(`(?i)\b(act as|pretend (to be|you are)|roleplay)\b`)},
+}
+
+// highInjectionScore is the score from which a page is high risk.
+const highInjectionScore = 3
+
+// detectInjection scans page text for instruction-like passages.
+func detectInjection(content string) InjectionRisk {
+	risk := InjectionRisk{Level: InjectionRiskNone}
+	for _, rule := range injectionRules {
+		for _, loc := range rule.pattern.FindAllStringIndex(content, 5) {
+			risk.Score += rule.weight
+			risk.Matches = append(risk.Matches, InjectionMatch{
+				Rule:   rule.name,
+				Text:   content[loc[0]:loc[1]],
+				Offset: loc[0],
+			})
+		}
+	}
+	sort.Slice(risk.Matches, func(i, j int) bool { return risk.Matches[i].Offset < risk.Matches[j].Offset })
+
+	switch {
+	case risk.Score >= highInjectionScore:
+		risk.Level = InjectionRiskHigh
+	case risk.Score > 0:
+		risk.Level = InjectionRiskLow
+	}
+	return risk
+}
+
+// fenceUntrusted wraps page text in delimiters that the text itself cannot
+// close. The marker is derived from a hash of the text, so a page cannot
+// contain its own marker, and identical text still yields identical prompts
+// for the extraction cache and cassettes.
+func fenceUntrusted(content string) (fenced, marker string) {
+	sum := sha256.Sum256([]byte(content))
+	marker = "LISTING_" + strings.ToUpper(hex.EncodeToString(sum[:6]))
+	return fmt.Sprintf("<<<%s\n%s\n%s>>>", marker, content, marker), marker
+}
+
+func injectionPolicy() string {
+	if strings.ToLower(os.Getenv("INJECTION_POLICY")) == InjectionPolicyRefuse {
+		return InjectionPolicyRefuse
+	}
+	return InjectionPolicyWarn
+}
+
+// checkReportInjection looks up the injection risk of every page in the report.
+// Under the refuse policy a high-risk page yields a placeholder report;
+// otherwise each risky page adds a warning.
+func checkReportInjection(ctx context.Context, in *reportInputs) (*BMAReport, error) {
+	addrs := append([]Address{in.Primary}, in.Comparisons...)
+	ids := make([]primitive.ObjectID, 0, len(addrs))
+	for _, addr := range addrs {
+		ids = append(ids, addr.RawPageID)
+	}
+
+	cursor, err := BmaDB.Collection("raw_page_data").Find(ctx,
+		bson.M{"_id": bson.M{"$in": ids}, "injectionRisk.level": bson.M{"$in": []string{InjectionRiskLow, InjectionRiskHigh}}},
+		options.Find().SetProjection(bson.M{"injectionRisk": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var pages []RawPageData
+	if err := cursor.All(ctx, &pages); err != nil {
+		return nil, err
+	}
+
+	risky := map[primitive.ObjectID]*InjectionRisk{}
+	for _, page := range pages {
+		risky[page.ID] = page.InjectionRisk
+	}
+
+	in.Warnings = nil
+	var refused []string
+	for _, addr := range addrs {
+		risk, ok := risky[addr.RawPageID]
+		if !ok || risk == nil {
+			continue
+		}
+		if risk.Level == InjectionRiskHigh && injectionPolicy() == InjectionPolicyRefuse {
+			refused = append(refused, addr.AddressStr)
+			continue
+		}
+		in.Warnings = append(in.Warnings, in.Locale.Message(msgInjectionWarning, addr.AddressStr, risk.Level))
+	}
+
+	if len(refused) > 0 {
+		var comparisonAddrs []*Address
+		for i := range in.Comparisons {
+			comparisonAddrs = append(comparisonAddrs, &in.Comparisons[i])
+		}
+		return &BMAReport{
+			PrimaryAddress:  &in.Primary,
+			ComparisonAddrs: comparisonAddrs,
+			Opinion:         in.Locale.Message(msgInjectionRefused, strings.Join(refused, "; ")),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,317 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultProfileName names the profile holding the instructions saved before
+// profiles existed, and the one /api/llm-instructions creates.
+const DefaultProfileName = "Default"
+
+// ErrProfileNotFound is returned when a requested instruction profile does not exist.
+var ErrProfileNotFound = errors.New("instruction profile not found")
+
+// migrateInstructionProfiles turns the single instructions document of older
+// versions into the default profile.
+func migrateInstructionProfiles(ctx context.Context, col *mongo.Collection) error {
+	_, err := col.UpdateMany(ctx, bson.M{"name": bson.M{"$exists": false}}, bson.M{
+		"$set": bson.M{"name": DefaultProfileName, "default": true},
+	})
+	return err
+}
+
+// defaultInstructionProfile returns the default profile, or nil when there is none.
+func defaultInstructionProfile(ctx context.Context) (*LLMInstructions, error) {
+	if llmInstructionsCollection == nil {
+		return nil, nil
+	}
+	var profile LLMInstructions
+	err := llmInstructionsCollection.FindOne(ctx, bson.M{"default": true}).Decode(&profile)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching LLM instructions: %v", err)
+	}
+	return &profile, nil
+}
+
+// findInstructionProfile resolves a profile by ID or name. An empty reference
+// selects the default profile, which may be nil.
+func findInstructionProfile(ctx context.Context, ref string) (*LLMInstructions, error) {
+	if ref == "" {
+		return defaultInstructionProfile(ctx)
+	}
+	if llmInstructionsCollection == nil {
+		return nil, ErrProfileNotFound
+	}
+
+	filter := bson.M{"name": ref}
+	if objID, err := primitive.ObjectIDFromHex(ref); err == nil {
+		filter = bson.M{"_id": objID}
+	}
+	var profile LLMInstructions
+	err := llmInstructionsCollection.FindOne(ctx, filter).Decode(&profile)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrProfileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching instruction profile: %v", err)
+	}
+	return &profile, nil
+}
+
+// loadLLMInstructions returns the instructions of the default profile.
+func loadLLMInstructions(ctx context.Context) (string, error) {
+	profile, err := defaultInstructionProfile(ctx)
+	if err != nil || profile == nil {
+		return "", err
+	}
+	return profile.Instructions, nil
+}
+
+// clearCachedReportsForProfile drops the reports generated with the profile's old instructions.
+func clearCachedReportsForProfile(ctx context.Context, id primitive.ObjectID) {
+	if _, err := cachedBMAReportsCollection.DeleteMany(ctx, bson.M{"profileId": id}); err != nil {
+		log.Error().Err(err).Str("profile", id.Hex()).Msg("Failed to clear cached reports")
+	}
+}
+
+// makeDefaultProfile marks the profile as the only default.
+func makeDefaultProfile(ctx context.Context, id primitive.ObjectID) error {
+	_, err := llmInstructionsCollection.UpdateMany(ctx, bson.M{"_id": bson.M{"$ne": id}, "default": true}, bson.M{
+		"$set": bson.M{"default": false},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = llmInstructionsCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"default": true}})
+	return err
+}
+
+// handleListInstructionProfiles returns every profile, the default first.
+func handleListInstructionProfiles(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	cursor, err := llmInstructionsCollection.Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "default", Value: -1}, {Key: "name", Value: 1}}))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer cursor.Close(ctx)
+
+	profiles := []LLMInstructions{}
+	if err := cursor.All(ctx, &profiles); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(profiles)
+}
+
+// handleGetInstructionProfile returns one profile by ID or name.
+func handleGetInstructionProfile(c *fiber.Ctx) error {
+	profile, err := findInstructionProfile(c.UserContext(), c.Params("id"))
+	if errors.Is(err, ErrProfileNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Instruction profile not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(profile)
+}
+
+// handleCreateInstructionProfile creates a profile from {"name", "instructions",
+// "default"}. The first profile always becomes the default.
+func handleCreateInstructionProfile(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var data LLMInstructions
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Profile name is required"})
+	}
+
+	current, err := defaultInstructionProfile(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	profile := LLMInstructions{
+		Name:         data.Name,
+		Instructions: data.Instructions,
+		UpdatedAt:    time.Now(),
+	}
+	res, err := llmInstructionsCollection.InsertOne(ctx, profile)
+	if mongo.IsDuplicateKeyError(err) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A profile with this name already exists"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	profile.ID = res.InsertedID.(primitive.ObjectID)
+
+	if data.Default || current == nil {
+		if err := makeDefaultProfile(ctx, profile.ID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		profile.Default = true
+	}
+	return c.Status(fiber.StatusCreated).JSON(profile)
+}
+
+// handleUpdateInstructionProfile renames a profile or replaces its instructions.
+// Reports generated with the old instructions are discarded.
+func handleUpdateInstructionProfile(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	profile, err := findInstructionProfile(ctx, c.Params("id"))
+	if errors.Is(err, ErrProfileNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Instruction profile not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var data struct {
+		Name         *string `json:"name"`
+		Instructions *string `json:"instructions"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	set := bson.M{"updated_at": time.Now()}
+	if data.Name != nil {
+		name := strings.TrimSpace(*data.Name)
+		if name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Profile name is required"})
+		}
+		set["name"] = name
+		profile.Name = name
+	}
+	if data.Instructions != nil {
+		set["instructions"] = *data.Instructions
+		profile.Instructions = *data.Instructions
+	}
+
+	_, err = llmInstructionsCollection.UpdateOne(ctx, bson.M{"_id": profile.ID}, bson.M{"$set": set})
+	if mongo.IsDuplicateKeyError(err) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A profile with this name already exists"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if data.Instructions != nil {
+		clearCachedReportsForProfile(ctx, profile.ID)
+	}
+	return c.JSON(profile)
+}
+
+// handleSetDefaultInstructionProfile makes the profile the one reports use by default.
+func handleSetDefaultInstructionProfile(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	profile, err := findInstructionProfile(ctx, c.Params("id"))
+	if errors.Is(err, ErrProfileNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Instruction profile not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := makeDefaultProfile(ctx, profile.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	profile.Default = true
+	return c.JSON(profile)
+}
+
+// handleDeleteInstructionProfile deletes a profile and its cached reports. The
+// default profile can only be deleted after another one has been made the default.
+func handleDeleteInstructionProfile(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	profile, err := findInstructionProfile(ctx, c.Params("id"))
+	if errors.Is(err, ErrProfileNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Instruction profile not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if profile.Default {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Make another profile the default before deleting this one"})
+	}
+
+	if _, err := llmInstructionsCollection.DeleteOne(ctx, bson.M{"_id": profile.ID}); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	clearCachedReportsForProfile(ctx, profile.ID)
+	return c.JSON(fiber.Map{"message": "Instruction profile deleted"})
+}
+
+// handleGetLLMInstructions returns the instructions of the default profile.
+func handleGetLLMInstructions(c *fiber.Ctx) error {
+	profile, err := defaultInstructionProfile(c.UserContext())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch instructions"})
+	}
+	if profile == nil {
+		return c.JSON(fiber.Map{"instructions": ""})
+	}
+	return c.JSON(fiber.Map{"instructions": profile.Instructions, "profile": profile.Name})
+}
+
+// handleUpdateLLMInstructions replaces the instructions of the default profile,
+// creating it when there is none.
+func handleUpdateLLMInstructions(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	var data struct {
+		Instructions string `json:"instructions"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	profile, err := defaultInstructionProfile(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch instructions"})
+	}
+	if profile == nil {
+		profile = &LLMInstructions{Name: DefaultProfileName, Default: true}
+	}
+	profile.Instructions = data.Instructions
+	profile.UpdatedAt = time.Now()
+
+	filter := bson.M{"name": profile.Name}
+	if !profile.ID.IsZero() {
+		filter = bson.M{"_id": profile.ID}
+	}
+	res, err := llmInstructionsCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+		"name":         profile.Name,
+		"instructions": profile.Instructions,
+		"default":      true,
+		"updated_at":   profile.UpdatedAt,
+	}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save instructions"})
+	}
+	if id, ok := res.UpsertedID.(primitive.ObjectID); ok {
+		profile.ID = id
+		if err := makeDefaultProfile(ctx, id); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save instructions"})
+		}
+	}
+
+	// Discard reports generated with the old instructions to force regeneration
+	clearCachedReportsForProfile(ctx, profile.ID)
+
+	return c.JSON(fiber.Map{"status": "success"})
+}
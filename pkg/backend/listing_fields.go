@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// listingFields are the PropertyDetails fields added for sold comparisons,
+// carrying costs and amenities. Records captured before them are migrated.
+var listingFields = []string{
+	"listingStatus", "listPrice", "soldPrice", "listDate", "soldDate", "closeDate",
+	"hoaDues", "annualTaxes", "garageSpaces", "stories", "basement", "pool",
+	"lotSizeSqFt", "subdivision", "schoolDistrict",
+}
+
+// dateFields hold dates in YYYY-MM-DD form.
+var dateFields = []string{"listDate", "soldDate", "closeDate"}
+
+// checkDates reports extracted dates that are not YYYY-MM-DD, so the model
+// repairs them like schema violations.
+func checkDates(answer []byte) []FieldError {
+	var fields map[string]struct {
+		Value interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(answer, &fields); err != nil {
+		return nil
+	}
+	var errs []FieldError
+	for _, name := range dateFields {
+		date, ok := fields[name].Value.(string)
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, date); err != nil {
+			errs = append(errs, FieldError{Path: name + ".value", Message: "must be a date in YYYY-MM-DD form"})
+		}
+	}
+	return errs
+}
+
+var lotSizePattern = regexp.MustCompile(`(?i)^\s*(\d[\d,]*(?:\.\d+)?|\.\d+)\s*(acres?|ac\b|sq\.?\s?ft\.?|sqft|square\s+feet|sf\b)`)
+
+// lotSizeSquareFeet converts a lot size such as "0.25 Acres" or "8,276 sq ft"
+// to square feet.
+func lotSizeSquareFeet(lotSize string) (float64, bool) {
+	m := lotSizePattern.FindStringSubmatch(lotSize)
+	if m == nil {
+		return 0, false
+	}
+	size, err := strconv.ParseFloat(strings.ReplaceAll(m[1], ",", ""), 64)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+	if strings.HasPrefix(strings.ToLower(m[2]), "ac") {
+		size *= 43560
+	}
+	return math.Round(size), true
+}
+
+// deriveListingFields fills fields the page did not state separately: the
+// list or sold price from the price of listings whose status is known, and
+// the lot size in square feet from the lot size. Derived values keep the
+// provenance of the value they were derived from.
+func deriveListingFields(provenance map[string]FieldProvenance) {
+	derive := func(field, from string, convert func(interface{}) (interface{}, bool)) {
+		if prov, ok := provenance[field]; ok && prov.Value != nil {
+			return
+		}
+		source, ok := provenance[from]
+		if !ok || source.Value == nil {
+			return
+		}
+		if value, ok := convert(source.Value); ok {
+			source.Value = value
+			provenance[field] = source
+		}
+	}
+	same := func(v interface{}) (interface{}, bool) { return v, true }
+
+	switch status, _ := provenance["listingStatus"].Value.(string); status {
+	case "active", "pending":
+		derive("listPrice", "price", same)
+	case "sold":
+		derive("soldPrice", "price", same)
+	}
+	derive("lotSizeSqFt", "lotSize", func(v interface{}) (interface{}, bool) {
+		lotSize, _ := v.(string)
+		sqft, ok := lotSizeSquareFeet(lotSize)
+		return sqft, ok
+	})
+}
+
+// migrateListingFields adds the listing fields to records captured before
+// they existed. The stored page is read again by its site extractor and
+// structured data, the derivable fields are derived, and fields that are
+// still unknown are recorded as not stated, so /api/addresses leaves them out.
+func migrateListingFields(ctx context.Context, col *mongo.Collection) error {
+	cursor, err := col.Find(ctx, bson.M{
+		"propertyDetails":               bson.M{"$ne": nil},
+		"propertyDetails.listingStatus": bson.M{"$exists": false},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	migrated := 0
+	for cursor.Next(ctx) {
+		var raw RawPageData
+		if err := cursor.Decode(&raw); err != nil {
+			return err
+		}
+
+		provenance := map[string]FieldProvenance{}
+		for name, prov := range raw.Provenance {
+			provenance[name] = prov
+		}
+		// Records captured before provenance existed only have the details
+		if _, ok := provenance["price"]; !ok && raw.PropertyDetails.Price > 0 {
+			provenance["price"] = FieldProvenance{Value: raw.PropertyDetails.Price, Confidence: 1}
+		}
+		if _, ok := provenance["lotSize"]; !ok && raw.PropertyDetails.LotSize != "" {
+			provenance["lotSize"] = FieldProvenance{Value: raw.PropertyDetails.LotSize, Confidence: 1}
+		}
+		page := raw
+		known := readPage(&page)
+		for _, name := range listingFields {
+			if prov, ok := known[name]; ok {
+				provenance[name] = prov
+			}
+		}
+		deriveListingFields(provenance)
+
+		var values map[string]interface{}
+		encoded, _ := json.Marshal(raw.PropertyDetails)
+		if err := json.Unmarshal(encoded, &values); err != nil {
+			return err
+		}
+		set := bson.M{}
+		for _, name := range listingFields {
+			prov := provenance[name]
+			values[name] = prov.Value
+			set["provenance."+name] = prov
+		}
+		var details PropertyDetails
+		encoded, _ = json.Marshal(values)
+		if err := json.Unmarshal(encoded, &details); err != nil {
+			log.Warn().Err(err).Str("address", raw.PropertyDetails.Address).Msg("Skipping listing fields of unreadable record")
+			details = *raw.PropertyDetails
+		}
+		set["propertyDetails"] = details
+
+		if _, err := col.UpdateOne(ctx, bson.M{"_id": raw.ID}, bson.M{"$set": set}); err != nil {
+			return err
+		}
+		migrated++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if migrated > 0 {
+		log.Info().Int("records", migrated).Msg("Added listing fields to captured properties")
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLotSizeSquareFeet(t *testing.T) {
+	tests := []struct {
+		lotSize string
+		want    float64
+		ok      bool
+	}{
+		{"0.25 Acres", 10890, true},
+		{"8,276 sq ft", 8276, true},
+		{".5 ac", 21780, true},
+		{"1 acre", 43560, true},
+		{"9,148 sqft lot", 9148, true},
+		{"7500 SF", 7500, true},
+		{"1/4 acre", 0, false},
+		{"Corner lot", 0, false},
+		{"0 acres", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := lotSizeSquareFeet(tt.lotSize)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("lotSizeSquareFeet(%q) = %v, %v, want %v, %v", tt.lotSize, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDeriveListingFields(t *testing.T) {
+	price := FieldProvenance{Value: 450000.0, Confidence: 0.9, Evidence: "$450,000", Source: "llm"}
+	tests := []struct {
+		name       string
+		provenance map[string]FieldProvenance
+		want       map[string]interface{}
+	}{
+		{
+			name:       "active",
+			provenance: map[string]FieldProvenance{"listingStatus": {Value: "active"}, "price": price},
+			want:       map[string]interface{}{"listPrice": 450000.0, "soldPrice": nil},
+		},
+		{
+			name:       "pending",
+			provenance: map[string]FieldProvenance{"listingStatus": {Value: "pending"}, "price": price},
+			want:       map[string]interface{}{"listPrice": 450000.0, "soldPrice": nil},
+		},
+		{
+			name:       "sold",
+			provenance: map[string]FieldProvenance{"listingStatus": {Value: "sold"}, "price": price},
+			want:       map[string]interface{}{"listPrice": nil, "soldPrice": 450000.0},
+		},
+		{
+			name:       "unknown status",
+			provenance: map[string]FieldProvenance{"price": price},
+			want:       map[string]interface{}{"listPrice": nil, "soldPrice": nil},
+		},
+		{
+			name: "stated prices are kept",
+			provenance: map[string]FieldProvenance{
+				"listingStatus": {Value: "sold"}, "price": price, "soldPrice": {Value: 445000.0},
+			},
+			want: map[string]interface{}{"listPrice": nil, "soldPrice": 445000.0},
+		},
+		{
+			name:       "lot size in square feet",
+			provenance: map[string]FieldProvenance{"lotSize": {Value: "0.25 Acres", Evidence: "Lot: 0.25 Acres"}},
+			want:       map[string]interface{}{"lotSizeSqFt": 10890.0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deriveListingFields(tt.provenance)
+			for field, want := range tt.want {
+				if got := tt.provenance[field].Value; got != want {
+					t.Errorf("%s = %v, want %v", field, got, want)
+				}
+			}
+		})
+	}
+
+	t.Run("derived values keep their source's provenance", func(t *testing.T) {
+		provenance := map[string]FieldProvenance{"listingStatus": {Value: "active"}, "price": price}
+		deriveListingFields(provenance)
+		if got := provenance["listPrice"]; !reflect.DeepEqual(got, price) {
+			t.Errorf("listPrice provenance = %+v, want %+v", got, price)
+		}
+	})
+}
+
+func TestCheckDates(t *testing.T) {
+	answer := []byte(`{"listDate": {"value": "3/4/2024"}, "soldDate": {"value": "2024-03-04"}, "closeDate": {"value": null}}`)
+	errs := checkDates(answer)
+	if len(errs) != 1 || errs[0].Path != "listDate.value" {
+		t.Errorf("checkDates = %v, want one error for listDate.value", errs)
+	}
+}
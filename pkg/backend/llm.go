@@ -5,74 +5,349 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/google/generative-ai-go/genai"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"google.golang.org/api/option"
+	"github.com/rs/zerolog/log"
 )
 
-// ExtractPropertyDetails uses Gemini to parse property details from the content
-func ExtractPropertyDetails(content string) (*PropertyDetails, error) {
-	ctx := context.Background()
-	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
+// defaultRepairAttempts is how many times a response that fails validation is
+// sent back to the model with the errors before giving up.
+const defaultRepairAttempts = 2
+
+func repairAttempts() int {
+	if n, err := strconv.Atoi(os.Getenv("LLM_REPAIR_ATTEMPTS")); err == nil && n >= 0 {
+		return n
+	}
+	return defaultRepairAttempts
+}
+
+// generationObserver receives progress while a structured answer is generated.
+// A nil observer, or nil hooks, are ignored.
+type generationObserver struct {
+	// PromptSent is called before each attempt is sent to the model.
+	PromptSent func(model string, attempt int)
+	// Chunk receives answer text as it streams in.
+	Chunk func(text string)
+	// Rejected is called when an answer failed validation and will be repaired.
+	Rejected func(errs []FieldError)
+	// ToolCalled is called after a calculation requested by the model has run.
+	ToolCalled func(call ToolCall)
+	// FactCheckFailed is called before an analysis is regenerated because of
+	// its discrepancies.
+	FactCheckFailed func(discrepancies []Discrepancy)
+}
+
+// llmTarget pins the provider, model and prompt version of the LLM calls made
+// with a context, e.g. for one run of a consensus extraction.
+type llmTarget struct {
+	provider      LLMProvider
+	model         string
+	promptVersion *int
+}
+
+type llmTargetKey struct{}
+
+func withLLMTarget(ctx context.Context, target *llmTarget) context.Context {
+	return context.WithValue(ctx, llmTargetKey{}, target)
+}
+
+func llmTargetFrom(ctx context.Context) *llmTarget {
+	target, _ := ctx.Value(llmTargetKey{}).(*llmTarget)
+	return target
+}
+
+// providerForTask returns the provider and model to use for the task, honoring
+// a target pinned on the context.
+func providerForTask(ctx context.Context, task LLMTask) (LLMProvider, string, error) {
+	if target := llmTargetFrom(ctx); target != nil {
+		return target.provider, target.model, nil
+	}
+	provider, err := currentLLMProvider()
+	if err != nil {
+		return nil, "", err
+	}
+	if settings := taskSettings(ctx, task); settings != nil && settings.Model != "" {
+		return provider, settings.Model, nil
+	}
+	return provider, modelForTask(provider.Name(), task), nil
+}
+
+// generateJSON sends the prompt and any images to the configured provider using the
+// model for the task and returns the raw answer. With an observer that wants chunks, the answer is
+// streamed when the provider supports it. Transient provider errors are retried
+// with backoff, except once a streamed answer has started.
+func generateJSON(ctx context.Context, task LLMTask, prompt string, images []LLMImage, schema *Schema, obs *generationObserver) (string, error) {
+	provider, model, err := providerForTask(ctx, task)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Gemini client: %v", err)
-	}
-	defer client.Close()
-
-	model := client.GenerativeModel("gemini-1.5-flash")
-	prompt := `Extract the following property details from the given real estate listing text. 
-	Return ONLY a JSON object with these exact fields (use null for missing values):
-	{
-		"address": "string",
-		"price": number,
-		"bedrooms": number,
-		"bathrooms": number,
-		"squareFootage": number,
-		"yearBuilt": number,
-		"propertyType": "string",
-		"lotSize": "string",
-		"mlsNumber": "string",
-		"daysOnMarket": number,
-		"lastPriceChange": number,
-		"description": "string"
-	}
-
-	Here is the listing text:
-	` + content
-
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+		return "", err
+	}
+
+	req := LLMRequest{
+		Model:  model,
+		Prompt: prompt,
+		Schema: schema,
+		Config: generationConfigFor(ctx, task),
+		Images: images,
+	}
+	streamed := false
+	resp, err := callResilient(ctx, provider.Name(), func(ctx context.Context) (*LLMResponse, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeoutForTask(task))
+		defer cancel()
+
+		start := time.Now()
+		var resp *LLMResponse
+		var err error
+		if obs != nil && obs.Chunk != nil {
+			if streamer, ok := provider.(StreamingProvider); ok {
+				resp, err = streamer.StreamJSON(ctx, req, func(chunk string) {
+					streamed = true
+					obs.Chunk(chunk)
+				})
+			} else {
+				resp, err = provider.GenerateJSON(ctx, req)
+				if err == nil {
+					obs.Chunk(resp.Text)
+				}
+			}
+		} else {
+			resp, err = provider.GenerateJSON(ctx, req)
+		}
+		recordUsage(ctx, task, provider.Name(), req, resp, err, time.Since(start))
+		return resp, err
+	}, func() bool { return !streamed })
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate content: %v", err)
+		return "", err
+	}
+	return resp.Text, nil
+}
+
+// extractJSONObject returns the outermost JSON object in text, tolerating
+// code fences or commentary around it.
+func extractJSONObject(text string) string {
+	start := strings.Index(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start == -1 || end == -1 || end < start {
+		return text
 	}
+	return text[start : end+1]
+}
+
+// generateStructured asks the model for JSON matching the schema derived from out,
+// validates the answer and re-prompts with the validation errors until it passes
+// or the repair attempts are used up, in which case a *ValidationError is returned.
+func generateStructured(ctx context.Context, task LLMTask, prompt string, out interface{}) error {
+	return generateStructuredObserved(ctx, task, prompt, out, nil)
+}
+
+// generateStructuredObserved is generateStructured reporting progress to obs.
+func generateStructuredObserved(ctx context.Context, task LLMTask, prompt string, out interface{}, obs *generationObserver) error {
+	return generateValidated(ctx, task, prompt, SchemaFor(out), out, obs)
+}
+
+// generateValidated runs the validate and repair loop against an explicit schema
+// and decodes the accepted answer into out.
+func generateValidated(ctx context.Context, task LLMTask, prompt string, schema *Schema, out interface{}, obs *generationObserver) error {
+	return generateChecked(ctx, task, prompt, nil, schema, nil, out, obs)
+}
+
+// generateChecked is generateValidated with images sent along with the prompt on
+// every attempt and an extra check of answers that match the schema; the errors
+// the check returns are repaired like schema violations.
+func generateChecked(ctx context.Context, task LLMTask, prompt string, images []LLMImage, schema *Schema, check func(answer []byte) []FieldError, out interface{}, obs *generationObserver) error {
+	maxRepairs := repairAttempts()
 
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return nil, fmt.Errorf("no content generated")
+	attemptPrompt := prompt
+	var answer string
+	var errs []FieldError
+	for attempt := 0; attempt <= maxRepairs; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if obs != nil && obs.PromptSent != nil {
+			_, model, err := providerForTask(ctx, task)
+			if err != nil {
+				return err
+			}
+			obs.PromptSent(model, attempt)
+		}
+		text, err := generateJSON(ctx, task, attemptPrompt, images, schema, obs)
+		if err != nil {
+			return err
+		}
+
+		answer = extractJSONObject(text)
+		errs = ValidateJSON(schema, []byte(answer))
+		if len(errs) == 0 && check != nil {
+			errs = check([]byte(answer))
+		}
+		if len(errs) == 0 {
+			if err := json.Unmarshal([]byte(answer), out); err != nil {
+				return fmt.Errorf("failed to parse JSON response: %v", err)
+			}
+			return nil
+		}
+
+		log.Warn().Str("task", string(task)).Int("attempt", attempt+1).Int("errors", len(errs)).
+			Msg("LLM response failed schema validation")
+		if obs != nil && obs.Rejected != nil && attempt < maxRepairs {
+			obs.Rejected(errs)
+		}
+		attemptPrompt = repairPrompt(prompt, text, errs)
 	}
 
-	// Extract the JSON response from the model's output
-	responseText := fmt.Sprintf("%v", resp.Candidates[0].Content.Parts[0])
-	// Clean up the response to get just the JSON
-	start := strings.Index(responseText, "{")
-	end := strings.LastIndex(responseText, "}")
-	if start == -1 || end == -1 {
-		return nil, fmt.Errorf("invalid response format")
+	return &ValidationError{
+		Task:     task,
+		Attempts: maxRepairs + 1,
+		Errors:   errs,
+		Response: answer,
 	}
-	jsonStr := responseText[start : end+1]
+}
 
-	var details PropertyDetails
-	if err := json.Unmarshal([]byte(jsonStr), &details); err != nil {
-		return nil, fmt.Errorf("failed to parse JSON response: %v", err)
+// repairPrompt repeats the original request together with the rejected answer
+// and the validation errors it produced.
+func repairPrompt(prompt, answer string, errs []FieldError) string {
+	var builder strings.Builder
+	builder.WriteString(prompt)
+	builder.WriteString("\n\nYour previous answer was:\n")
+	builder.WriteString(answer)
+	builder.WriteString("\n\nIt was rejected because of these validation errors:\n")
+	for _, fe := range errs {
+		builder.WriteString("- ")
+		builder.WriteString(fe.String())
+		builder.WriteString("\n")
 	}
+	builder.WriteString("\nReturn ONLY a corrected JSON object that fixes every error.")
+	return builder.String()
+}
 
-	return &details, nil
+// ExtractPropertyDetails uses the configured LLM provider to parse property details from the content
+func ExtractPropertyDetails(ctx context.Context, content string) (*PropertyDetails, error) {
+	details, _, err := ExtractPropertyDetailsWithProvenance(ctx, content)
+	return details, err
+}
+
+// ExtractPropertyDetailsWithProvenance parses property details from the content
+// and reports, for every field, the model's confidence and the supporting text.
+// With LLM_EXTRACTION_CONSENSUS set, several runs vote on the values.
+func ExtractPropertyDetailsWithProvenance(ctx context.Context, content string) (*PropertyDetails, map[string]FieldProvenance, error) {
+	return extractListing(ctx, content, nil)
+}
+
+// ExtractPageDetails reads the fields the site extractor for the page's host
+// and the structured data in its HTML find, and extracts only the others from
+// the content with the LLM.
+func ExtractPageDetails(ctx context.Context, page *RawPageData) (*PropertyDetails, map[string]FieldProvenance, error) {
+	known := readPage(page)
+	fields := missingFields(known)
+	var extracted map[string]FieldProvenance
+	if known == nil || len(fields) > 0 {
+		var err error
+		if _, extracted, err = extractListing(ctx, page.Content, fields); err != nil {
+			return nil, nil, err
+		}
+	}
+	return detailsWithStructuredData(known, extracted)
+}
+
+// detailsWithStructuredData overlays the structured values on the extracted
+// ones, derives the listing fields that can be, and builds the property
+// details, which must have an address.
+func detailsWithStructuredData(structured, extracted map[string]FieldProvenance) (*PropertyDetails, map[string]FieldProvenance, error) {
+	provenance := withStructuredData(structured, extracted)
+	deriveListingFields(provenance)
+	details, err := detailsFromProvenance(provenance)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.TrimSpace(details.Address) == "" {
+		return nil, nil, fmt.Errorf("no address found in listing")
+	}
+	return details, provenance, nil
+}
+
+// extractListing extracts the given fields, or all of them when fields is nil.
+// The address is required only when it is asked for.
+func extractListing(ctx context.Context, content string, fields []string) (*PropertyDetails, map[string]FieldProvenance, error) {
+	if refs := consensusRefs(); refs != nil {
+		return consensusExtraction(ctx, content, refs, fields)
+	}
+	return extractSingle(ctx, content, fields)
+}
+
+// extractSingle runs one extraction of the given fields. Boilerplate is stripped
+// first; pages that are still too long for one call are extracted in chunks
+// whose results are merged.
+func extractSingle(ctx context.Context, content string, fields []string) (*PropertyDetails, map[string]FieldProvenance, error) {
+	chunks := listingChunks(content)
+
+	if len(chunks) == 1 {
+		provenance, err := extractFields(ctx, chunks[0], content, extractionSchema(fields...))
+		if err != nil {
+			return nil, nil, err
+		}
+		details, err := detailsFromProvenance(provenance)
+		if err != nil {
+			return nil, nil, err
+		}
+		return details, provenance, nil
+	}
+
+	var partial []map[string]FieldProvenance
+	for i, chunk := range chunks {
+		provenance, err := extractFields(ctx, chunk, content, chunkExtractionSchema(fields...))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to extract chunk %d of %d: %w", i+1, len(chunks), err)
+		}
+		partial = append(partial, provenance)
+	}
+
+	provenance := mergeProvenance(partial)
+	if wantsField(fields, "address") && provenance["address"].Value == nil {
+		return nil, nil, fmt.Errorf("no address found in listing")
+	}
+	details, err := detailsFromProvenance(provenance)
+	if err != nil {
+		return nil, nil, err
+	}
+	return details, provenance, nil
+}
+
+// wantsField tells whether an extraction of fields, nil meaning all, includes name.
+func wantsField(fields []string, name string) bool {
+	return fields == nil || slices.Contains(fields, name)
+}
+
+// extractFields runs the extraction prompt over text and locates the evidence
+// of each field in the full page content.
+func extractFields(ctx context.Context, text, content string, schema *Schema) (map[string]FieldProvenance, error) {
+	var tmpl *PromptTemplate
+	var err error
+	if target := llmTargetFrom(ctx); target != nil && target.promptVersion != nil {
+		tmpl, err = findPromptTemplate(ctx, PromptExtraction, *target.promptVersion)
+	} else {
+		tmpl, err = activePromptTemplate(ctx, PromptExtraction)
+	}
+	if err != nil {
+		return nil, err
+	}
+	prompt, err := renderPrompt(tmpl, extractionPromptData(text, schema))
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]extractedField
+	if err := generateChecked(ctx, TaskExtraction, prompt, nil, schema, checkDates, &fields, nil); err != nil {
+		return nil, err
+	}
+	return provenanceFromFields(fields, content)
 }
 
 // ExtractAddressFromPage extracts the address from property details
-func ExtractAddressFromPage(content string) (string, error) {
-	details, err := ExtractPropertyDetails(content)
+func ExtractAddressFromPage(ctx context.Context, content string) (string, error) {
+	details, err := ExtractPropertyDetails(ctx, content)
 	if err != nil {
 		return "", err
 	}
@@ -87,134 +362,118 @@ func reverseString(s string) string {
 	return string(runes)
 }
 
-func formatPropertyDetails(property PropertyDetails) string {
-	jsonData, _ := json.MarshalIndent(property, "", "  ")
-	return string(jsonData)
+// GenerateDetailedBMA generates a comprehensive BMA analysis using the configured LLM provider,
+// the instructions of the default profile and the default locale.
+func GenerateDetailedBMA(ctx context.Context, primary PropertyDetails, comparisons []PropertyDetails) (DetailedAnalysis, error) {
+	instructions, err := loadLLMInstructions(ctx)
+	if err != nil {
+		return DetailedAnalysis{}, err
+	}
+	opts := analysisOptions{Instructions: instructions, Locale: defaultReportLocale()}
+	result, err := generateDetailedBMA(ctx, primary, comparisons, opts, nil)
+	return result.Analysis, err
 }
 
-func formatComparisonProperties(properties []PropertyDetails) string {
-	var builder strings.Builder
-	for i, prop := range properties {
-		builder.WriteString(fmt.Sprintf("Comparison Property %d:\n", i+1))
-		jsonData, _ := json.MarshalIndent(prop, "", "  ")
-		builder.WriteString(string(jsonData))
-		builder.WriteString("\n\n")
-	}
-	return builder.String()
+// analysisOptions are the choices of one report that shape its analysis.
+type analysisOptions struct {
+	// Instructions come from the selected instruction profile.
+	Instructions string
+	// Locale sets the language and formats of the text; nil means the default locale.
+	Locale *ReportLocale
 }
 
-// GenerateDetailedBMA generates a comprehensive BMA analysis using Gemini
-func GenerateDetailedBMA(primary PropertyDetails, comparisons []PropertyDetails) (DetailedAnalysis, error) {
-	// Get LLM instructions
-	var instructions LLMInstructions
-	err := llmInstructionsCollection.FindOne(context.Background(), bson.M{}).Decode(&instructions)
-	if err != nil && err != mongo.ErrNoDocuments {
-		return DetailedAnalysis{}, fmt.Errorf("error fetching LLM instructions: %v", err)
-	}
-
-	prompt := fmt.Sprintf(`Generate a detailed BMA (Broker Market Analysis) report comparing the following properties:
-
-Primary Property:
-%s
-
-Comparison Properties:
-%s
-
-Additional Instructions:
-%s
-
-Please provide a comprehensive analysis including:
-1. Price analysis comparing the primary property to the comparisons
-2. Detailed feature comparison (bedrooms, bathrooms, square footage, etc.)
-3. Market trends and context
-4. Final recommendation
-
-Format the response as a JSON object with the following structure:
-{
-    "primaryPropertyDetails": {
-        "address": "string",
-        "price": number,
-        "bedrooms": number,
-        "bathrooms": number,
-        "squareFootage": number,
-        "yearBuilt": number,
-        "propertyType": "string",
-        "lotSize": "string",
-        "mlsNumber": "string",
-        "daysOnMarket": number,
-        "lastPriceChange": number,
-        "description": "string"
-    },
-    "comparisonDetails": [
-        {
-            "address": "string",
-            "price": number,
-            "bedrooms": number,
-            "bathrooms": number,
-            "squareFootage": number,
-            "yearBuilt": number,
-            "propertyType": "string",
-            "lotSize": "string",
-            "mlsNumber": "string",
-            "daysOnMarket": number,
-            "lastPriceChange": number,
-            "description": "string"
-        }
-    ],
-    "priceAnalysis": "string",
-    "featureComparison": [
-        {
-            "feature": "string",
-            "primaryValue": "string",
-            "comparison": [
-                {
-                    "address": "string",
-                    "value": "string"
-                }
-            ],
-            "analysis": "string"
-        }
-    ],
-    "marketTrends": "string",
-    "recommendation": "string"
-}`, formatPropertyDetails(primary), formatComparisonProperties(comparisons), instructions.Instructions)
-
-	ctx := context.Background()
-	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
-	if err != nil {
-		return DetailedAnalysis{}, fmt.Errorf("failed to create Gemini client: %v", err)
+func (o analysisOptions) locale() *ReportLocale {
+	if o.Locale == nil {
+		return defaultReportLocale()
 	}
-	defer client.Close()
+	return o.Locale
+}
 
-	model := client.GenerativeModel("gemini-1.5-pro")
+// generatedAnalysis is an analysis with the calculations it was written with
+// and the claims in it that contradict the property details.
+type generatedAnalysis struct {
+	Analysis      DetailedAnalysis
+	ToolCalls     []ToolCall
+	Discrepancies []Discrepancy
+}
 
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+// generateDetailedBMA generates the analysis for the options, reporting progress to obs.
+// Unless LLM_TOOL_ROUNDS is 0, the model first requests the calculations it needs,
+// which are returned, and an analysis citing figures that are neither in the
+// property data nor calculated is rejected. The finished analysis is fact-checked
+// and regenerated up to FACT_CHECK_REGENERATIONS times while it has more than
+// FACT_CHECK_THRESHOLD discrepancies.
+func generateDetailedBMA(ctx context.Context, primary PropertyDetails, comparisons []PropertyDetails, opts analysisOptions, obs *generationObserver) (generatedAnalysis, error) {
+	prompt, err := analysisPrompt(ctx, primary, comparisons, opts)
 	if err != nil {
-		return DetailedAnalysis{}, fmt.Errorf("failed to generate content: %v", err)
+		return generatedAnalysis{}, err
 	}
 
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return DetailedAnalysis{}, fmt.Errorf("no content generated")
+	var result generatedAnalysis
+	var check func([]byte) []FieldError
+	if toolRounds() > 0 {
+		tools := &analysisTools{primary: primary, comps: comparisons}
+		result.ToolCalls, err = requestToolCalls(ctx, prompt, tools, obs)
+		if err != nil {
+			return generatedAnalysis{}, err
+		}
+		prompt = toolResultsPrompt(prompt, result.ToolCalls)
+		known := knownNumbers(primary, comparisons, opts.Instructions, result.ToolCalls)
+		check = func(answer []byte) []FieldError { return uncitedFigures(answer, known, opts.locale()) }
 	}
 
-	responseText := resp.Candidates[0].Content.Parts[0].(genai.Text)
-	start := strings.Index(string(responseText), "{")
-	end := strings.LastIndex(string(responseText), "}")
-	if start == -1 || end == -1 {
-		return DetailedAnalysis{}, fmt.Errorf("invalid response format")
+	var analysis DetailedAnalysis
+	schema := SchemaFor(&analysis)
+	if err := generateChecked(ctx, TaskAnalysis, prompt, nil, schema, check, &analysis, obs); err != nil {
+		return result, err
 	}
-	jsonStr := string(responseText)[start : end+1]
+	discrepancies := checkFacts(&analysis, primary, comparisons, opts.locale())
 
-	var analysis DetailedAnalysis
-	if err := json.Unmarshal([]byte(jsonStr), &analysis); err != nil {
-		return DetailedAnalysis{}, fmt.Errorf("failed to parse JSON response: %v", err)
+	for i := 0; i < factCheckRegenerations() && len(discrepancies) > factCheckThreshold(); i++ {
+		log.Warn().Int("discrepancies", len(discrepancies)).Int("regeneration", i+1).
+			Msg("Analysis contradicts the property details, regenerating")
+		if obs != nil && obs.FactCheckFailed != nil {
+			obs.FactCheckFailed(discrepancies)
+		}
+		retry := repairPrompt(prompt, analysisAnswer(analysis), discrepancyErrors(discrepancies))
+		var regenerated DetailedAnalysis
+		if err := generateChecked(ctx, TaskAnalysis, retry, nil, schema, check, &regenerated, obs); err != nil {
+			// The first analysis is still usable, with its discrepancies reported
+			if ctx.Err() != nil {
+				return result, err
+			}
+			log.Error().Err(err).Msg("Failed to regenerate the analysis")
+			break
+		}
+		analysis = regenerated
+		discrepancies = checkFacts(&analysis, primary, comparisons, opts.locale())
 	}
 
 	// Set the actual property details
 	analysis.PrimaryPropertyDetails = primary
 	analysis.ComparisonDetails = comparisons
 
-	return analysis, nil
+	result.Analysis = analysis
+	result.Discrepancies = discrepancies
+	return result, nil
+}
+
+// analysisPrompt renders the active analysis template, including the profile's
+// instructions, and asks for the report's language and formats.
+func analysisPrompt(ctx context.Context, primary PropertyDetails, comparisons []PropertyDetails, opts analysisOptions) (string, error) {
+	data := analysisPromptData(primary, comparisons, opts.Instructions)
+	tmpl, err := activePromptTemplate(ctx, PromptAnalysis)
+	if err != nil {
+		return "", err
+	}
+	prompt, err := renderPrompt(tmpl, data)
+	if err != nil {
+		return "", err
+	}
+	if instruction := opts.locale().instruction(); instruction != "" {
+		prompt += "\n\n" + instruction
+	}
+	return prompt, nil
 }
 
 // Helper function to safely marshal JSON
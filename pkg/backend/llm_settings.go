@@ -0,0 +1,225 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LLMSettings are the stored model and generation settings of one task. They
+// take precedence over LLM_<TASK>_MODEL and the provider defaults.
+type LLMSettings struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Task             LLMTask            `bson:"task" json:"task"`
+	Model            string             `bson:"model,omitempty" json:"model,omitempty"`
+	GenerationConfig `bson:",inline"`
+	UpdatedAt        time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+var (
+	// settingsCache holds the stored settings by task; a nil entry means none
+	// are stored. It is reset whenever settings are saved.
+	settingsCache   map[LLMTask]*LLMSettings
+	settingsCacheMu sync.Mutex
+)
+
+func isLLMTask(task LLMTask) bool {
+	for _, t := range llmTasks {
+		if t == task {
+			return true
+		}
+	}
+	return false
+}
+
+// taskSettings returns the stored settings of the task, or nil when there are none.
+func taskSettings(ctx context.Context, task LLMTask) *LLMSettings {
+	if llmSettingsCollection == nil {
+		return nil
+	}
+
+	settingsCacheMu.Lock()
+	defer settingsCacheMu.Unlock()
+	if settingsCache == nil {
+		cursor, err := llmSettingsCollection.Find(ctx, bson.M{})
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to load LLM settings")
+			return nil
+		}
+		var stored []LLMSettings
+		if err := cursor.All(ctx, &stored); err != nil {
+			log.Error().Err(err).Msg("Failed to load LLM settings")
+			return nil
+		}
+		settingsCache = map[LLMTask]*LLMSettings{}
+		for i := range stored {
+			settingsCache[stored[i].Task] = &stored[i]
+		}
+	}
+	return settingsCache[task]
+}
+
+func resetSettingsCache() {
+	settingsCacheMu.Lock()
+	settingsCache = nil
+	settingsCacheMu.Unlock()
+}
+
+// generationConfigFor returns the generation settings to send with the task's requests.
+func generationConfigFor(ctx context.Context, task LLMTask) GenerationConfig {
+	if settings := taskSettings(ctx, task); settings != nil {
+		return settings.GenerationConfig
+	}
+	return GenerationConfig{}
+}
+
+// validateLLMSettings checks the ranges the providers accept.
+func validateLLMSettings(s *LLMSettings) error {
+	if s.Temperature != nil && (*s.Temperature < 0 || *s.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if s.TopP != nil && (*s.TopP <= 0 || *s.TopP > 1) {
+		return fmt.Errorf("topP must be greater than 0 and at most 1")
+	}
+	if s.MaxTokens < 0 {
+		return fmt.Errorf("maxTokens must not be negative")
+	}
+	seen := map[string]bool{}
+	for _, safety := range s.Safety {
+		if _, ok := geminiHarmCategories[safety.Category]; !ok {
+			return fmt.Errorf("unknown safety category %q", safety.Category)
+		}
+		if _, ok := geminiHarmThresholds[safety.Threshold]; !ok {
+			return fmt.Errorf("unknown safety threshold %q", safety.Threshold)
+		}
+		if seen[safety.Category] {
+			return fmt.Errorf("duplicate safety category %q", safety.Category)
+		}
+		seen[safety.Category] = true
+	}
+	return nil
+}
+
+// invalidateCachesForTask drops results produced with the task's old settings:
+// stored extractions for extraction, cached reports for analysis.
+func invalidateCachesForTask(ctx context.Context, task LLMTask) {
+	switch task {
+	case TaskExtraction:
+		if extractionCacheCollection == nil {
+			return
+		}
+		res, err := extractionCacheCollection.DeleteMany(ctx, bson.M{})
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to clear extraction cache")
+			return
+		}
+		log.Info().Int64("deleted", res.DeletedCount).Msg("Cleared extraction cache after settings change")
+	case TaskAnalysis:
+		if cachedBMAReportsCollection == nil {
+			return
+		}
+		if _, err := cachedBMAReportsCollection.DeleteMany(ctx, bson.M{}); err != nil {
+			log.Error().Err(err).Msg("Failed to clear cached reports")
+		}
+	}
+}
+
+// effectiveSettings describes what a task's calls currently use.
+func effectiveSettings(ctx context.Context, task LLMTask) fiber.Map {
+	stored := taskSettings(ctx, task)
+	provider, model, err := providerForTask(ctx, task)
+	providerName := configuredProviderName()
+	if err == nil {
+		providerName = provider.Name()
+	}
+
+	effective := fiber.Map{
+		"provider": providerName,
+		"model":    model,
+		"timeout":  timeoutForTask(task).String(),
+	}
+	if stored != nil {
+		effective["config"] = stored.GenerationConfig
+	}
+	return fiber.Map{
+		"task":         task,
+		"stored":       stored,
+		"defaultModel": modelForTask(providerName, task),
+		"effective":    effective,
+	}
+}
+
+// handleListLLMSettings returns the stored and effective settings of every task.
+func handleListLLMSettings(c *fiber.Ctx) error {
+	settings := make([]fiber.Map, 0, len(llmTasks))
+	for _, task := range llmTasks {
+		settings = append(settings, effectiveSettings(c.UserContext(), task))
+	}
+	return c.JSON(settings)
+}
+
+// handleGetLLMSettings returns the stored and effective settings of one task.
+func handleGetLLMSettings(c *fiber.Ctx) error {
+	task := LLMTask(c.Params("task"))
+	if !isLLMTask(task) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Unknown task"})
+	}
+	return c.JSON(effectiveSettings(c.UserContext(), task))
+}
+
+// handleUpdateLLMSettings replaces the stored settings of a task. Omitted
+// fields fall back to the defaults.
+func handleUpdateLLMSettings(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	task := LLMTask(c.Params("task"))
+	if !isLLMTask(task) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Unknown task"})
+	}
+
+	var settings LLMSettings
+	if err := c.BodyParser(&settings); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if err := validateLLMSettings(&settings); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	settings.ID = primitive.NilObjectID
+	settings.Task = task
+	settings.UpdatedAt = time.Now()
+
+	_, err := llmSettingsCollection.ReplaceOne(ctx, bson.M{"task": task}, settings, options.Replace().SetUpsert(true))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	resetSettingsCache()
+	invalidateCachesForTask(ctx, task)
+
+	log.Info().Str("task", string(task)).Str("model", settings.Model).Msg("Updated LLM settings")
+	return c.JSON(effectiveSettings(ctx, task))
+}
+
+// handleDeleteLLMSettings removes the stored settings of a task, restoring the defaults.
+func handleDeleteLLMSettings(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	task := LLMTask(c.Params("task"))
+	if !isLLMTask(task) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Unknown task"})
+	}
+
+	res, err := llmSettingsCollection.DeleteOne(ctx, bson.M{"task": task})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	resetSettingsCache()
+	if res.DeletedCount > 0 {
+		invalidateCachesForTask(ctx, task)
+	}
+	return c.JSON(effectiveSettings(ctx, task))
+}
@@ -0,0 +1,186 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLocale is used when a report does not ask for a locale.
+const DefaultLocale = "en-US"
+
+// ErrUnsupportedLocale is returned for a locale no report can be written in.
+var ErrUnsupportedLocale = errors.New("unsupported locale")
+
+// ReportLocale is the language of a report's text and the way its numbers,
+// prices and dates are written. Prices are always in US dollars.
+type ReportLocale struct {
+	Tag      string `json:"tag"`
+	Language string `json:"language"`
+	// Decimal and Group separate the fraction and the thousands of numbers.
+	Decimal string `json:"decimal"`
+	Group   string `json:"group"`
+	// Currency places the formatted amount, e.g. "$%s" or "%s US$".
+	Currency string `json:"currency"`
+
+	months     [12]string
+	dateFormat string
+	messages   map[string]string
+	figures    *regexp.Regexp
+}
+
+// Messages used in reports that are not written by the model.
+const (
+	msgNoPrimary        = "no_primary"
+	msgNoComparisons    = "no_comparisons"
+	msgNeedsReview      = "needs_review"
+	msgInjectionRefused = "injection_refused"
+	msgInjectionWarning = "injection_warning"
+)
+
+var englishMessages = map[string]string{
+	msgNoPrimary:        "No primary address set yet.",
+	msgNoComparisons:    "Need at least one enabled comparison address.",
+	msgNeedsReview:      "These addresses need review before a BMA can be generated: %s",
+	msgInjectionRefused: "No BMA was generated because these listings contain text that looks like instructions to an AI: %s",
+	msgInjectionWarning: "The listing for %s contains text that looks like instructions to an AI (%s risk); verify the analysis against the listing.",
+}
+
+var spanishMessages = map[string]string{
+	msgNoPrimary:        "Todavía no se ha elegido una dirección principal.",
+	msgNoComparisons:    "Se necesita al menos una dirección de comparación activada.",
+	msgNeedsReview:      "Estas direcciones deben revisarse antes de generar un BMA: %s",
+	msgInjectionRefused: "No se generó el BMA porque estos anuncios contienen texto que parece dar instrucciones a una IA: %s",
+	msgInjectionWarning: "El anuncio de %s contiene texto que parece dar instrucciones a una IA (riesgo %s); verifique el análisis con el anuncio.",
+}
+
+var englishMonths = [12]string{"January", "February", "March", "April", "May", "June",
+	"July", "August", "September", "October", "November", "December"}
+
+var spanishMonths = [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio",
+	"julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"}
+
+// reportLocales lists the supported locales; the first one of each language
+// is used when only the language is requested.
+var reportLocales = []*ReportLocale{
+	newReportLocale("en-US", "English", ".", ",", "$%s", englishMonths, "{month} {day}, {year}", englishMessages),
+	newReportLocale("es-US", "Spanish", ".", ",", "$%s", spanishMonths, "{day} de {month} de {year}", spanishMessages),
+	newReportLocale("es-MX", "Spanish", ".", ",", "US$%s", spanishMonths, "{day} de {month} de {year}", spanishMessages),
+	newReportLocale("es-ES", "Spanish", ",", ".", "%s US$", spanishMonths, "{day} de {month} de {year}", spanishMessages),
+}
+
+func newReportLocale(tag, language, decimal, group, currency string, months [12]string, dateFormat string, messages map[string]string) *ReportLocale {
+	d, g := regexp.QuoteMeta(decimal), regexp.QuoteMeta(group)
+	return &ReportLocale{
+		Tag:        tag,
+		Language:   language,
+		Decimal:    decimal,
+		Group:      group,
+		Currency:   currency,
+		months:     months,
+		dateFormat: dateFormat,
+		messages:   messages,
+		// Groups: dollar sign, whole part, fraction with its separator, suffix
+		figures: regexp.MustCompile(`(\$)?(\d{1,3}(?:` + g + `\d{3})+|\d+)(` + d + `\d+)?\s?([kKmM]\b|%|US\$|\$)?`),
+	}
+}
+
+// parseFigure returns the value of a match of the figures pattern, without
+// applying its suffix.
+func (l *ReportLocale) parseFigure(m []string) (float64, bool) {
+	whole := strings.ReplaceAll(m[2], l.Group, "")
+	fraction := strings.Replace(m[3], l.Decimal, ".", 1)
+	v, err := strconv.ParseFloat(whole+fraction, 64)
+	return v, err == nil
+}
+
+// findReportLocale resolves a tag such as "es-US", "es_us" or "es". An empty
+// tag selects DefaultLocale.
+func findReportLocale(tag string) (*ReportLocale, error) {
+	tag = strings.ReplaceAll(strings.TrimSpace(tag), "_", "-")
+	if tag == "" {
+		tag = DefaultLocale
+	}
+	for _, l := range reportLocales {
+		if strings.EqualFold(l.Tag, tag) {
+			return l, nil
+		}
+	}
+	language, _, _ := strings.Cut(tag, "-")
+	for _, l := range reportLocales {
+		if strings.EqualFold(l.Tag[:2], language) {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnsupportedLocale, tag)
+}
+
+// defaultReportLocale returns the locale of reports that do not ask for one.
+func defaultReportLocale() *ReportLocale {
+	return reportLocales[0]
+}
+
+// Message returns a fixed report message, formatted with args.
+func (l *ReportLocale) Message(key string, args ...interface{}) string {
+	format, ok := l.messages[key]
+	if !ok {
+		format = englishMessages[key]
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// FormatNumber writes v with the given number of decimals, e.g. 1.234,5 in es-ES.
+func (l *ReportLocale) FormatNumber(v float64, decimals int) string {
+	s := fmt.Sprintf("%.*f", decimals, math.Abs(v))
+	whole, fraction, _ := strings.Cut(s, ".")
+
+	var b strings.Builder
+	if v < 0 && strings.Trim(s, "0.") != "" {
+		b.WriteString("-")
+	}
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(l.Group)
+		}
+		b.WriteRune(r)
+	}
+	if fraction != "" {
+		b.WriteString(l.Decimal)
+		b.WriteString(fraction)
+	}
+	return b.String()
+}
+
+// FormatMoney writes a dollar amount without cents, e.g. $512,000 or 512.000 US$.
+func (l *ReportLocale) FormatMoney(v float64) string {
+	return fmt.Sprintf(l.Currency, l.FormatNumber(v, 0))
+}
+
+// FormatDate writes a date in full, e.g. October 16, 2026 or 16 de octubre de 2026.
+func (l *ReportLocale) FormatDate(t time.Time) string {
+	return strings.NewReplacer(
+		"{day}", fmt.Sprint(t.Day()),
+		"{month}", l.months[t.Month()-1],
+		"{year}", fmt.Sprint(t.Year()),
+	).Replace(l.dateFormat)
+}
+
+// exampleDate is formatted in the locale instruction; a fixed date keeps the
+// prompt, and so recorded answers, the same from day to day.
+var exampleDate = time.Date(2025, time.March, 5, 0, 0, 0, 0, time.UTC)
+
+// instruction tells the model how to write the report. The default locale
+// needs none, which keeps its prompts unchanged.
+func (l *ReportLocale) instruction() string {
+	if l.Tag == DefaultLocale {
+		return ""
+	}
+	return fmt.Sprintf("Write every text value of the analysis in %s (%s), including feature names and the values "+
+		"in the feature comparison; keep the JSON keys and the addresses as they are. Write numbers like %s, "+
+		"prices in US dollars like %s and dates like %s.",
+		l.Language, l.Tag, l.FormatNumber(1234.5, 1), l.FormatMoney(512000), l.FormatDate(exampleDate))
+}
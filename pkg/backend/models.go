@@ -8,26 +8,101 @@ import (
 
 // PropertyDetails contains all the relevant information extracted from a property listing
 type PropertyDetails struct {
-	Address         string  `bson:"address" json:"address"`
-	Price           float64 `bson:"price" json:"price"`
-	Bedrooms        int     `bson:"bedrooms" json:"bedrooms"`
-	Bathrooms       float64 `bson:"bathrooms" json:"bathrooms"`
-	SquareFootage   int     `bson:"squareFootage" json:"squareFootage"`
-	YearBuilt       int     `bson:"yearBuilt" json:"yearBuilt"`
-	PropertyType    string  `bson:"propertyType" json:"propertyType"`
-	LotSize         string  `bson:"lotSize" json:"lotSize"`
-	MLSNumber       string  `bson:"mlsNumber" json:"mlsNumber"`
-	DaysOnMarket    int     `bson:"daysOnMarket" json:"daysOnMarket"`
-	LastPriceChange float64 `bson:"lastPriceChange" json:"lastPriceChange"`
-	Description     string  `bson:"description" json:"description"`
+	Address         string  `bson:"address" json:"address" llm:"nonempty"`
+	Price           float64 `bson:"price" json:"price" llm:"nullable,min=0"`
+	Bedrooms        int     `bson:"bedrooms" json:"bedrooms" llm:"nullable,min=0,max=50"`
+	Bathrooms       float64 `bson:"bathrooms" json:"bathrooms" llm:"nullable,min=0,max=50"`
+	SquareFootage   int     `bson:"squareFootage" json:"squareFootage" llm:"nullable,min=0,max=100000"`
+	YearBuilt       int     `bson:"yearBuilt" json:"yearBuilt" llm:"nullable,min=1600,max=2100"`
+	PropertyType    string  `bson:"propertyType" json:"propertyType" llm:"nullable"`
+	LotSize         string  `bson:"lotSize" json:"lotSize" llm:"nullable"`
+	MLSNumber       string  `bson:"mlsNumber" json:"mlsNumber" llm:"nullable"`
+	DaysOnMarket    int     `bson:"daysOnMarket" json:"daysOnMarket" llm:"nullable,min=0"`
+	LastPriceChange float64 `bson:"lastPriceChange" json:"lastPriceChange" llm:"nullable"`
+	Description     string  `bson:"description" json:"description" llm:"nullable"`
+	// Latitude and Longitude locate the property when the listing states them.
+	Latitude  float64 `bson:"latitude" json:"latitude" llm:"nullable,min=-90,max=90"`
+	Longitude float64 `bson:"longitude" json:"longitude" llm:"nullable,min=-180,max=180"`
+	// ListingStatus is "active", "pending" or "sold". Price is the price the
+	// listing shows: the sold price of sold homes, otherwise the list price.
+	ListingStatus string  `bson:"listingStatus" json:"listingStatus" llm:"nullable,enum=active|pending|sold"`
+	ListPrice     float64 `bson:"listPrice" json:"listPrice" llm:"nullable,min=0"`
+	SoldPrice     float64 `bson:"soldPrice" json:"soldPrice" llm:"nullable,min=0"`
+	// ListDate, SoldDate and CloseDate are YYYY-MM-DD.
+	ListDate  string `bson:"listDate" json:"listDate" llm:"nullable"`
+	SoldDate  string `bson:"soldDate" json:"soldDate" llm:"nullable"`
+	CloseDate string `bson:"closeDate" json:"closeDate" llm:"nullable"`
+	// HOADues are per month and AnnualTaxes per year, in dollars.
+	HOADues      float64 `bson:"hoaDues" json:"hoaDues" llm:"nullable,min=0"`
+	AnnualTaxes  float64 `bson:"annualTaxes" json:"annualTaxes" llm:"nullable,min=0"`
+	GarageSpaces int     `bson:"garageSpaces" json:"garageSpaces" llm:"nullable,min=0,max=20"`
+	Stories      float64 `bson:"stories" json:"stories" llm:"nullable,min=0,max=10"`
+	// Basement and Pool are nil when the listing does not say.
+	Basement       *bool  `bson:"basement" json:"basement" llm:"nullable"`
+	Pool           *bool  `bson:"pool" json:"pool" llm:"nullable"`
+	LotSizeSqFt    int    `bson:"lotSizeSqFt" json:"lotSizeSqFt" llm:"nullable,min=0"`
+	Subdivision    string `bson:"subdivision" json:"subdivision" llm:"nullable"`
+	SchoolDistrict string `bson:"schoolDistrict" json:"schoolDistrict" llm:"nullable"`
+	// Condition is attached from raw_page_data.condition for the analysis; it
+	// is never extracted or stored with the details.
+	Condition *ConditionAssessment `bson:"-" json:"condition,omitempty" llm:"-"`
 }
 
 // RawPageData is the raw request from the extension.
 type RawPageData struct {
-	ID              primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	URL             string             `bson:"url" json:"url"`
-	Content         string             `bson:"content" json:"content"`
-	PropertyDetails *PropertyDetails   `bson:"propertyDetails,omitempty" json:"propertyDetails,omitempty"`
+	ID      primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	URL     string             `bson:"url" json:"url"`
+	Content string             `bson:"content" json:"content"`
+	// HTML is the page markup, optional; its structured data is read first and
+	// the text converted from it replaces Content.
+	HTML string `bson:"html,omitempty" json:"html,omitempty"`
+	// HTMLGzip is the page markup gzip-compressed and base64-encoded, sent instead of HTML.
+	HTMLGzip string `bson:"-" json:"htmlGzip,omitempty"`
+	// Extractor names the site extractor that read the page, or "generic".
+	Extractor       string                     `bson:"extractor,omitempty" json:"extractor,omitempty"`
+	PropertyDetails *PropertyDetails           `bson:"propertyDetails,omitempty" json:"propertyDetails,omitempty"`
+	Provenance      map[string]FieldProvenance `bson:"provenance,omitempty" json:"provenance,omitempty"`
+	InjectionRisk   *InjectionRisk             `bson:"injectionRisk,omitempty" json:"injectionRisk,omitempty"`
+	Photos          []Photo                    `bson:"photos,omitempty" json:"photos,omitempty"`
+	// Condition is the vision model's assessment of the photos, when one was made.
+	Condition *ConditionAssessment `bson:"condition,omitempty" json:"condition,omitempty"`
+}
+
+// Photo is one photo of the listed home found on a captured page.
+type Photo struct {
+	URL string `bson:"url" json:"url"`
+	// Source is where the URL came from: "json-ld", "microdata", "html" for
+	// the page's og:image, or "llm" for page images the model picked.
+	Source  string `bson:"source" json:"source"`
+	Caption string `bson:"caption,omitempty" json:"caption,omitempty"`
+	// Blob and Thumbnail name the stored binaries when PHOTO_STORAGE is set;
+	// Width and Height are those of the downloaded image.
+	Blob        string `bson:"blob,omitempty" json:"blob,omitempty"`
+	Thumbnail   string `bson:"thumbnail,omitempty" json:"thumbnail,omitempty"`
+	ContentType string `bson:"contentType,omitempty" json:"contentType,omitempty"`
+	Width       int    `bson:"width,omitempty" json:"width,omitempty"`
+	Height      int    `bson:"height,omitempty" json:"height,omitempty"`
+}
+
+// FieldProvenance records how one PropertyDetails field was extracted, keyed
+// by the field's JSON name. A nil Value means the listing did not state it,
+// whatever zero value PropertyDetails holds.
+type FieldProvenance struct {
+	Value      interface{} `bson:"value" json:"value"`
+	Confidence float64     `bson:"confidence" json:"confidence"`
+	Evidence   string      `bson:"evidence,omitempty" json:"evidence,omitempty"`
+	// Span is the [start, end) byte range of Evidence in RawPageData.Content,
+	// empty when the evidence could not be found there.
+	Span []int `bson:"span,omitempty" json:"span,omitempty"`
+	// Alternatives are different values found elsewhere on a long page or
+	// returned by other consensus runs.
+	Alternatives []interface{} `bson:"alternatives,omitempty" json:"alternatives,omitempty"`
+	// Agreement is the share of consensus runs that returned Value, zero when
+	// consensus extraction was not used.
+	Agreement float64 `bson:"agreement,omitempty" json:"agreement,omitempty"`
+	// Source is where Value came from: "json-ld" or "microdata" embedded in
+	// the page HTML, the name of the site extractor, or "llm". Empty for extractions stored before sources were recorded.
+	Source string `bson:"source,omitempty" json:"source,omitempty"`
 }
 
 // Address represents an address extracted and stored for BMA analysis.
@@ -37,6 +112,10 @@ type Address struct {
 	AddressStr string             `bson:"addressStr" json:"addressStr"`
 	Enabled    bool               `bson:"enabled" json:"enabled"`
 	Primary    bool               `bson:"primary" json:"primary"`
+	// NeedsReview is set when consensus extraction disagreed on ReviewFields;
+	// the address is left out of reports until it is marked reviewed.
+	NeedsReview  bool     `bson:"needsReview,omitempty" json:"needsReview,omitempty"`
+	ReviewFields []string `bson:"reviewFields,omitempty" json:"reviewFields,omitempty"`
 }
 
 // BMAReport holds the result of the broker market analysis
@@ -46,21 +125,31 @@ type BMAReport struct {
 	ComparisonAddrs  []*Address        `json:"comparisonAddresses"`
 	Opinion          string            `json:"opinion"`
 	DetailedAnalysis *DetailedAnalysis `json:"detailedAnalysis,omitempty"`
+	Warnings         []string          `json:"warnings,omitempty"`
+	// Profile names the instruction profile the analysis was generated with.
+	Profile string `json:"profile,omitempty"`
+	// ToolCalls are the calculations the model requested while writing the analysis.
+	ToolCalls []ToolCall `json:"toolCalls,omitempty"`
+	// Locale is the language and formats the report is written in, e.g. "es-US".
+	Locale string `json:"locale,omitempty"`
+	// Discrepancies are claims in the analysis that contradict the property details.
+	Discrepancies []Discrepancy `json:"discrepancies,omitempty"`
 }
 
-// DetailedAnalysis provides a comprehensive breakdown of the BMA comparison
+// DetailedAnalysis provides a comprehensive breakdown of the BMA comparison.
+// The property details are filled in from the database, not by the model.
 type DetailedAnalysis struct {
-	PrimaryPropertyDetails PropertyDetails     `json:"primaryPropertyDetails" bson:"primaryPropertyDetails"`
-	ComparisonDetails      []PropertyDetails   `json:"comparisonDetails" bson:"comparisonDetails"`
-	PriceAnalysis          string              `json:"priceAnalysis" bson:"priceAnalysis"`
-	FeatureComparison      []FeatureComparison `json:"featureComparison" bson:"featureComparison"`
-	MarketTrends           string              `json:"marketTrends" bson:"marketTrends"`
-	Recommendation         string              `json:"recommendation" bson:"recommendation"`
+	PrimaryPropertyDetails PropertyDetails     `json:"primaryPropertyDetails" bson:"primaryPropertyDetails" llm:"-"`
+	ComparisonDetails      []PropertyDetails   `json:"comparisonDetails" bson:"comparisonDetails" llm:"-"`
+	PriceAnalysis          string              `json:"priceAnalysis" bson:"priceAnalysis" llm:"nonempty"`
+	FeatureComparison      []FeatureComparison `json:"featureComparison" bson:"featureComparison" llm:"nonempty"`
+	MarketTrends           string              `json:"marketTrends" bson:"marketTrends" llm:"nonempty"`
+	Recommendation         string              `json:"recommendation" bson:"recommendation" llm:"nonempty"`
 }
 
 // FeatureComparison compares specific features between properties
 type FeatureComparison struct {
-	Feature      string            `json:"feature"`
+	Feature      string            `json:"feature" llm:"nonempty"`
 	PrimaryValue string            `json:"primaryValue"`
 	Comparison   []ComparisonValue `json:"comparison"`
 	Analysis     string            `json:"analysis"`
@@ -77,12 +166,54 @@ type CachedBMAReport struct {
 	ID                   primitive.ObjectID   `bson:"_id,omitempty" json:"id,omitempty"`
 	PrimaryAddressID     primitive.ObjectID   `bson:"primaryAddressId" json:"primaryAddressId"`
 	ComparisonAddressIDs []primitive.ObjectID `bson:"comparisonAddressIds" json:"comparisonAddressIds"`
+	ProfileID            primitive.ObjectID   `bson:"profileId" json:"profileId"`
+	Locale               string               `bson:"locale" json:"locale"`
 	GeneratedAt          time.Time            `bson:"generatedAt" json:"generatedAt"`
 	Report               BMAReport            `bson:"report" json:"report"`
 }
 
+// LLMInstructions is a named instruction profile, free text added to the
+// analysis prompt, e.g. "Investor" or "Buyer offer". Reports use the default
+// profile unless another one is requested.
 type LLMInstructions struct {
-	ID           primitive.ObjectID `bson:"_id,omitempty"`
-	Instructions string             `bson:"instructions"`
-	UpdatedAt    time.Time          `bson:"updated_at"`
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name         string             `bson:"name" json:"name"`
+	Instructions string             `bson:"instructions" json:"instructions"`
+	Default      bool               `bson:"default" json:"default"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updatedAt"`
+}
+
+// PromptTemplate is one version of a text/template prompt. The active version of
+// each prompt is used for generation; without one the built-in default applies.
+type PromptTemplate struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name      string             `bson:"name" json:"name"`
+	Version   int                `bson:"version" json:"version"`
+	Template  string             `bson:"template" json:"template"`
+	Notes     string             `bson:"notes,omitempty" json:"notes,omitempty"`
+	Active    bool               `bson:"active" json:"active"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// ConditionAssessment is a vision model's judgement of a property's condition
+// and updates, made from its listing photos. Scores run from 1, needs major
+// work, to 10, new or fully renovated.
+type ConditionAssessment struct {
+	Kitchen      AreaCondition `bson:"kitchen" json:"kitchen"`
+	Bathrooms    AreaCondition `bson:"bathrooms" json:"bathrooms"`
+	Exterior     AreaCondition `bson:"exterior" json:"exterior"`
+	OverallScore int           `bson:"overallScore" json:"overallScore" llm:"min=1,max=10"`
+	Rationale    string        `bson:"rationale" json:"rationale" llm:"nonempty"`
+	// Renovations lists the updates the photos show, e.g. "quartz countertops".
+	Renovations []string `bson:"renovations" json:"renovations"`
+	// Photos is the number of photos assessed.
+	Photos     int       `bson:"photos" json:"photos" llm:"-"`
+	Model      string    `bson:"model" json:"model" llm:"-"`
+	AssessedAt time.Time `bson:"assessedAt" json:"assessedAt" llm:"-"`
+}
+
+// AreaCondition rates one part of the property; Score is nil when no photo shows it.
+type AreaCondition struct {
+	Score *int   `bson:"score" json:"score" llm:"nullable,min=1,max=10"`
+	Notes string `bson:"notes" json:"notes"`
 }
@@ -0,0 +1,262 @@
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// defaultMaxHTMLBytes caps the decompressed size of gzip-compressed HTML.
+const defaultMaxHTMLBytes = 16 << 20
+
+func maxHTMLBytes() int {
+	return envInt("HTML_MAX_BYTES", defaultMaxHTMLBytes)
+}
+
+// normalizePageData decodes gzip-compressed HTML and, when the page markup was
+// sent, replaces the captured text with the text converted from it, which
+// keeps fact tables as "key: value" lines.
+func normalizePageData(data *RawPageData) error {
+	if data.HTMLGzip != "" {
+		page, err := gunzipHTML(data.HTMLGzip)
+		if err != nil {
+			return fmt.Errorf("invalid htmlGzip: %w", err)
+		}
+		data.HTML, data.HTMLGzip = page, ""
+	}
+	if data.HTML != "" {
+		if text := htmlToText(data.HTML); text != "" {
+			data.Content = text
+		}
+	}
+	if strings.TrimSpace(data.Content) == "" {
+		return fmt.Errorf("content or html is required")
+	}
+	return nil
+}
+
+// gunzipHTML decodes base64-encoded gzip data of at most maxHTMLBytes.
+func gunzipHTML(encoded string) (string, error) {
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	limit := maxHTMLBytes()
+	page, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(page) > limit {
+		return "", fmt.Errorf("HTML is larger than %d bytes", limit)
+	}
+	return string(page), nil
+}
+
+// skippedElements never hold listing text.
+var skippedElements = map[string]bool{
+	"head": true, "script": true, "style": true, "noscript": true, "template": true,
+	"svg": true, "canvas": true, "iframe": true, "object": true, "select": true,
+	"nav": true, "footer": true,
+}
+
+// blockElements start and end a line of text.
+var blockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "body": true,
+	"button": true, "caption": true, "dd": true, "details": true, "div": true,
+	"dt": true, "fieldset": true, "figcaption": true, "figure": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "label": true, "legend": true, "li": true, "main": true,
+	"ol": true, "p": true, "pre": true, "section": true, "summary": true, "ul": true,
+}
+
+// htmlToText converts page markup to text with one line per block, like the
+// innerText the extension captures, except that hidden elements, navigation
+// and footers are dropped and the rows of tables and definition lists become
+// "key: value" lines.
+func htmlToText(page string) string {
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		return ""
+	}
+	w := &textWriter{}
+	w.node(doc)
+	w.flush()
+	return strings.Join(w.lines, "\n")
+}
+
+// textWriter collects the lines of converted text.
+type textWriter struct {
+	lines []string
+	line  strings.Builder
+}
+
+func (w *textWriter) write(s string) {
+	w.line.WriteString(s)
+}
+
+func (w *textWriter) flush() {
+	if line := strings.Join(strings.Fields(w.line.String()), " "); line != "" {
+		w.lines = append(w.lines, line)
+	}
+	w.line.Reset()
+}
+
+func (w *textWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.write(n.Data)
+		return
+	case html.ElementNode:
+		if skippedElements[n.Data] || hiddenElement(n) {
+			return
+		}
+		switch n.Data {
+		case "br":
+			w.flush()
+			return
+		case "table":
+			w.flush()
+			w.table(n)
+			return
+		case "dl":
+			w.flush()
+			w.definitions(n)
+			return
+		}
+	}
+
+	block := n.Type == html.ElementNode && blockElements[n.Data]
+	if block {
+		w.flush()
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+	if block {
+		w.flush()
+	}
+}
+
+// table writes two-cell rows as "key: value", rows under a header row as
+// "heading: value" pairs and other rows with their cells separated by " | ".
+func (w *textWriter) table(n *html.Node) {
+	if caption := elements(n, "caption", "table"); len(caption) > 0 {
+		if text := inlineText(caption[0]); text != "" {
+			w.lines = append(w.lines, text)
+		}
+	}
+	var header []string
+	for _, row := range elements(n, "tr", "table") {
+		var cells []string
+		headings := 0
+		for c := row.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || (c.Data != "th" && c.Data != "td") || hiddenElement(c) {
+				continue
+			}
+			if c.Data == "th" {
+				headings++
+			}
+			cells = append(cells, inlineText(c))
+		}
+		switch {
+		case len(cells) == 0:
+		case header == nil && len(cells) > 1 && headings == len(cells):
+			header = cells
+		case header != nil && len(cells) == len(header):
+			pairs := make([]string, len(cells))
+			for i, cell := range cells {
+				pairs[i] = keyValue(header[i], cell)
+			}
+			w.lines = append(w.lines, strings.Join(pairs, "; "))
+		case len(cells) == 2:
+			w.lines = append(w.lines, keyValue(cells[0], cells[1]))
+		default:
+			w.lines = append(w.lines, strings.Join(cells, " | "))
+		}
+	}
+}
+
+// definitions writes each term of a definition list with its descriptions.
+func (w *textWriter) definitions(n *html.Node) {
+	term := ""
+	var descriptions []string
+	emit := func() {
+		if term != "" || len(descriptions) > 0 {
+			if line := keyValue(term, strings.Join(descriptions, ", ")); line != "" {
+				w.lines = append(w.lines, line)
+			}
+		}
+		term, descriptions = "", nil
+	}
+	for _, item := range elements(n, "", "dl") {
+		switch item.Data {
+		case "dt":
+			emit()
+			term = inlineText(item)
+		case "dd":
+			if text := inlineText(item); text != "" {
+				descriptions = append(descriptions, text)
+			}
+		}
+	}
+	emit()
+}
+
+// elements returns the descendants of n named tag, or all dt and dd when tag
+// is empty, without descending into nested elements named stop.
+func elements(n *html.Node, tag, stop string) []*html.Node {
+	var out []*html.Node
+	var walk func(*html.Node)
+	walk = func(p *html.Node) {
+		for c := p.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || skippedElements[c.Data] || hiddenElement(c) || c.Data == stop {
+				continue
+			}
+			if c.Data == tag || (tag == "" && (c.Data == "dt" || c.Data == "dd")) {
+				out = append(out, c)
+				continue
+			}
+			walk(c)
+		}
+	}
+	walk(n)
+	return out
+}
+
+// inlineText is the text of n on one line.
+func inlineText(n *html.Node) string {
+	w := &textWriter{}
+	w.node(n)
+	w.flush()
+	return strings.Join(w.lines, " ")
+}
+
+func keyValue(key, value string) string {
+	key = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(key), ":"))
+	switch {
+	case key == "":
+		return value
+	case value == "":
+		return key
+	}
+	return key + ": " + value
+}
+
+// hiddenElement tells whether n is hidden from the reader.
+func hiddenElement(n *html.Node) bool {
+	if hasAttr(n, "hidden") || attr(n, "aria-hidden") == "true" {
+		return true
+	}
+	style := strings.ReplaceAll(strings.ToLower(attr(n, "style")), " ", "")
+	return strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden")
+}
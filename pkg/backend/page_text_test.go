@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name, page, want string
+	}{
+		{
+			name: "blocks and line breaks",
+			page: `<body><h1>123 Maple St</h1><p>Columbus,   OH<br>43004</p><span>$349,900</span> <b>Active</b></body>`,
+			want: "123 Maple St\nColumbus, OH\n43004\n$349,900 Active",
+		},
+		{
+			name: "fact table rows become key/value lines",
+			page: `<table><caption>Facts and features</caption>
+				<tr><th>Bedrooms</th><td>3</td></tr>
+				<tr><td>Year built:</td><td>1995</td></tr>
+				<tr><td>Basement</td><td></td></tr>
+				<tr><td>Parking</td><td>Garage</td><td>2 spaces</td></tr>
+			</table>`,
+			want: "Facts and features\nBedrooms: 3\nYear built: 1995\nBasement\nParking | Garage | 2 spaces",
+		},
+		{
+			name: "rows under a header row",
+			page: `<table><thead><tr><th>Date</th><th>Event</th><th>Price</th></tr></thead>
+				<tbody><tr><td>05/01/2024</td><td>Listed</td><td>$349,900</td></tr></tbody></table>`,
+			want: "Date: 05/01/2024; Event: Listed; Price: $349,900",
+		},
+		{
+			name: "definition lists",
+			page: `<dl><dt>HOA dues</dt><dd>$120/mo</dd><dt>Appliances</dt><dd>Dishwasher</dd><dd>Range</dd></dl>`,
+			want: "HOA dues: $120/mo\nAppliances: Dishwasher, Range",
+		},
+		{
+			name: "hidden elements, scripts and page chrome are dropped",
+			page: `<head><title>Listing</title></head><body><nav>Buy Sell Rent</nav>
+				<script>var x = 1;</script><div hidden>Old price</div><div style="display: none">Agent only</div>
+				<div aria-hidden="true">Icon</div><main>3 beds</main><footer>© 2024 Portal Inc.</footer></body>`,
+			want: "3 beds",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := htmlToText(tt.page); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func gzipBase64(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestNormalizePageData(t *testing.T) {
+	page := `<html><body><h1>123 Maple St</h1><table><tr><td>Bedrooms</td><td>3</td></tr></table></body></html>`
+	valid := gzipBase64(t, page)
+	compressed, _ := base64.StdEncoding.DecodeString(valid)
+
+	tests := []struct {
+		name        string
+		data        RawPageData
+		wantContent string
+		wantErr     string
+	}{
+		{
+			name:        "gzip-compressed HTML",
+			data:        RawPageData{Content: "captured text", HTMLGzip: valid},
+			wantContent: "123 Maple St\nBedrooms: 3",
+		},
+		{
+			name:        "plain HTML",
+			data:        RawPageData{HTML: page},
+			wantContent: "123 Maple St\nBedrooms: 3",
+		},
+		{
+			name:        "captured text only",
+			data:        RawPageData{Content: "123 Maple St"},
+			wantContent: "123 Maple St",
+		},
+		{
+			name:    "not base64",
+			data:    RawPageData{HTMLGzip: "not base64!"},
+			wantErr: "invalid htmlGzip",
+		},
+		{
+			name:    "not gzip",
+			data:    RawPageData{HTMLGzip: base64.StdEncoding.EncodeToString([]byte(page))},
+			wantErr: "invalid htmlGzip",
+		},
+		{
+			name:    "truncated gzip",
+			data:    RawPageData{HTMLGzip: base64.StdEncoding.EncodeToString(compressed[:len(compressed)/2])},
+			wantErr: "invalid htmlGzip",
+		},
+		{
+			name:    "no content",
+			data:    RawPageData{HTML: "<script>var x = 1;</script>"},
+			wantErr: "content or html is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.data
+			err := normalizePageData(&data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.Content != tt.wantContent || data.HTMLGzip != "" {
+				t.Errorf("content %q, htmlGzip %q, want content %q", data.Content, data.HTMLGzip, tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestGunzipHTMLLimitsTheSize(t *testing.T) {
+	t.Setenv("HTML_MAX_BYTES", "1024")
+	if _, err := gunzipHTML(gzipBase64(t, strings.Repeat("a", 1024))); err != nil {
+		t.Errorf("HTML of the maximum size: %v", err)
+	}
+	if _, err := gunzipHTML(gzipBase64(t, strings.Repeat("a", 1025))); err == nil {
+		t.Error("HTML over the maximum size was accepted")
+	}
+}
+
+func TestReceivePageDataRejectsBadGzip(t *testing.T) {
+	app := fiber.New()
+	app.Post("/api/extension/page-data", handleReceivePageData)
+
+	for _, payload := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("<html></html>")), "H4sIAAAA"} {
+		body, _ := json.Marshal(map[string]string{"url": "https://www.zillow.com/homedetails/1", "htmlGzip": payload})
+		req := httptest.NewRequest("POST", "/api/extension/page-data", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("htmlGzip %q: %v", payload, err)
+		}
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("htmlGzip %q: status %d, want %d", payload, resp.StatusCode, fiber.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.10", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPhotoURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://photos.zillowstatic.com/fp/1.jpg", true},
+		{"http://93.184.216.34/1.jpg", true},
+		{"http://127.0.0.1:8080/1.jpg", false},
+		{"http://10.0.0.5/1.jpg", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://100.64.1.1/1.jpg", false},
+		{"http://[64:ff9b::a9fe:a9fe]/1.jpg", false},
+		{"http://[::ffff:127.0.0.1]/1.jpg", false},
+		{"file:///etc/passwd", false},
+		{"ftp://example.com/1.jpg", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkPhotoURL(u); (err == nil) != tt.ok {
+			t.Errorf("checkPhotoURL(%s) = %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestPhotoClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the photo client reached a loopback server")
+	}))
+	defer srv.Close()
+
+	// A hostname passes checkPhotoURL, so the dialer must refuse it after resolution
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	if resp, err := photoClient.Get("http://localhost:" + port + "/1.jpg"); err == nil {
+		resp.Body.Close()
+		t.Fatal("want an error")
+	}
+}
+
+func TestDecodePhoto(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 2))); err != nil {
+		t.Fatal(err)
+	}
+	img, err := decodePhoto(buf.Bytes())
+	if err != nil || img.Bounds().Dx() != 4 {
+		t.Fatalf("decodePhoto = %v, %v, want the 4x2 image", img, err)
+	}
+
+	// The same PNG declaring 50000x50000 pixels in its header
+	bomb := bytes.Clone(buf.Bytes())
+	binary.BigEndian.PutUint32(bomb[16:], 50000)
+	binary.BigEndian.PutUint32(bomb[20:], 50000)
+	binary.BigEndian.PutUint32(bomb[29:], crc32.ChecksumIEEE(bomb[12:29]))
+	if _, err := decodePhoto(bomb); !errors.Is(err, errPhotoTooLarge) {
+		t.Errorf("decodePhoto of a 50000x50000 header = %v, want errPhotoTooLarge", err)
+	}
+
+	if _, err := decodePhoto([]byte("not an image")); err == nil {
+		t.Error("decodePhoto of text succeeded")
+	}
+}
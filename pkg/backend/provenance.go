@@ -0,0 +1,238 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// lowConfidence is the confidence below which an extracted value should be
+// verified before it is presented.
+const lowConfidence = 0.6
+
+// extractedField is one field of the extraction answer.
+type extractedField struct {
+	Value      json.RawMessage `json:"value"`
+	Confidence float64         `json:"confidence"`
+	Evidence   *string         `json:"evidence"`
+}
+
+// extractionSchema wraps the given PropertyDetails fields, or all of them when
+// none are given, in a {value, confidence, evidence} object.
+func extractionSchema(fields ...string) *Schema {
+	details := SchemaFor(PropertyDetails{})
+	zero, one := 0.0, 1.0
+
+	wanted := func(name string) bool { return len(fields) == 0 || slices.Contains(fields, name) }
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for _, name := range details.Required {
+		if wanted(name) {
+			s.Required = append(s.Required, name)
+		}
+	}
+	for name, prop := range details.Properties {
+		if !wanted(name) {
+			continue
+		}
+		s.Properties[name] = &Schema{
+			Type: "object",
+			Properties: map[string]*Schema{
+				"value":      prop,
+				"confidence": {Type: "number", Minimum: &zero, Maximum: &one},
+				"evidence":   {Type: "string", Nullable: true},
+			},
+			Required: []string{"value", "confidence", "evidence"},
+		}
+	}
+	return s
+}
+
+// chunkExtractionSchema is extractionSchema for part of a page, which may not
+// contain the address.
+func chunkExtractionSchema(fields ...string) *Schema {
+	s := extractionSchema(fields...)
+	if s.Properties["address"] == nil {
+		return s
+	}
+	address := *s.Properties["address"].Properties["value"]
+	address.Nullable = true
+	address.NonEmpty = false
+	s.Properties["address"].Properties["value"] = &address
+	return s
+}
+
+// provenanceFromFields turns the validated extraction answer into provenance,
+// locating the evidence in the listing content.
+func provenanceFromFields(fields map[string]extractedField, content string) (map[string]FieldProvenance, error) {
+	provenance := map[string]FieldProvenance{}
+	for name, field := range fields {
+		prov := FieldProvenance{Confidence: field.Confidence, Source: SourceLLM}
+		if len(field.Value) > 0 && string(field.Value) != "null" {
+			if err := json.Unmarshal(field.Value, &prov.Value); err != nil {
+				return nil, fmt.Errorf("failed to parse %s value: %v", name, err)
+			}
+			// An empty string is as good as no value
+			if str, ok := prov.Value.(string); ok && strings.TrimSpace(str) == "" {
+				prov.Value = nil
+			}
+		}
+		if field.Evidence != nil && prov.Value != nil {
+			prov.Evidence = *field.Evidence
+			prov.Span = locateEvidence(content, prov.Evidence)
+		}
+		provenance[name] = prov
+	}
+	return provenance, nil
+}
+
+// detailsFromProvenance builds property details from the provenance values.
+func detailsFromProvenance(provenance map[string]FieldProvenance) (*PropertyDetails, error) {
+	values := map[string]interface{}{}
+	for name, prov := range provenance {
+		if prov.Value != nil {
+			values[name] = prov.Value
+		}
+	}
+
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode property details: %v", err)
+	}
+	var details PropertyDetails
+	if err := json.Unmarshal(raw, &details); err != nil {
+		return nil, fmt.Errorf("failed to parse property details: %v", err)
+	}
+	return &details, nil
+}
+
+// mergeProvenance combines the fields extracted from the chunks of one page.
+// The address with the best confidence, earliest chunk first, anchors the
+// listing; for other fields values from that chunk are preferred, so numbers
+// from a neighboring listing further down the page lose to the listing's own.
+// Located evidence and confidence decide between the rest. Values that
+// disagree with the chosen one are kept as alternatives.
+func mergeProvenance(chunks []map[string]FieldProvenance) map[string]FieldProvenance {
+	best := func(name string, score func(chunk int, prov FieldProvenance) float64) (int, bool) {
+		chosen, bestScore := -1, 0.0
+		for i, chunk := range chunks {
+			prov, ok := chunk[name]
+			if !ok || prov.Value == nil {
+				continue
+			}
+			if s := score(i, prov); chosen == -1 || s > bestScore {
+				chosen, bestScore = i, s
+			}
+		}
+		return chosen, chosen != -1
+	}
+
+	evidenceScore := func(prov FieldProvenance) float64 {
+		if len(prov.Span) > 0 {
+			return 0.1
+		}
+		return 0
+	}
+
+	anchor, _ := best("address", func(_ int, prov FieldProvenance) float64 {
+		return prov.Confidence + evidenceScore(prov)
+	})
+
+	names := map[string]bool{}
+	for _, chunk := range chunks {
+		for name := range chunk {
+			names[name] = true
+		}
+	}
+
+	merged := map[string]FieldProvenance{}
+	for name := range names {
+		chosen, ok := best(name, func(i int, prov FieldProvenance) float64 {
+			s := prov.Confidence + evidenceScore(prov)
+			if i == anchor {
+				s += 0.2
+			}
+			return s
+		})
+		if !ok {
+			merged[name] = FieldProvenance{}
+			continue
+		}
+
+		prov := chunks[chosen][name]
+		prov.Alternatives = nil
+		for i, chunk := range chunks {
+			other, ok := chunk[name]
+			if i == chosen || !ok || other.Value == nil || sameValue(other.Value, prov.Value) {
+				continue
+			}
+			known := false
+			for _, alt := range prov.Alternatives {
+				known = known || sameValue(alt, other.Value)
+			}
+			if !known {
+				prov.Alternatives = append(prov.Alternatives, other.Value)
+			}
+		}
+		merged[name] = prov
+	}
+	return merged
+}
+
+// sameValue compares extracted values, ignoring case and spacing of strings.
+func sameValue(a, b interface{}) bool {
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		return strings.EqualFold(strings.Join(strings.Fields(as), " "), strings.Join(strings.Fields(bs), " "))
+	}
+	return a == b
+}
+
+// locateEvidence returns the byte range of evidence in content. Models often
+// change whitespace or case when quoting, so an exact match falls back to a
+// case-insensitive match that treats any run of whitespace as equal.
+func locateEvidence(content, evidence string) []int {
+	evidence = strings.TrimSpace(evidence)
+	if evidence == "" {
+		return nil
+	}
+	if i := strings.Index(content, evidence); i >= 0 {
+		return []int{i, i + len(evidence)}
+	}
+
+	words := strings.Fields(evidence)
+	for i, word := range words {
+		words[i] = regexp.QuoteMeta(word)
+	}
+	re, err := regexp.Compile(`(?i)` + strings.Join(words, `\s+`))
+	if err != nil {
+		return nil
+	}
+	return re.FindStringIndex(content)
+}
+
+// FieldsToVerify lists the fields that have a value but a low confidence,
+// evidence that could not be found in the listing, or conflicting values.
+// Disagreements between consensus runs are listed even without a value.
+func FieldsToVerify(provenance map[string]FieldProvenance) []string {
+	var fields []string
+	for name, prov := range provenance {
+		if prov.Agreement > 0 && prov.Agreement < 1 {
+			fields = append(fields, name)
+			continue
+		}
+		if prov.Value == nil {
+			continue
+		}
+		// Structured data is exact but has no evidence in the page text
+		located := len(prov.Span) > 0 || prov.Source == SourceJSONLD || prov.Source == SourceMicrodata
+		if prov.Confidence < lowConfidence || !located || len(prov.Alternatives) > 0 {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
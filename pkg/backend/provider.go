@@ -0,0 +1,294 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LLMTask identifies what a model call is used for, so each task can be
+// pointed at its own model.
+type LLMTask string
+
+const (
+	TaskExtraction LLMTask = "extraction"
+	TaskAnalysis   LLMTask = "analysis"
+	// TaskVision assesses listing photos and needs a multimodal model.
+	TaskVision LLMTask = "vision"
+)
+
+// llmTasks lists every task that has its own model and generation settings.
+var llmTasks = []LLMTask{TaskExtraction, TaskAnalysis, TaskVision}
+
+// LLMRequest is a provider-agnostic generation request.
+type LLMRequest struct {
+	Model  string
+	Prompt string
+	// Schema, when set on a JSON request, is passed to the provider's
+	// structured-output support so the answer follows it.
+	Schema *Schema
+	// Config holds the task's generation settings; its zero value keeps the
+	// provider defaults.
+	Config GenerationConfig
+	// Images are sent along with the prompt, in order.
+	Images []LLMImage
+}
+
+// LLMImage is an image attached to a request.
+type LLMImage struct {
+	MIMEType string
+	Data     []byte
+}
+
+// GenerationConfig tunes sampling and output length. Unset fields keep the
+// provider defaults. Safety settings are only supported by Gemini.
+type GenerationConfig struct {
+	Temperature *float32        `bson:"temperature,omitempty" json:"temperature,omitempty"`
+	TopP        *float32        `bson:"topP,omitempty" json:"topP,omitempty"`
+	MaxTokens   int             `bson:"maxTokens,omitempty" json:"maxTokens,omitempty"`
+	Safety      []SafetySetting `bson:"safety,omitempty" json:"safety,omitempty"`
+}
+
+// SafetySetting sets the blocking threshold for one harm category, e.g.
+// {"category": "dangerous_content", "threshold": "block_only_high"}.
+type SafetySetting struct {
+	Category  string `bson:"category" json:"category"`
+	Threshold string `bson:"threshold" json:"threshold"`
+}
+
+// LLMResponse is the text a provider generated for a request, with the token
+// usage the provider reported for it.
+type LLMResponse struct {
+	Model            string
+	Text             string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// LLMProvider is implemented by every model backend the BMA calculator can talk to.
+type LLMProvider interface {
+	// Name returns the configuration name of the provider, e.g. "gemini".
+	Name() string
+	// GenerateText returns free-form text for the prompt.
+	GenerateText(ctx context.Context, req LLMRequest) (*LLMResponse, error)
+	// GenerateJSON asks the model to answer with a single JSON object.
+	GenerateJSON(ctx context.Context, req LLMRequest) (*LLMResponse, error)
+}
+
+// StreamingProvider is implemented by providers that can stream a JSON answer
+// while it is generated. onChunk receives each piece of text in order.
+type StreamingProvider interface {
+	StreamJSON(ctx context.Context, req LLMRequest, onChunk func(string)) (*LLMResponse, error)
+}
+
+const (
+	ProviderGemini    = "gemini"
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+	ProviderReplay    = "replay"
+	ProviderFake      = "fake"
+)
+
+// defaultModels holds the models used for each task when no override is configured.
+var defaultModels = map[string]map[LLMTask]string{
+	ProviderGemini: {
+		TaskExtraction: "gemini-1.5-flash",
+		TaskAnalysis:   "gemini-1.5-pro",
+		TaskVision:     "gemini-1.5-flash",
+	},
+	ProviderOpenAI: {
+		TaskExtraction: "gpt-4o-mini",
+		TaskAnalysis:   "gpt-4o",
+		TaskVision:     "gpt-4o",
+	},
+	ProviderAnthropic: {
+		TaskExtraction: "claude-3-5-haiku-latest",
+		TaskAnalysis:   "claude-3-5-sonnet-latest",
+		TaskVision:     "claude-3-5-sonnet-latest",
+	},
+	ProviderFake: {
+		TaskExtraction: "fake-extraction",
+		TaskAnalysis:   "fake-analysis",
+		TaskVision:     "fake-vision",
+	},
+}
+
+var (
+	// overrideProvider, when set, replaces the provider configured through the environment.
+	overrideProvider LLMProvider
+	// sharedProvider is the configured provider, created once by InitLLM.
+	sharedProvider LLMProvider
+	providerMu     sync.RWMutex
+)
+
+// InitLLM creates the provider selected by LLM_PROVIDER once, so every request
+// reuses the same client. ctx must stay valid until CloseLLM is called.
+func InitLLM(ctx context.Context) error {
+	p, err := NewLLMProvider(ctx, configuredProviderName())
+	if err != nil {
+		return err
+	}
+
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	sharedProvider = p
+	return nil
+}
+
+// CloseLLM releases the connections of the shared provider and of any provider
+// created for consensus extraction.
+func CloseLLM() error {
+	err := closeNamedProviders()
+
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	if sharedProvider == nil {
+		return err
+	}
+	if closer, ok := sharedProvider.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	sharedProvider = nil
+	return err
+}
+
+// SetLLMProvider makes every LLM call use p, e.g. a ScriptedProvider when running
+// the handlers in tests or CI. Passing nil restores the configured provider.
+func SetLLMProvider(p LLMProvider) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	overrideProvider = p
+}
+
+// currentLLMProvider returns the provider LLM calls should use, initializing the
+// shared provider on first use when InitLLM was not called.
+func currentLLMProvider() (LLMProvider, error) {
+	providerMu.RLock()
+	p := overrideProvider
+	if p == nil {
+		p = sharedProvider
+	}
+	providerMu.RUnlock()
+	if p != nil {
+		return p, nil
+	}
+
+	// Concurrent first calls wait here, so only one of them creates a client
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	if overrideProvider != nil {
+		return overrideProvider, nil
+	}
+	if sharedProvider == nil {
+		p, err := NewLLMProvider(context.Background(), configuredProviderName())
+		if err != nil {
+			return nil, err
+		}
+		sharedProvider = p
+	}
+	return sharedProvider, nil
+}
+
+// configuredProviderName returns the provider selected by LLM_PROVIDER, defaulting to Gemini.
+func configuredProviderName() string {
+	name := strings.ToLower(strings.TrimSpace(os.Getenv("LLM_PROVIDER")))
+	if name == "" {
+		return ProviderGemini
+	}
+	return name
+}
+
+// NewLLMProvider builds the named provider from its environment variables.
+func NewLLMProvider(ctx context.Context, name string) (LLMProvider, error) {
+	switch name {
+	case ProviderGemini:
+		return NewGeminiProvider(ctx, os.Getenv("GEMINI_API_KEY"))
+	case ProviderOpenAI:
+		return NewOpenAIProvider(os.Getenv("OPENAI_BASE_URL"), os.Getenv("OPENAI_API_KEY")), nil
+	case ProviderAnthropic:
+		return NewAnthropicProvider(os.Getenv("ANTHROPIC_BASE_URL"), os.Getenv("ANTHROPIC_API_KEY")), nil
+	case ProviderReplay:
+		return newReplayProviderFromEnv(ctx)
+	case ProviderFake:
+		script := os.Getenv("LLM_FAKE_SCRIPT")
+		if script == "" {
+			return nil, fmt.Errorf("LLM_FAKE_SCRIPT must point to a JSON script for the fake provider")
+		}
+		return LoadScriptedProvider(script)
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q", name)
+	}
+}
+
+// newReplayProviderFromEnv builds a cassette provider from LLM_CASSETTE_DIR,
+// LLM_CASSETTE_MODE and LLM_RECORD_PROVIDER.
+func newReplayProviderFromEnv(ctx context.Context) (LLMProvider, error) {
+	dir := os.Getenv("LLM_CASSETTE_DIR")
+	if dir == "" {
+		dir = "cassettes"
+	}
+	mode := strings.ToLower(os.Getenv("LLM_CASSETTE_MODE"))
+	if mode == "" {
+		mode = CassetteModeReplay
+	}
+
+	var next LLMProvider
+	if mode != CassetteModeReplay {
+		var err error
+		next, err = NewLLMProvider(ctx, recordProviderName())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewReplayProvider(dir, mode, next)
+}
+
+// recordProviderName returns the provider a cassette records from, which also
+// decides the model names used in replay mode.
+func recordProviderName() string {
+	name := strings.ToLower(strings.TrimSpace(os.Getenv("LLM_RECORD_PROVIDER")))
+	if name == "" || name == ProviderReplay {
+		return ProviderGemini
+	}
+	return name
+}
+
+// defaultTimeouts bounds a single model call for each task.
+var defaultTimeouts = map[LLMTask]time.Duration{
+	TaskExtraction: 60 * time.Second,
+	TaskAnalysis:   3 * time.Minute,
+	TaskVision:     2 * time.Minute,
+}
+
+// timeoutForTask returns the per-call deadline for the task. LLM_EXTRACTION_TIMEOUT,
+// LLM_ANALYSIS_TIMEOUT and LLM_VISION_TIMEOUT accept Go durations such as "90s".
+func timeoutForTask(task LLMTask) time.Duration {
+	env := "LLM_" + strings.ToUpper(string(task)) + "_TIMEOUT"
+	if d, err := time.ParseDuration(os.Getenv(env)); err == nil && d > 0 {
+		return d
+	}
+	if d, ok := defaultTimeouts[task]; ok {
+		return d
+	}
+	return time.Minute
+}
+
+// modelForTask returns the model configured for the task on the given provider.
+// LLM_EXTRACTION_MODEL, LLM_ANALYSIS_MODEL and LLM_VISION_MODEL override the
+// provider defaults.
+func modelForTask(provider string, task LLMTask) string {
+	env := "LLM_" + strings.ToUpper(string(task)) + "_MODEL"
+	if model := os.Getenv(env); model != "" {
+		return model
+	}
+	if provider == ProviderReplay {
+		provider = recordProviderName()
+	}
+	return defaultModels[provider][task]
+}
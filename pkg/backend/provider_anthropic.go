@@ -0,0 +1,281 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultAnthropicBaseURL = "https://api.anthropic.com"
+	anthropicVersion        = "2023-06-01"
+	anthropicMaxTokens      = 8192
+)
+
+// AnthropicProvider talks to the Anthropic Messages API, or any server that
+// implements the same wire format.
+type AnthropicProvider struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// NewAnthropicProvider returns a provider for the given base URL and API key.
+func NewAnthropicProvider(baseURL, apiKey string) *AnthropicProvider {
+	if baseURL == "" {
+		baseURL = defaultAnthropicBaseURL
+	}
+	return &AnthropicProvider{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: http.DefaultClient,
+	}
+}
+
+func (p *AnthropicProvider) Name() string { return ProviderAnthropic }
+
+// anthropicMessage content is text, or a list of content blocks when the
+// request has images.
+type anthropicMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	Messages    []anthropicMessage `json:"messages"`
+	Temperature *float32           `json:"temperature,omitempty"`
+	TopP        *float32           `json:"top_p,omitempty"`
+	Stream      bool               `json:"stream,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage anthropicUsage `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// anthropicStreamEvent covers the fields used from message_start,
+// content_block_delta, message_delta and error stream events.
+type anthropicStreamEvent struct {
+	Type    string             `json:"type"`
+	Message *anthropicResponse `json:"message,omitempty"`
+	Delta   struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage,omitempty"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func (p *AnthropicProvider) GenerateText(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return p.generate(ctx, req, false)
+}
+
+// GenerateJSON prefills the assistant turn with "{" so the model continues a JSON object.
+// The Messages API has no response schema, so a schema the prompt does not already
+// contain is appended to it instead.
+func (p *AnthropicProvider) GenerateJSON(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return p.generate(ctx, req, true)
+}
+
+// StreamJSON passes text deltas to onChunk as they arrive.
+func (p *AnthropicProvider) StreamJSON(ctx context.Context, req LLMRequest, onChunk func(string)) (*LLMResponse, error) {
+	body := p.messagesRequest(req, true)
+	body.Stream = true
+
+	httpResp, err := p.send(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	out := &LLMResponse{Model: req.Model}
+	var text strings.Builder
+	text.WriteString("{")
+	onChunk("{")
+	err = readSSEData(httpResp.Body, func(data string) error {
+		var event anthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("failed to decode stream event: %v", err)
+		}
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				if event.Message.Model != "" {
+					out.Model = event.Message.Model
+				}
+				out.PromptTokens = event.Message.Usage.InputTokens
+			}
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+				text.WriteString(event.Delta.Text)
+				onChunk(event.Delta.Text)
+			}
+		case "message_delta":
+			if event.Usage != nil {
+				out.CompletionTokens = event.Usage.OutputTokens
+			}
+		case "error":
+			if event.Error != nil {
+				// Overload can be reported mid-stream as well as with a 529 status
+				if event.Error.Type == "overloaded_error" {
+					return &ProviderError{API: "Anthropic API stream", StatusCode: 529, Message: event.Error.Message}
+				}
+				return fmt.Errorf("Anthropic API stream error: %s", event.Error.Message)
+			}
+			return fmt.Errorf("Anthropic API stream error")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if text.Len() <= 1 {
+		return nil, fmt.Errorf("no content generated")
+	}
+	out.Text = text.String()
+	return out, nil
+}
+
+func (p *AnthropicProvider) messagesRequest(req LLMRequest, jsonOutput bool) anthropicRequest {
+	prompt := req.Prompt
+	if jsonOutput && req.Schema != nil {
+		if schema := req.Schema.String(); !strings.Contains(prompt, schema) {
+			prompt += "\n\nThe JSON object must conform to this JSON Schema:\n" + schema
+		}
+	}
+	body := anthropicRequest{
+		Model:       req.Model,
+		MaxTokens:   anthropicMaxTokens,
+		Messages:    []anthropicMessage{{Role: "user", Content: anthropicContent(prompt, req.Images)}},
+		Temperature: req.Config.Temperature,
+		TopP:        req.Config.TopP,
+	}
+	if req.Config.MaxTokens > 0 {
+		body.MaxTokens = req.Config.MaxTokens
+	}
+	if jsonOutput {
+		body.Messages = append(body.Messages, anthropicMessage{Role: "assistant", Content: "{"})
+	}
+	return body
+}
+
+// anthropicContent puts the images before the prompt, as the Messages API
+// documentation recommends.
+func anthropicContent(prompt string, images []LLMImage) interface{} {
+	if len(images) == 0 {
+		return prompt
+	}
+	var blocks []map[string]interface{}
+	for _, img := range images {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "image",
+			"source": map[string]string{
+				"type":       "base64",
+				"media_type": img.MIMEType,
+				"data":       base64.StdEncoding.EncodeToString(img.Data),
+			},
+		})
+	}
+	return append(blocks, map[string]interface{}{"type": "text", "text": prompt})
+}
+
+func (p *AnthropicProvider) generate(ctx context.Context, req LLMRequest, jsonOutput bool) (*LLMResponse, error) {
+	httpResp, err := p.send(ctx, p.messagesRequest(req, jsonOutput))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var resp anthropicResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	var text strings.Builder
+	if jsonOutput {
+		text.WriteString("{")
+	}
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	if text.Len() == 0 || (jsonOutput && text.Len() == 1) {
+		return nil, fmt.Errorf("no content generated")
+	}
+
+	model := resp.Model
+	if model == "" {
+		model = req.Model
+	}
+	return &LLMResponse{
+		Model:            model,
+		Text:             text.String(),
+		PromptTokens:     resp.Usage.InputTokens,
+		CompletionTokens: resp.Usage.OutputTokens,
+	}, nil
+}
+
+// send posts a Messages request and returns the response once the server has
+// accepted it; the caller must close its body.
+func (p *AnthropicProvider) send(ctx context.Context, body anthropicRequest) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %v", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/messages", bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("anthropic-version", anthropicVersion)
+	if p.apiKey != "" {
+		httpReq.Header.Set("x-api-key", p.apiKey)
+	}
+
+	httpResp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call Anthropic API: %w", err)
+	}
+	if httpResp.StatusCode < 300 {
+		return httpResp, nil
+	}
+	defer httpResp.Body.Close()
+
+	raw, _ := io.ReadAll(httpResp.Body)
+	apiErr := &ProviderError{
+		API:        "Anthropic API",
+		StatusCode: httpResp.StatusCode,
+		Message:    strings.TrimSpace(string(raw)),
+		RetryAfter: parseRetryAfter(httpResp.Header.Get("Retry-After")),
+	}
+	var errResp anthropicResponse
+	if json.Unmarshal(raw, &errResp) == nil && errResp.Error != nil && errResp.Error.Message != "" {
+		apiErr.Message = errResp.Error.Message
+	}
+	return nil, apiErr
+}
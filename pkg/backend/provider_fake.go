@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ScriptedResponse is one canned answer for the ScriptedProvider. The first
+// response whose Match is contained in the prompt is returned; an empty Match
+// matches every prompt. Error makes the call fail instead; with Status it
+// fails like an API error with that HTTP status, e.g. 429 or 503.
+type ScriptedResponse struct {
+	Match    string `json:"match"`
+	Response string `json:"response"`
+	Error    string `json:"error,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	// Once removes the response after it has been used, so a script can
+	// return different answers to the same prompt on successive calls.
+	Once bool `json:"once,omitempty"`
+}
+
+// ScriptedCall records a request the ScriptedProvider received.
+type ScriptedCall struct {
+	Kind    string
+	Request LLMRequest
+}
+
+// ScriptedProvider is a fake provider that answers from a fixed script, for
+// running handlers without any model at all.
+type ScriptedProvider struct {
+	mu        sync.Mutex
+	responses []ScriptedResponse
+	calls     []ScriptedCall
+}
+
+// NewScriptedProvider returns a fake provider answering with the given responses.
+func NewScriptedProvider(responses ...ScriptedResponse) *ScriptedProvider {
+	return &ScriptedProvider{responses: responses}
+}
+
+// LoadScriptedProvider reads a JSON array of ScriptedResponse from path.
+func LoadScriptedProvider(path string) (*ScriptedProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fake LLM script: %v", err)
+	}
+	var responses []ScriptedResponse
+	if err := json.Unmarshal(data, &responses); err != nil {
+		return nil, fmt.Errorf("failed to parse fake LLM script: %v", err)
+	}
+	return NewScriptedProvider(responses...), nil
+}
+
+func (p *ScriptedProvider) Name() string { return ProviderFake }
+
+func (p *ScriptedProvider) GenerateText(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return p.generate(ctx, "text", req)
+}
+
+func (p *ScriptedProvider) GenerateJSON(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return p.generate(ctx, "json", req)
+}
+
+// Calls returns the requests received so far.
+func (p *ScriptedProvider) Calls() []ScriptedCall {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]ScriptedCall(nil), p.calls...)
+}
+
+func (p *ScriptedProvider) generate(ctx context.Context, kind string, req LLMRequest) (*LLMResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, ScriptedCall{Kind: kind, Request: req})
+
+	for i, r := range p.responses {
+		if r.Match != "" && !strings.Contains(req.Prompt, r.Match) {
+			continue
+		}
+		if r.Once {
+			p.responses = append(p.responses[:i:i], p.responses[i+1:]...)
+		}
+		if r.Status != 0 {
+			return nil, &ProviderError{API: "Fake LLM provider", StatusCode: r.Status, Message: r.Error}
+		}
+		if r.Error != "" {
+			return nil, fmt.Errorf("%s", r.Error)
+		}
+		return &LLMResponse{Model: req.Model, Text: r.Response}, nil
+	}
+	return nil, fmt.Errorf("fake LLM provider has no scripted response for prompt")
+}
@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GeminiProvider talks to Google's Gemini API through a single long-lived client.
+type GeminiProvider struct {
+	client *genai.Client
+}
+
+// NewGeminiProvider creates the Gemini client. ctx must outlive the provider,
+// as the client keeps using it for authentication.
+func NewGeminiProvider(ctx context.Context, apiKey string) (*GeminiProvider, error) {
+	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %v", err)
+	}
+	return &GeminiProvider{client: client}, nil
+}
+
+func (p *GeminiProvider) Name() string { return ProviderGemini }
+
+// Close releases the underlying client connection.
+func (p *GeminiProvider) Close() error {
+	return p.client.Close()
+}
+
+func (p *GeminiProvider) GenerateText(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return p.generate(ctx, req, false)
+}
+
+func (p *GeminiProvider) GenerateJSON(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return p.generate(ctx, req, true)
+}
+
+// StreamJSON passes each streamed text part to onChunk as it arrives.
+func (p *GeminiProvider) StreamJSON(ctx context.Context, req LLMRequest, onChunk func(string)) (*LLMResponse, error) {
+	iter := p.model(req, true).GenerateContentStream(ctx, geminiParts(req)...)
+
+	out := &LLMResponse{Model: req.Model}
+	var text strings.Builder
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate content: %w", err)
+		}
+		if resp.UsageMetadata != nil {
+			out.PromptTokens = int(resp.UsageMetadata.PromptTokenCount)
+			out.CompletionTokens = int(resp.UsageMetadata.CandidatesTokenCount)
+		}
+		if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+			continue
+		}
+		for _, part := range resp.Candidates[0].Content.Parts {
+			if t, ok := part.(genai.Text); ok && t != "" {
+				text.WriteString(string(t))
+				onChunk(string(t))
+			}
+		}
+	}
+
+	if text.Len() == 0 {
+		return nil, fmt.Errorf("no content generated")
+	}
+	out.Text = text.String()
+	return out, nil
+}
+
+// geminiHarmCategories and geminiHarmThresholds map the names accepted in
+// SafetySetting to Gemini's enums.
+var geminiHarmCategories = map[string]genai.HarmCategory{
+	"harassment":        genai.HarmCategoryHarassment,
+	"hate_speech":       genai.HarmCategoryHateSpeech,
+	"sexually_explicit": genai.HarmCategorySexuallyExplicit,
+	"dangerous_content": genai.HarmCategoryDangerousContent,
+}
+
+var geminiHarmThresholds = map[string]genai.HarmBlockThreshold{
+	"block_none":             genai.HarmBlockNone,
+	"block_only_high":        genai.HarmBlockOnlyHigh,
+	"block_medium_and_above": genai.HarmBlockMediumAndAbove,
+	"block_low_and_above":    genai.HarmBlockLowAndAbove,
+}
+
+func (p *GeminiProvider) model(req LLMRequest, jsonOutput bool) *genai.GenerativeModel {
+	model := p.client.GenerativeModel(req.Model)
+	if jsonOutput {
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = req.Schema.toGenai()
+	}
+	if req.Config.Temperature != nil {
+		model.SetTemperature(*req.Config.Temperature)
+	}
+	if req.Config.TopP != nil {
+		model.SetTopP(*req.Config.TopP)
+	}
+	if req.Config.MaxTokens > 0 {
+		model.SetMaxOutputTokens(int32(req.Config.MaxTokens))
+	}
+	for _, s := range req.Config.Safety {
+		model.SafetySettings = append(model.SafetySettings, &genai.SafetySetting{
+			Category:  geminiHarmCategories[s.Category],
+			Threshold: geminiHarmThresholds[s.Threshold],
+		})
+	}
+	return model
+}
+
+// geminiParts is the prompt followed by the request's images.
+func geminiParts(req LLMRequest) []genai.Part {
+	parts := []genai.Part{genai.Text(req.Prompt)}
+	for _, img := range req.Images {
+		parts = append(parts, genai.Blob{MIMEType: img.MIMEType, Data: img.Data})
+	}
+	return parts
+}
+
+func (p *GeminiProvider) generate(ctx context.Context, req LLMRequest, jsonOutput bool) (*LLMResponse, error) {
+	model := p.model(req, jsonOutput)
+
+	resp, err := model.GenerateContent(ctx, geminiParts(req)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate content: %w", err)
+	}
+
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil || len(resp.Candidates[0].Content.Parts) == 0 {
+		return nil, fmt.Errorf("no content generated")
+	}
+
+	var text strings.Builder
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if t, ok := part.(genai.Text); ok {
+			text.WriteString(string(t))
+		}
+	}
+
+	out := &LLMResponse{Model: req.Model, Text: text.String()}
+	if resp.UsageMetadata != nil {
+		out.PromptTokens = int(resp.UsageMetadata.PromptTokenCount)
+		out.CompletionTokens = int(resp.UsageMetadata.CandidatesTokenCount)
+	}
+	return out, nil
+}
@@ -0,0 +1,241 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const defaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// OpenAIProvider talks to any server implementing the OpenAI chat completions
+// API, including vLLM, LM Studio and Ollama running on localhost.
+type OpenAIProvider struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// NewOpenAIProvider returns a provider for the given base URL, e.g.
+// "http://localhost:11434/v1" for Ollama. The API key may be empty for local servers.
+func NewOpenAIProvider(baseURL, apiKey string) *OpenAIProvider {
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	return &OpenAIProvider{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: http.DefaultClient,
+	}
+}
+
+func (p *OpenAIProvider) Name() string { return ProviderOpenAI }
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// openAIRequestMessage is a message sent to the API. Its content is the prompt
+// text, or a list of text and image parts when the request has images.
+type openAIRequestMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+type openAIChatRequest struct {
+	Model          string                 `json:"model"`
+	Messages       []openAIRequestMessage `json:"messages"`
+	ResponseFormat map[string]interface{} `json:"response_format,omitempty"`
+	Temperature    *float32               `json:"temperature,omitempty"`
+	TopP           *float32               `json:"top_p,omitempty"`
+	MaxTokens      int                    `json:"max_tokens,omitempty"`
+	Stream         bool                   `json:"stream,omitempty"`
+	StreamOptions  map[string]interface{} `json:"stream_options,omitempty"`
+}
+
+type openAIChatResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+		Delta   openAIMessage `json:"delta"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage,omitempty"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func (p *OpenAIProvider) GenerateText(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return p.generate(ctx, p.chatRequest(req, false))
+}
+
+func (p *OpenAIProvider) GenerateJSON(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return p.generate(ctx, p.chatRequest(req, true))
+}
+
+// StreamJSON passes the answer's content deltas to onChunk as they arrive.
+func (p *OpenAIProvider) StreamJSON(ctx context.Context, req LLMRequest, onChunk func(string)) (*LLMResponse, error) {
+	body := p.chatRequest(req, true)
+	body.Stream = true
+	body.StreamOptions = map[string]interface{}{"include_usage": true}
+
+	httpResp, err := p.send(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	out := &LLMResponse{Model: req.Model}
+	var text strings.Builder
+	err = readSSEData(httpResp.Body, func(data string) error {
+		if data == "[DONE]" {
+			return nil
+		}
+		var chunk openAIChatResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("failed to decode stream chunk: %v", err)
+		}
+		if chunk.Error != nil {
+			return fmt.Errorf("OpenAI-compatible API stream error: %s", chunk.Error.Message)
+		}
+		if chunk.Model != "" {
+			out.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			out.PromptTokens = chunk.Usage.PromptTokens
+			out.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				text.WriteString(choice.Delta.Content)
+				onChunk(choice.Delta.Content)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if text.Len() == 0 {
+		return nil, fmt.Errorf("no content generated")
+	}
+	out.Text = text.String()
+	return out, nil
+}
+
+func (p *OpenAIProvider) chatRequest(req LLMRequest, jsonOutput bool) openAIChatRequest {
+	body := openAIChatRequest{
+		Model:       req.Model,
+		Messages:    []openAIRequestMessage{{Role: "user", Content: openAIContent(req)}},
+		Temperature: req.Config.Temperature,
+		TopP:        req.Config.TopP,
+		MaxTokens:   req.Config.MaxTokens,
+	}
+	if jsonOutput && req.Schema != nil {
+		body.ResponseFormat = map[string]interface{}{
+			"type": "json_schema",
+			"json_schema": map[string]interface{}{
+				"name":   "response",
+				"schema": req.Schema.JSONSchema(),
+			},
+		}
+	} else if jsonOutput {
+		body.ResponseFormat = map[string]interface{}{"type": "json_object"}
+	}
+	return body
+}
+
+// openAIContent is the prompt, followed by the images as data URLs.
+func openAIContent(req LLMRequest) interface{} {
+	if len(req.Images) == 0 {
+		return req.Prompt
+	}
+	parts := []map[string]interface{}{{"type": "text", "text": req.Prompt}}
+	for _, img := range req.Images {
+		parts = append(parts, map[string]interface{}{
+			"type": "image_url",
+			"image_url": map[string]string{
+				"url": "data:" + img.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(img.Data),
+			},
+		})
+	}
+	return parts
+}
+
+func (p *OpenAIProvider) generate(ctx context.Context, body openAIChatRequest) (*LLMResponse, error) {
+	httpResp, err := p.send(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var resp openAIChatResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return nil, fmt.Errorf("no content generated")
+	}
+
+	model := resp.Model
+	if model == "" {
+		model = body.Model
+	}
+	out := &LLMResponse{Model: model, Text: resp.Choices[0].Message.Content}
+	if resp.Usage != nil {
+		out.PromptTokens = resp.Usage.PromptTokens
+		out.CompletionTokens = resp.Usage.CompletionTokens
+	}
+	return out, nil
+}
+
+// send posts a chat completion request and returns the response once the
+// server has accepted it; the caller must close its body.
+func (p *OpenAIProvider) send(ctx context.Context, body openAIChatRequest) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %v", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	httpResp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call OpenAI-compatible API: %w", err)
+	}
+	if httpResp.StatusCode < 300 {
+		return httpResp, nil
+	}
+	defer httpResp.Body.Close()
+
+	raw, _ := io.ReadAll(httpResp.Body)
+	apiErr := &ProviderError{
+		API:        "OpenAI-compatible API",
+		StatusCode: httpResp.StatusCode,
+		Message:    strings.TrimSpace(string(raw)),
+		RetryAfter: parseRetryAfter(httpResp.Header.Get("Retry-After")),
+	}
+	var errResp openAIChatResponse
+	if json.Unmarshal(raw, &errResp) == nil && errResp.Error != nil && errResp.Error.Message != "" {
+		apiErr.Message = errResp.Error.Message
+	}
+	return nil, apiErr
+}
@@ -0,0 +1,212 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	CassetteModeRecord = "record"
+	CassetteModeReplay = "replay"
+	CassetteModeAuto   = "auto"
+)
+
+// ErrCassetteMiss is returned in replay mode when no recording exists for a prompt.
+var ErrCassetteMiss = errors.New("no cassette recording for prompt")
+
+// cassetteEntry is one recorded prompt→response pair, stored as <dir>/<key>.json.
+type cassetteEntry struct {
+	Key              string    `json:"key"`
+	Kind             string    `json:"kind"`
+	Model            string    `json:"model"`
+	Prompt           string    `json:"prompt"`
+	Response         string    `json:"response"`
+	RecordedAt       time.Time `json:"recordedAt"`
+	PromptTokens     int       `json:"promptTokens,omitempty"`
+	CompletionTokens int       `json:"completionTokens,omitempty"`
+}
+
+// ReplayProvider records responses from another provider to disk and replays
+// them, keyed by a hash of the request, so backend runs are offline and reproducible.
+//
+// In "record" mode every call goes to the wrapped provider and is saved,
+// in "replay" mode only saved responses are returned, and "auto" replays
+// when a recording exists and records otherwise.
+type ReplayProvider struct {
+	dir  string
+	mode string
+	next LLMProvider
+	mu   sync.Mutex
+}
+
+// NewReplayProvider returns a cassette provider storing recordings in dir.
+// next may be nil in replay mode.
+func NewReplayProvider(dir, mode string, next LLMProvider) (*ReplayProvider, error) {
+	switch mode {
+	case CassetteModeRecord, CassetteModeAuto:
+		if next == nil {
+			return nil, fmt.Errorf("cassette mode %q needs a provider to record from", mode)
+		}
+	case CassetteModeReplay:
+	default:
+		return nil, fmt.Errorf("unknown cassette mode %q", mode)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cassette directory: %v", err)
+	}
+	return &ReplayProvider{dir: dir, mode: mode, next: next}, nil
+}
+
+func (p *ReplayProvider) Name() string { return ProviderReplay }
+
+// Close closes the provider being recorded from, if any.
+func (p *ReplayProvider) Close() error {
+	if closer, ok := p.next.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (p *ReplayProvider) GenerateText(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return p.generate(ctx, "text", req)
+}
+
+func (p *ReplayProvider) GenerateJSON(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	return p.generate(ctx, "json", req)
+}
+
+// StreamJSON replays a recording as a single chunk. When recording, it streams
+// from the wrapped provider if that provider supports streaming.
+func (p *ReplayProvider) StreamJSON(ctx context.Context, req LLMRequest, onChunk func(string)) (*LLMResponse, error) {
+	return p.generateStream(ctx, "json", req, onChunk)
+}
+
+func (p *ReplayProvider) generate(ctx context.Context, kind string, req LLMRequest) (*LLMResponse, error) {
+	return p.generateStream(ctx, kind, req, nil)
+}
+
+func (p *ReplayProvider) generateStream(ctx context.Context, kind string, req LLMRequest, onChunk func(string)) (*LLMResponse, error) {
+	key := cassetteKey(kind, req)
+
+	if p.mode != CassetteModeRecord {
+		entry, err := p.load(key)
+		if err == nil {
+			if onChunk != nil {
+				onChunk(entry.Response)
+			}
+			return &LLMResponse{
+				Model:            entry.Model,
+				Text:             entry.Response,
+				PromptTokens:     entry.PromptTokens,
+				CompletionTokens: entry.CompletionTokens,
+			}, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if p.mode == CassetteModeReplay {
+			return nil, fmt.Errorf("%w (key %s)", ErrCassetteMiss, key)
+		}
+	}
+
+	var resp *LLMResponse
+	var err error
+	if streamer, ok := p.next.(StreamingProvider); ok && onChunk != nil {
+		resp, err = streamer.StreamJSON(ctx, req, onChunk)
+	} else if kind == "json" {
+		resp, err = p.next.GenerateJSON(ctx, req)
+		if err == nil && onChunk != nil {
+			onChunk(resp.Text)
+		}
+	} else {
+		resp, err = p.next.GenerateText(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := cassetteEntry{
+		Key:              key,
+		Kind:             kind,
+		Model:            req.Model,
+		Prompt:           req.Prompt,
+		Response:         resp.Text,
+		RecordedAt:       time.Now(),
+		PromptTokens:     resp.PromptTokens,
+		CompletionTokens: resp.CompletionTokens,
+	}
+	if err := p.save(entry); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// cassetteKey hashes everything that influences the model's answer.
+func cassetteKey(kind string, req LLMRequest) string {
+	h := sha256.New()
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(req.Model))
+	h.Write([]byte{0})
+	h.Write([]byte(req.Prompt))
+	if req.Schema != nil {
+		h.Write([]byte{0})
+		h.Write([]byte(req.Schema.String()))
+	}
+	for _, img := range req.Images {
+		sum := sha256.Sum256(img.Data)
+		h.Write([]byte{0})
+		h.Write([]byte(img.MIMEType))
+		h.Write(sum[:])
+	}
+	// Only hashed when set, so cassettes recorded with the defaults stay valid
+	if config, _ := json.Marshal(req.Config); string(config) != "{}" {
+		h.Write([]byte{0})
+		h.Write(config)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (p *ReplayProvider) path(key string) string {
+	return filepath.Join(p.dir, key+".json")
+}
+
+func (p *ReplayProvider) load(key string) (*cassetteEntry, error) {
+	data, err := os.ReadFile(p.path(key))
+	if err != nil {
+		return nil, err
+	}
+	var entry cassetteEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette %s: %v", key, err)
+	}
+	return &entry, nil
+}
+
+func (p *ReplayProvider) save(entry cassetteEntry) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cassette: %v", err)
+	}
+	// Write to a temp file first so a crash never leaves a truncated recording.
+	tmp := p.path(entry.Key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write cassette: %v", err)
+	}
+	if err := os.Rename(tmp, p.path(entry.Key)); err != nil {
+		return fmt.Errorf("failed to write cassette: %v", err)
+	}
+	return nil
+}
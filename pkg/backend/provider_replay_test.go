@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// extractionAnswer is a valid extraction answer giving the address, price and
+// bedrooms and no value for the other fields.
+func extractionAnswer(t *testing.T) string {
+	t.Helper()
+	values := map[string]interface{}{
+		"address":  "123 Maple St, Columbus, OH 43004",
+		"price":    349900,
+		"bedrooms": 3,
+	}
+	answer := map[string]interface{}{}
+	for name := range SchemaFor(PropertyDetails{}).Properties {
+		answer[name] = map[string]interface{}{"value": values[name], "confidence": 0.9, "evidence": nil}
+	}
+	data, err := json.Marshal(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestExtractPropertyDetailsReplaysCassette(t *testing.T) {
+	dir := t.TempDir()
+	page := "123 Maple St, Columbus, OH 43004\n$349,900\n3 beds"
+	defer SetLLMProvider(nil)
+
+	scripted := NewScriptedProvider(ScriptedResponse{Response: extractionAnswer(t)})
+	recorder, err := NewReplayProvider(dir, CassetteModeRecord, scripted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetLLMProvider(recorder)
+	recorded, err := ExtractPropertyDetails(context.Background(), page)
+	if err != nil {
+		t.Fatalf("recording: %v", err)
+	}
+	if recorded.Address != "123 Maple St, Columbus, OH 43004" || recorded.Price != 349900 || recorded.Bedrooms != 3 {
+		t.Fatalf("recorded details = %+v", recorded)
+	}
+
+	replay, err := NewReplayProvider(dir, CassetteModeReplay, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetLLMProvider(replay)
+	replayed, err := ExtractPropertyDetails(context.Background(), page)
+	if err != nil {
+		t.Fatalf("replaying: %v", err)
+	}
+	if !reflect.DeepEqual(replayed, recorded) {
+		t.Errorf("replayed %+v, recorded %+v", replayed, recorded)
+	}
+	if calls := len(scripted.Calls()); calls != 1 {
+		t.Errorf("the recorded provider was called %d times, want 1", calls)
+	}
+
+	if _, err := ExtractPropertyDetails(context.Background(), page+"\n1,820 sq ft"); !errors.Is(err, ErrCassetteMiss) {
+		t.Errorf("unrecorded page: err = %v, want ErrCassetteMiss", err)
+	}
+}
+
+func TestCassetteKeyIsStable(t *testing.T) {
+	temperature := float32(0.2)
+	base := LLMRequest{Model: "test-model", Prompt: "Extract the listing."}
+
+	// Cassettes already on disk are found by this key, so it must not change
+	// between releases
+	if got, want := cassetteKey("json", base), "b92c0ad36bc189146c1a63a6349598ee8593a6a33d38bf91c6e42ca92a46c6a1"; got != want {
+		t.Errorf("cassetteKey = %s, want %s", got, want)
+	}
+	if cassetteKey("json", base) != cassetteKey("json", LLMRequest{Model: "test-model", Prompt: "Extract the listing.", Config: GenerationConfig{}}) {
+		t.Error("the default generation config changed the key")
+	}
+
+	variants := map[string]struct {
+		kind string
+		req  LLMRequest
+	}{
+		"kind":   {"text", base},
+		"model":  {"json", LLMRequest{Model: "other-model", Prompt: base.Prompt}},
+		"prompt": {"json", LLMRequest{Model: base.Model, Prompt: "Extract the listing!"}},
+		"schema": {"json", LLMRequest{Model: base.Model, Prompt: base.Prompt, Schema: &Schema{Type: "object"}}},
+		"config": {"json", LLMRequest{Model: base.Model, Prompt: base.Prompt, Config: GenerationConfig{Temperature: &temperature}}},
+		"images": {"json", LLMRequest{Model: base.Model, Prompt: base.Prompt, Images: []LLMImage{{MIMEType: "image/jpeg", Data: []byte{1}}}}},
+	}
+	for name, v := range variants {
+		if cassetteKey(v.kind, v.req) == cassetteKey("json", base) {
+			t.Errorf("changing the %s kept the key", name)
+		}
+	}
+}
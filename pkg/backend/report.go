@@ -0,0 +1,281 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// reportCacheTTL is how long a generated report is served from the cache.
+const reportCacheTTL = 24 * time.Hour
+
+// reportInputs are the addresses and property details a BMA report is generated from.
+type reportInputs struct {
+	Primary           Address
+	Comparisons       []Address
+	ComparisonIDs     []primitive.ObjectID
+	PrimaryDetails    PropertyDetails
+	ComparisonDetails []PropertyDetails
+	// Profile holds the instructions added to the analysis prompt; nil when
+	// no instruction profile exists.
+	Profile *LLMInstructions
+	// Locale is the language and formats the report is written in.
+	Locale *ReportLocale
+	// Warnings are added to the report, e.g. for listings with injection risk.
+	Warnings []string
+}
+
+// reportOptions are what a client chose for a report.
+type reportOptions struct {
+	// Profile is the ID or name of the instruction profile; empty selects the default.
+	Profile string
+	// Locale is a tag such as "es-US"; empty selects DefaultLocale.
+	Locale string
+}
+
+// reportOptionsFromQuery reads ?profile= and ?locale=.
+func reportOptionsFromQuery(c *fiber.Ctx) reportOptions {
+	return reportOptions{Profile: c.Query("profile"), Locale: c.Query("locale")}
+}
+
+// loadReportAddresses finds the primary address, the enabled comparison
+// addresses, the instruction profile and the locale for the options. When no
+// report can be generated yet, for example because an address needs review, it
+// returns a placeholder report whose opinion explains why. An unknown profile
+// yields ErrProfileNotFound and an unknown locale ErrUnsupportedLocale.
+func loadReportAddresses(ctx context.Context, opts reportOptions) (*reportInputs, *BMAReport, error) {
+	addrCol := BmaDB.Collection("addresses")
+
+	var in reportInputs
+
+	locale, err := findReportLocale(opts.Locale)
+	if err != nil {
+		return nil, nil, err
+	}
+	in.Locale = locale
+
+	profile, err := findInstructionProfile(ctx, opts.Profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	in.Profile = profile
+
+	// Find primary
+	err = addrCol.FindOne(ctx, bson.M{"primary": true}).Decode(&in.Primary)
+	if err != nil {
+		return nil, &BMAReport{
+			PrimaryAddress:  nil,
+			ComparisonAddrs: nil,
+			Opinion:         locale.Message(msgNoPrimary),
+		}, nil
+	}
+
+	// Find enabled (but not primary)
+	cursor, err := addrCol.Find(ctx, bson.M{"enabled": true, "primary": false})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &in.Comparisons); err != nil {
+		return nil, nil, err
+	}
+
+	if len(in.Comparisons) == 0 {
+		return nil, &BMAReport{
+			PrimaryAddress:  &in.Primary,
+			ComparisonAddrs: nil,
+			Opinion:         locale.Message(msgNoComparisons),
+		}, nil
+	}
+
+	// Disputed extractions must be checked before they feed an analysis
+	var review []string
+	if in.Primary.NeedsReview {
+		review = append(review, in.Primary.AddressStr)
+	}
+	for _, addr := range in.Comparisons {
+		if addr.NeedsReview {
+			review = append(review, addr.AddressStr)
+		}
+	}
+	if len(review) > 0 {
+		var comparisonAddrs []*Address
+		for i := range in.Comparisons {
+			comparisonAddrs = append(comparisonAddrs, &in.Comparisons[i])
+		}
+		return nil, &BMAReport{
+			PrimaryAddress:  &in.Primary,
+			ComparisonAddrs: comparisonAddrs,
+			Opinion:         locale.Message(msgNeedsReview, strings.Join(review, "; ")),
+		}, nil
+	}
+
+	for _, addr := range in.Comparisons {
+		in.ComparisonIDs = append(in.ComparisonIDs, addr.ID)
+	}
+	sort.Slice(in.ComparisonIDs, func(i, j int) bool {
+		return in.ComparisonIDs[i].Hex() < in.ComparisonIDs[j].Hex()
+	})
+
+	placeholder, err := checkReportInjection(ctx, &in)
+	if err != nil {
+		return nil, nil, err
+	}
+	if placeholder != nil {
+		return nil, placeholder, nil
+	}
+
+	return &in, nil, nil
+}
+
+// cacheFilter selects the cached report for these inputs.
+func (in *reportInputs) cacheFilter() bson.M {
+	return bson.M{
+		"primaryAddressId":     in.Primary.ID,
+		"comparisonAddressIds": in.ComparisonIDs,
+		"profileId":            in.profileID(),
+		"locale":               in.Locale.Tag,
+	}
+}
+
+// profileID identifies the instruction profile in the cache; reports generated
+// without any profile use the nil ID.
+func (in *reportInputs) profileID() primitive.ObjectID {
+	if in.Profile == nil {
+		return primitive.NilObjectID
+	}
+	return in.Profile.ID
+}
+
+// analysisOptions returns the profile's instructions and the locale for the analysis.
+func (in *reportInputs) analysisOptions() analysisOptions {
+	opts := analysisOptions{Locale: in.Locale}
+	if in.Profile != nil {
+		opts.Instructions = in.Profile.Instructions
+	}
+	return opts
+}
+
+// findCachedReport returns the cached report for the inputs if it is still fresh.
+func findCachedReport(ctx context.Context, in *reportInputs) (*BMAReport, bool) {
+	var cachedReport CachedBMAReport
+	err := BmaDB.Collection("cached_bma_reports").FindOne(ctx, in.cacheFilter()).Decode(&cachedReport)
+	if err == nil && time.Since(cachedReport.GeneratedAt) < reportCacheTTL {
+		// Pages may have been re-captured since, so warnings reflect their current state
+		cachedReport.Report.Warnings = in.Warnings
+		return &cachedReport.Report, true
+	}
+	return nil, false
+}
+
+// deleteCachedReport removes the cached report for the inputs, if any.
+func deleteCachedReport(ctx context.Context, in *reportInputs) error {
+	_, err := BmaDB.Collection("cached_bma_reports").DeleteOne(ctx, in.cacheFilter())
+	return err
+}
+
+// loadReportDetails reads the extracted property details for every address.
+func loadReportDetails(ctx context.Context, in *reportInputs) error {
+	rawCol := BmaDB.Collection("raw_page_data")
+
+	// Get property details for primary address
+	var primaryRaw RawPageData
+	err := rawCol.FindOne(ctx, bson.M{"_id": in.Primary.RawPageID}).Decode(&primaryRaw)
+	if err != nil || primaryRaw.PropertyDetails == nil {
+		return fmt.Errorf("failed to get primary property details")
+	}
+	in.PrimaryDetails = *primaryRaw.PropertyDetails
+	in.PrimaryDetails.Condition = primaryRaw.Condition
+
+	// Get property details for comparison addresses
+	in.ComparisonDetails = nil
+	for _, addr := range in.Comparisons {
+		var raw RawPageData
+		err = rawCol.FindOne(ctx, bson.M{"_id": addr.RawPageID}).Decode(&raw)
+		if err != nil {
+			continue
+		}
+		if raw.PropertyDetails != nil {
+			// Create a copy without the listing date
+			details := *raw.PropertyDetails
+			details.DaysOnMarket = 0
+			details.LastPriceChange = 0
+			details.Condition = raw.Condition
+			in.ComparisonDetails = append(in.ComparisonDetails, details)
+		}
+	}
+	return nil
+}
+
+// generateReport runs the analysis for the inputs and caches the resulting report.
+// obs, when not nil, receives generation progress.
+func generateReport(ctx context.Context, in *reportInputs, obs *generationObserver) (BMAReport, error) {
+	ctx, usage := withUsageScope(ctx, "", &in.Primary.ID)
+
+	result, err := generateDetailedBMA(ctx, in.PrimaryDetails, in.ComparisonDetails, in.analysisOptions(), obs)
+	if err != nil {
+		return BMAReport{}, err
+	}
+
+	// Construct the report
+	var comparisonAddrs []*Address
+	for i := range in.Comparisons {
+		comparisonAddrs = append(comparisonAddrs, &in.Comparisons[i])
+	}
+
+	report := BMAReport{
+		PrimaryAddress:   &in.Primary,
+		ComparisonAddrs:  comparisonAddrs,
+		Opinion:          result.Analysis.Recommendation,
+		DetailedAnalysis: &result.Analysis,
+		Warnings:         in.Warnings,
+		ToolCalls:        result.ToolCalls,
+		Discrepancies:    result.Discrepancies,
+		Locale:           in.Locale.Tag,
+	}
+	if in.Profile != nil {
+		report.Profile = in.Profile.Name
+	}
+
+	cacheReport(ctx, in, report, usage)
+	return report, nil
+}
+
+// cacheReport stores the report and attributes the LLM usage of its generation to it.
+func cacheReport(ctx context.Context, in *reportInputs, report BMAReport, usage *usageScope) {
+	cachedCol := BmaDB.Collection("cached_bma_reports")
+
+	cachedReport := CachedBMAReport{
+		PrimaryAddressID:     in.Primary.ID,
+		ComparisonAddressIDs: in.ComparisonIDs,
+		ProfileID:            in.profileID(),
+		Locale:               in.Locale.Tag,
+		GeneratedAt:          time.Now(),
+		Report:               report,
+	}
+
+	_, err := cachedCol.UpdateOne(
+		ctx,
+		in.cacheFilter(),
+		bson.M{"$set": cachedReport},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to cache BMA report")
+		return
+	}
+
+	// Attribute the generation cost to the cached report
+	var stored CachedBMAReport
+	if err := cachedCol.FindOne(ctx, in.cacheFilter()).Decode(&stored); err == nil {
+		linkUsage(ctx, usage, bson.M{"reportId": stored.ID})
+	}
+}
@@ -0,0 +1,245 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Stages reported in "status" events of the report stream.
+const (
+	streamStageLoadingComps = "loading_comps"
+	streamStageCached       = "cached"
+	streamStagePromptSent   = "prompt_sent"
+	streamStageRepairing    = "repairing"
+	streamStageFactCheck    = "fact_check"
+)
+
+// handleBMAReportStream generates the BMA report like handleBMAReport but
+// streams progress as server-sent events:
+//
+//	status     {"stage": "loading_comps" | "cached" | "prompt_sent" | "repairing" | "fact_check", ...}
+//	properties the addresses and property details the report is based on
+//	tool       a ToolCall, for each calculation the model requested
+//	token      {"text": "..."} raw model output as it is generated
+//	section    {"name": "priceAnalysis", "value": ...} each analysis field once complete
+//	report     the complete BMAReport, always the last event on success
+//	error      {"error": "...", "validation": {...}, "retryAfter": seconds}
+//
+// Pass refresh=true to ignore the cached report, profile= to select the
+// instruction profile and locale= to select the language and formats. Work
+// stops as soon as the client disconnects.
+func handleBMAReportStream(c *fiber.Ctx) error {
+	refresh := c.QueryBool("refresh")
+	opts := reportOptionsFromQuery(c)
+
+	// The stream writer runs after this handler returns, when the request
+	// context has already been cancelled, so it gets a context of its own.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.UserContext()), requestTimeout())
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		sse := &sseWriter{w: w}
+		send := func(event string, payload interface{}) {
+			if err := sse.send(event, payload); err != nil {
+				log.Info().Err(err).Msg("Report stream client disconnected")
+				cancel()
+			}
+		}
+		streamBMAReport(ctx, refresh, opts, send)
+	})
+	return nil
+}
+
+func streamBMAReport(ctx context.Context, refresh bool, opts reportOptions, send func(event string, payload interface{})) {
+	sendError := func(message string, err error) {
+		payload := fiber.Map{"error": message}
+		if verr, ok := asValidationError(err); ok {
+			payload["validation"] = verr
+		}
+		if ErrUpstreamUnavailable(err) {
+			payload["error"] = "LLM provider is unavailable, try again shortly"
+			payload["retryAfter"] = upstreamRetryAfter(err)
+		}
+		send("error", payload)
+	}
+
+	send("status", fiber.Map{"stage": streamStageLoadingComps})
+	in, placeholder, err := loadReportAddresses(ctx, opts)
+	if err != nil {
+		sendError(err.Error(), err)
+		return
+	}
+	if placeholder != nil {
+		send("report", placeholder)
+		return
+	}
+
+	if refresh {
+		if err := deleteCachedReport(ctx, in); err != nil {
+			log.Error().Err(err).Msg("Failed to delete cached report")
+		}
+	} else if cached, ok := findCachedReport(ctx, in); ok {
+		send("status", fiber.Map{"stage": streamStageCached})
+		send("report", cached)
+		return
+	}
+
+	if err := loadReportDetails(ctx, in); err != nil {
+		sendError("Failed to get primary property details", err)
+		return
+	}
+	send("properties", fiber.Map{
+		"primaryAddress":         in.Primary,
+		"comparisonAddresses":    in.Comparisons,
+		"primaryPropertyDetails": in.PrimaryDetails,
+		"comparisonDetails":      in.ComparisonDetails,
+	})
+
+	sections := &sectionScanner{}
+	sent := map[string]bool{}
+	obs := &generationObserver{
+		PromptSent: func(model string, attempt int) {
+			send("status", fiber.Map{"stage": streamStagePromptSent, "model": model, "attempt": attempt + 1})
+		},
+		Chunk: func(text string) {
+			send("token", fiber.Map{"text": text})
+			for name, value := range sections.write(text) {
+				if !sent[name] {
+					sent[name] = true
+					send("section", fiber.Map{"name": name, "value": value})
+				}
+			}
+		},
+		Rejected: func(errs []FieldError) {
+			// The repaired answer replaces everything streamed so far
+			sections = &sectionScanner{}
+			sent = map[string]bool{}
+			send("status", fiber.Map{"stage": streamStageRepairing, "errors": errs})
+		},
+		ToolCalled: func(call ToolCall) {
+			send("tool", call)
+		},
+		FactCheckFailed: func(discrepancies []Discrepancy) {
+			// The regenerated analysis replaces the one streamed so far
+			sections = &sectionScanner{}
+			sent = map[string]bool{}
+			send("status", fiber.Map{"stage": streamStageFactCheck, "discrepancies": discrepancies})
+		},
+	}
+
+	report, err := generateReport(ctx, in, obs)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate detailed analysis")
+		if ctx.Err() != nil {
+			return
+		}
+		sendError("Failed to generate analysis", err)
+		return
+	}
+	send("report", report)
+}
+
+// analysisSections are the DetailedAnalysis fields emitted as "section" events.
+var analysisSections = map[string]bool{
+	"priceAnalysis":     true,
+	"featureComparison": true,
+	"marketTrends":      true,
+	"recommendation":    true,
+}
+
+// sectionScanner finds the top-level analysis fields of a streamed JSON
+// object as they complete. Each chunk is scanned once, so the work stays
+// linear in the length of the response.
+type sectionScanner struct {
+	buf        []byte
+	depth      int
+	inString   bool
+	escaped    bool
+	done       bool
+	inValue    bool // between a top-level key's colon and the end of its value
+	keyStart   int
+	valueStart int
+	key        string
+}
+
+// write appends a chunk and returns the sections it completed.
+func (s *sectionScanner) write(chunk string) map[string]json.RawMessage {
+	var out map[string]json.RawMessage
+	finish := func(end int) {
+		s.inValue = false
+		value := json.RawMessage(bytes.TrimSpace(s.buf[s.valueStart:end]))
+		if analysisSections[s.key] && json.Valid(value) {
+			if out == nil {
+				out = map[string]json.RawMessage{}
+			}
+			out[s.key] = value
+		}
+	}
+
+	from := len(s.buf)
+	s.buf = append(s.buf, chunk...)
+	for i := from; i < len(s.buf) && !s.done; i++ {
+		c := s.buf[i]
+		if s.inString {
+			switch {
+			case s.escaped:
+				s.escaped = false
+			case c == '\\':
+				s.escaped = true
+			case c == '"':
+				s.inString = false
+				if s.depth == 1 && s.inValue {
+					finish(i + 1)
+				} else if s.depth == 1 {
+					if err := json.Unmarshal(s.buf[s.keyStart:i+1], &s.key); err != nil {
+						s.key = ""
+					}
+				}
+			}
+			continue
+		}
+		if s.depth == 0 && c != '{' {
+			// Text before the object
+			continue
+		}
+		switch c {
+		case '"':
+			s.inString = true
+			if s.depth == 1 && !s.inValue {
+				s.keyStart = i
+			}
+		case ':':
+			if s.depth == 1 && !s.inValue {
+				s.inValue = true
+				s.valueStart = i + 1
+			}
+		case ',':
+			if s.depth == 1 && s.inValue {
+				finish(i)
+			}
+		case '{', '[':
+			s.depth++
+		case '}', ']':
+			s.depth--
+			if s.depth == 1 && s.inValue {
+				finish(i + 1)
+			} else if s.depth == 0 {
+				if s.inValue {
+					finish(i)
+				}
+				s.done = true
+			}
+		}
+	}
+	return out
+}
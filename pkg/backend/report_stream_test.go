@@ -0,0 +1,56 @@
+package backend
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSectionScannerSplitChunks(t *testing.T) {
+	answer := `Here is the analysis: "draft" {"priceAnalysis": {"note": "}\"]", "figures": [1, {"n": 2}]}, ` +
+		`"marketTrends" : "Prices rose 4%, \"steadily\" {", "confidence": 0.8, ` +
+		`"recommendation": 12.5, "featureComparison": [ {"feature": "Beds"} ]} trailing "text"`
+	want := map[string]json.RawMessage{
+		"priceAnalysis":     json.RawMessage(`{"note": "}\"]", "figures": [1, {"n": 2}]}`),
+		"marketTrends":      json.RawMessage(`"Prices rose 4%, \"steadily\" {"`),
+		"recommendation":    json.RawMessage(`12.5`),
+		"featureComparison": json.RawMessage(`[ {"feature": "Beds"} ]`),
+	}
+
+	for size := 1; size <= len(answer); size++ {
+		scanner := &sectionScanner{}
+		got := map[string]json.RawMessage{}
+		for start := 0; start < len(answer); start += size {
+			end := min(start+size, len(answer))
+			for name, value := range scanner.write(answer[start:end]) {
+				if _, ok := got[name]; ok {
+					t.Fatalf("chunks of %d bytes: %s completed twice", size, name)
+				}
+				got[name] = value
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("chunks of %d bytes: got %s, want %s", size, got, want)
+		}
+	}
+}
+
+func TestSectionScannerWaitsForCompleteValues(t *testing.T) {
+	tests := []struct {
+		chunks []string
+		want   []int // sections completed by each chunk
+	}{
+		{[]string{`{"recommendation": 12`, `.5}`}, []int{0, 1}},
+		{[]string{`{"marketTrends": "up`, `", "priceAnalysis": {"a": [1`, `]}`}, []int{0, 1, 1}},
+		{[]string{`{"priceAnalysis": "x\`, `"", "recommendation": "y"}`}, []int{0, 2}},
+		{[]string{`{"other": {"priceAnalysis": "nested"}}`}, []int{0}},
+	}
+	for _, tt := range tests {
+		scanner := &sectionScanner{}
+		for i, chunk := range tt.chunks {
+			if got := len(scanner.write(chunk)); got != tt.want[i] {
+				t.Errorf("%q: chunk %d completed %d sections, want %d", tt.chunks, i, got, tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultRetryAttempts    = 3
+	defaultRetryBaseDelay   = 500 * time.Millisecond
+	defaultRetryMaxDelay    = 20 * time.Second
+	defaultConcurrency      = 4
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// ProviderError is an error status returned by a provider's API.
+type ProviderError struct {
+	API        string
+	StatusCode int
+	Message    string
+	// RetryAfter is the delay the server asked for, if any.
+	RetryAfter time.Duration
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s returned %d: %s", e.API, e.StatusCode, e.Message)
+}
+
+// ErrCircuitOpen is returned without calling the provider while its circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("LLM provider circuit breaker is open")
+
+// circuitOpenError is ErrCircuitOpen for the provider whose breaker is open.
+type circuitOpenError struct {
+	provider string
+}
+
+func (e *circuitOpenError) Error() string {
+	return ErrCircuitOpen.Error() + ": " + e.provider
+}
+
+func (e *circuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// errAttemptTimeout is returned when a single call ran past its task timeout
+// while the caller was still waiting: the provider is slow or hung.
+var errAttemptTimeout = errors.New("LLM provider did not answer in time")
+
+// ErrUpstreamUnavailable reports whether err means the provider is unavailable
+// or overloaded, as opposed to a bad request or an invalid answer.
+func ErrUpstreamUnavailable(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || isRetryable(err)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// isRetryable reports whether a failed call may succeed when repeated:
+// rate limits, overload and server errors, timed out attempts and dropped
+// connections.
+func isRetryable(err error) bool {
+	if errors.Is(err, errAttemptTimeout) {
+		return true
+	}
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var perr *ProviderError
+	if errors.As(err, &perr) {
+		switch perr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout, 529:
+			return true
+		}
+		return false
+	}
+
+	var apiErr *apierror.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.HTTPCode() {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		if status := apiErr.GRPCStatus(); status != nil {
+			switch status.Code() {
+			case codes.ResourceExhausted, codes.Unavailable, codes.Internal:
+				return true
+			}
+		}
+		return false
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		strings.Contains(err.Error(), "connection reset by peer")
+}
+
+func retryAfterOf(err error) time.Duration {
+	var perr *ProviderError
+	if errors.As(err, &perr) {
+		return perr.RetryAfter
+	}
+	return 0
+}
+
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n >= 0 {
+		return n
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// backoffDelay returns a full-jitter exponential delay for the retry after
+// the given attempt, stretched to the server's Retry-After when it asks for more.
+func backoffDelay(attempt int, retryAfter time.Duration) time.Duration {
+	base := envDuration("LLM_RETRY_BASE_DELAY", defaultRetryBaseDelay)
+	maxDelay := envDuration("LLM_RETRY_MAX_DELAY", defaultRetryMaxDelay)
+
+	ceiling := base << attempt
+	if ceiling <= 0 || ceiling > maxDelay {
+		ceiling = maxDelay
+	}
+	delay := time.Duration(rand.Int63n(int64(ceiling) + 1))
+	if retryAfter > delay {
+		delay = min(retryAfter, maxDelay)
+	}
+	return delay
+}
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// providerGuard limits concurrency and tracks the health of one provider.
+type providerGuard struct {
+	name  string
+	slots chan struct{}
+
+	mu                  sync.Mutex
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	probing             bool
+	lastError           string
+	calls               int64
+	failures            int64
+	retries             int64
+	rejected            int64
+}
+
+var (
+	providerGuards   = map[string]*providerGuard{}
+	providerGuardsMu sync.Mutex
+)
+
+// guardFor returns the guard of the named provider. LLM_<PROVIDER>_CONCURRENCY,
+// or LLM_CONCURRENCY for all providers, limits the calls in flight.
+func guardFor(name string) *providerGuard {
+	providerGuardsMu.Lock()
+	defer providerGuardsMu.Unlock()
+	if g, ok := providerGuards[name]; ok {
+		return g
+	}
+	limit := envInt("LLM_"+strings.ToUpper(name)+"_CONCURRENCY", envInt("LLM_CONCURRENCY", defaultConcurrency))
+	if limit < 1 {
+		limit = 1
+	}
+	g := &providerGuard{name: name, slots: make(chan struct{}, limit), state: BreakerClosed}
+	providerGuards[name] = g
+	return g
+}
+
+// allow reports whether a call may go through the breaker. After the cooldown
+// an open breaker lets a single probe through.
+func (g *providerGuard) allow() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch g.state {
+	case BreakerOpen:
+		if time.Since(g.openedAt) < envDuration("LLM_BREAKER_COOLDOWN", defaultBreakerCooldown) {
+			g.rejected++
+			return false
+		}
+		g.state = BreakerHalfOpen
+		g.probing = true
+		return true
+	case BreakerHalfOpen:
+		if g.probing {
+			g.rejected++
+			return false
+		}
+		g.probing = true
+		return true
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a call. Only upstream
+// failures count; a bad request says nothing about the provider's health.
+func (g *providerGuard) record(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls++
+	g.probing = false
+
+	if err == nil || !isRetryable(err) {
+		g.consecutiveFailures = 0
+		g.state = BreakerClosed
+		return
+	}
+
+	g.failures++
+	g.consecutiveFailures++
+	g.lastError = err.Error()
+	threshold := envInt("LLM_BREAKER_THRESHOLD", defaultBreakerThreshold)
+	if g.state == BreakerHalfOpen || (threshold > 0 && g.consecutiveFailures >= threshold) {
+		if g.state != BreakerOpen {
+			log.Warn().Str("provider", g.name).Int("failures", g.consecutiveFailures).Msg("LLM circuit breaker opened")
+		}
+		g.state = BreakerOpen
+		g.openedAt = time.Now()
+	}
+}
+
+// acquire waits for a concurrency slot.
+func (g *providerGuard) acquire(ctx context.Context) error {
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *providerGuard) release() { <-g.slots }
+
+// callResilient runs call against the named provider with a concurrency slot,
+// the circuit breaker and jittered exponential backoff on retryable errors.
+// canRetry, when not nil, vetoes a retry, e.g. after a stream has emitted text.
+// An attempt that runs past its own timeout while ctx is live counts as an
+// upstream failure; once ctx ends, the breaker is left as it was.
+func callResilient(ctx context.Context, provider string, call func(context.Context) (*LLMResponse, error), canRetry func() bool) (*LLMResponse, error) {
+	g := guardFor(provider)
+	attempts := envInt("LLM_RETRY_ATTEMPTS", defaultRetryAttempts)
+
+	for attempt := 0; ; attempt++ {
+		if !g.allow() {
+			return nil, &circuitOpenError{provider: provider}
+		}
+		if err := g.acquire(ctx); err != nil {
+			g.mu.Lock()
+			g.probing = false
+			g.mu.Unlock()
+			return nil, err
+		}
+		resp, err := call(ctx)
+		g.release()
+		if err != nil && ctx.Err() != nil {
+			// The caller gave up; that says nothing about the provider
+			g.mu.Lock()
+			g.probing = false
+			g.mu.Unlock()
+			return nil, err
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %v", errAttemptTimeout, err)
+		}
+		g.record(err)
+
+		if err == nil || !isRetryable(err) || attempt >= attempts || (canRetry != nil && !canRetry()) {
+			return resp, err
+		}
+
+		delay := backoffDelay(attempt, retryAfterOf(err))
+		log.Warn().Err(err).Str("provider", provider).Int("attempt", attempt+1).Dur("delay", delay).Msg("Retrying LLM call")
+		g.mu.Lock()
+		g.retries++
+		g.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// ProviderStatus is the health of one provider as shown by /api/llm/status.
+type ProviderStatus struct {
+	Provider            string     `json:"provider"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	RetryAt             *time.Time `json:"retryAt,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	InFlight            int        `json:"inFlight"`
+	ConcurrencyLimit    int        `json:"concurrencyLimit"`
+	Calls               int64      `json:"calls"`
+	Failures            int64      `json:"failures"`
+	Retries             int64      `json:"retries"`
+	Rejected            int64      `json:"rejected"`
+}
+
+func (g *providerGuard) status() ProviderStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := ProviderStatus{
+		Provider:            g.name,
+		State:               g.state,
+		ConsecutiveFailures: g.consecutiveFailures,
+		LastError:           g.lastError,
+		InFlight:            len(g.slots),
+		ConcurrencyLimit:    cap(g.slots),
+		Calls:               g.calls,
+		Failures:            g.failures,
+		Retries:             g.retries,
+		Rejected:            g.rejected,
+	}
+	if g.state != BreakerClosed {
+		openedAt := g.openedAt
+		retryAt := openedAt.Add(envDuration("LLM_BREAKER_COOLDOWN", defaultBreakerCooldown))
+		s.OpenedAt, s.RetryAt = &openedAt, &retryAt
+	}
+	return s
+}
+
+// upstreamRetryAfter suggests how many seconds a client should wait before
+// retrying after err: until the breaker closes, as long as the provider asked,
+// or the cooldown.
+func upstreamRetryAfter(err error) int {
+	delay := envDuration("LLM_BREAKER_COOLDOWN", defaultBreakerCooldown)
+	if d := retryAfterOf(err); d > 0 {
+		delay = d
+	} else if open := (*circuitOpenError)(nil); errors.As(err, &open) {
+		if s := guardFor(open.provider).status(); s.RetryAt != nil {
+			delay = time.Until(*s.RetryAt)
+		}
+	}
+	return max(1, int(delay.Round(time.Second)/time.Second))
+}
+
+// providerAvailable reports whether the named provider's breaker would let a call through.
+func providerAvailable(name string) bool {
+	s := guardFor(name).status()
+	return s.State == BreakerClosed || s.RetryAt == nil || time.Now().After(*s.RetryAt)
+}
+
+// activeProviderName is the name the breaker of the provider in use is keyed
+// on. It differs from LLM_PROVIDER when a provider is set with SetLLMProvider.
+func activeProviderName() string {
+	if p, err := currentLLMProvider(); err == nil {
+		return p.Name()
+	}
+	return configuredProviderName()
+}
+
+// extractionAvailable reports whether the breakers of every provider an
+// extraction calls, those of the consensus runs or the one in use, would let
+// a call through.
+func extractionAvailable() bool {
+	if refs := consensusRefs(); refs != nil {
+		for _, ref := range refs {
+			if !providerAvailable(ref.Provider) {
+				return false
+			}
+		}
+		return true
+	}
+	return providerAvailable(activeProviderName())
+}
+
+// handleLLMStatus returns the circuit breaker state and call counters of every
+// provider used since startup, and the number of queued captures.
+func handleLLMStatus(c *fiber.Ctx) error {
+	// Always report the provider in use, even before its first call
+	guardFor(activeProviderName())
+
+	providerGuardsMu.Lock()
+	guards := make([]*providerGuard, 0, len(providerGuards))
+	for _, g := range providerGuards {
+		guards = append(guards, g)
+	}
+	providerGuardsMu.Unlock()
+	sort.Slice(guards, func(i, j int) bool { return guards[i].name < guards[j].name })
+
+	providers := make([]ProviderStatus, len(guards))
+	for i, g := range guards {
+		providers[i] = g.status()
+	}
+
+	response := fiber.Map{
+		"provider":  activeProviderName(),
+		"providers": providers,
+	}
+	if pendingCapturesCollection != nil {
+		pending, err := pendingCapturesCollection.CountDocuments(c.UserContext(), pendingCaptureFilter())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		failed, err := pendingCapturesCollection.CountDocuments(c.UserContext(), bson.M{"status": CaptureFailed})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		response["pendingCaptures"] = pending
+		response["failedCaptures"] = failed
+	}
+	return c.JSON(response)
+}
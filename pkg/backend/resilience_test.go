@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// resetGuard gives the named provider a new guard for the test, so breaker
+// state does not carry over between tests or runs of them.
+func resetGuard(t *testing.T, name string) *providerGuard {
+	t.Helper()
+	forget := func() {
+		providerGuardsMu.Lock()
+		defer providerGuardsMu.Unlock()
+		delete(providerGuards, name)
+	}
+	forget()
+	t.Cleanup(forget)
+	return guardFor(name)
+}
+
+func TestAttemptTimeoutOpensTheBreaker(t *testing.T) {
+	resetGuard(t, "test-hung")
+	t.Setenv("LLM_RETRY_BASE_DELAY", "1ms")
+	t.Setenv("LLM_RETRY_ATTEMPTS", "1")
+	t.Setenv("LLM_BREAKER_THRESHOLD", "2")
+
+	attempts := 0
+	_, err := callResilient(context.Background(), "test-hung", func(ctx context.Context) (*LLMResponse, error) {
+		attempts++
+		ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+		defer cancel()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, nil)
+
+	if attempts != 2 {
+		t.Errorf("made %d attempts, want 2", attempts)
+	}
+	if !ErrUpstreamUnavailable(err) {
+		t.Errorf("err = %v, want an upstream failure", err)
+	}
+	if state := guardFor("test-hung").status().State; state != BreakerOpen {
+		t.Errorf("breaker is %s, want %s", state, BreakerOpen)
+	}
+	if providerAvailable("test-hung") {
+		t.Error("provider is available while its breaker is open")
+	}
+}
+
+func TestCallerCancellationLeavesTheBreaker(t *testing.T) {
+	g := resetGuard(t, "test-cancelled")
+	g.mu.Lock()
+	g.consecutiveFailures = 1
+	g.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := callResilient(ctx, "test-cancelled", func(context.Context) (*LLMResponse, error) {
+		cancel()
+		return nil, errors.New("stream closed")
+	}, nil)
+
+	if err == nil {
+		t.Fatal("want the call's error")
+	}
+	if s := g.status(); s.ConsecutiveFailures != 1 || s.Calls != 0 {
+		t.Errorf("breaker recorded the cancelled call: %+v", s)
+	}
+}
+
+func TestRetryAfterReadsTheFailedProvider(t *testing.T) {
+	t.Setenv("LLM_BREAKER_THRESHOLD", "1")
+	t.Setenv("LLM_BREAKER_COOLDOWN", "1h")
+	g := resetGuard(t, "test-open")
+	g.record(&ProviderError{API: "test", StatusCode: 503})
+
+	_, err := callResilient(context.Background(), "test-open", func(context.Context) (*LLMResponse, error) {
+		t.Fatal("called through an open breaker")
+		return nil, nil
+	}, nil)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+	if got := upstreamRetryAfter(err); got < 3500 {
+		t.Errorf("upstreamRetryAfter = %ds, want the breaker's remaining hour", got)
+	}
+}
@@ -2,8 +2,10 @@ package backend
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sort"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -11,11 +13,35 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// defaultRequestTimeout bounds a whole request, including its database and LLM calls.
+const defaultRequestTimeout = 5 * time.Minute
+
+// requestTimeout returns REQUEST_TIMEOUT as a Go duration, or the default.
+func requestTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("REQUEST_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return defaultRequestTimeout
+}
+
+// withRequestContext gives each request a context with a deadline that is
+// cancelled as soon as the handler returns, so handlers pass c.UserContext()
+// to Mongo and LLM calls and abandoned work stops with the request.
+func withRequestContext(timeout time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+		defer cancel()
+		c.SetUserContext(ctx)
+		return c.Next()
+	}
+}
+
 // SetupRoutes defines all endpoints.
 func SetupRoutes(app *fiber.App) {
+	app.Use(withRequestContext(requestTimeout()))
+
 	// Endpoint where the extension posts page data
 	app.Post("/api/extension/page-data", handleReceivePageData)
 
@@ -24,16 +50,52 @@ func SetupRoutes(app *fiber.App) {
 	app.Post("/api/addresses", handleCreateAddress)
 	app.Patch("/api/addresses/:id", handleUpdateAddress)
 	app.Delete("/api/addresses/:id", handleDeleteAddress)
+	app.Post("/api/addresses/:id/reviewed", handleMarkAddressReviewed)
+	app.Get("/api/addresses/:id/photos", handleListAddressPhotos)
+	app.Get("/api/addresses/:id/condition", handleGetAddressCondition)
+	app.Post("/api/addresses/:id/condition", handleAssessAddressCondition)
+	app.Get("/api/photos/:name", handleGetPhoto)
 	app.Get("/api/bma-report", handleBMAReport)
+	app.Get("/api/bma-report/stream", handleBMAReportStream)
 	app.Post("/api/bma-report/refresh", handleRefreshBMAReport)
 	app.Get("/api/llm-instructions", handleGetLLMInstructions)
 	app.Post("/api/llm-instructions", handleUpdateLLMInstructions)
+	app.Get("/api/instruction-profiles", handleListInstructionProfiles)
+	app.Post("/api/instruction-profiles", handleCreateInstructionProfile)
+	app.Get("/api/instruction-profiles/:id", handleGetInstructionProfile)
+	app.Put("/api/instruction-profiles/:id", handleUpdateInstructionProfile)
+	app.Delete("/api/instruction-profiles/:id", handleDeleteInstructionProfile)
+	app.Post("/api/instruction-profiles/:id/default", handleSetDefaultInstructionProfile)
+	app.Get("/api/usage", handleGetUsage)
+	app.Get("/api/prompts", handleListPrompts)
+	app.Get("/api/prompts/:name", handleListPromptVersions)
+	app.Post("/api/prompts/:name", handleCreatePromptVersion)
+	app.Post("/api/prompts/:name/activate", handleActivatePromptVersion)
+	app.Post("/api/prompts/:name/preview", handlePreviewPrompt)
+	app.Get("/api/admin/extraction-cache", handleGetExtractionCache)
+	app.Get("/api/admin/extraction-cache/entries", handleListExtractionCacheEntries)
+	app.Delete("/api/admin/extraction-cache", handlePurgeExtractionCache)
+	app.Delete("/api/admin/extraction-cache/:id", handleDeleteExtractionCacheEntry)
+	app.Get("/api/llm/status", handleLLMStatus)
+	app.Get("/api/settings/llm", handleListLLMSettings)
+	app.Get("/api/settings/llm/:task", handleGetLLMSettings)
+	app.Put("/api/settings/llm/:task", handleUpdateLLMSettings)
+	app.Delete("/api/settings/llm/:task", handleDeleteLLMSettings)
+}
+
+// asValidationError reports whether err carries a structured validation report.
+func asValidationError(err error) (*ValidationError, bool) {
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		return verr, true
+	}
+	return nil, false
 }
 
 // handleReceivePageData saves the raw content in MongoDB
 // Then calls the LLM to extract property details and saves that in the raw_page_data collection.
 func handleReceivePageData(c *fiber.Ctx) error {
-	ctx := context.Background()
+	ctx := c.UserContext()
 
 	var data RawPageData
 	if err := c.BodyParser(&data); err != nil {
@@ -43,12 +105,47 @@ func handleReceivePageData(c *fiber.Ctx) error {
 		})
 	}
 
+	// The text converted from the HTML replaces the captured text
+	if err := normalizePageData(&data); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
 	log.Info().Str("url", data.URL).Msg("Received page data from extension")
 
-	// Extract property details using Gemini
-	details, err := ExtractPropertyDetails(data.Content)
+	ctx, usage := withUsageScope(ctx, data.URL, nil)
+
+	// Read what the extractor for the listing's host and the structured data of
+	// the HTML, if sent, can, and extract the rest using the configured LLM
+	// provider, unless this exact listing text was extracted before.
+	// ?refresh=true forces a new extraction.
+	details, provenance, cached, err := ExtractPropertyDetailsCached(ctx, &data, c.QueryBool("refresh"))
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to extract property details")
+		if ctx.Err() != nil {
+			return c.Status(fiber.StatusGatewayTimeout).JSON(fiber.Map{
+				"error": "Timed out extracting property details",
+			})
+		}
+		if verr, ok := asValidationError(err); ok {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error":      "Extracted property details failed validation",
+				"validation": verr,
+			})
+		}
+		// Keep the capture when the model is unavailable and extract it later
+		if ErrUpstreamUnavailable(err) && pendingCapturesCollection != nil {
+			pending, qerr := enqueueCapture(ctx, &data, err)
+			if qerr == nil {
+				return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+					"message": "LLM provider unavailable; the page was queued and will be extracted automatically.",
+					"queued":  true,
+					"id":      pending.ID,
+				})
+			}
+			log.Error().Err(qerr).Str("url", data.URL).Msg("Failed to queue capture")
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": fmt.Sprintf("Failed to extract property details: %v", err),
 		})
@@ -56,58 +153,29 @@ func handleReceivePageData(c *fiber.Ctx) error {
 
 	log.Info().Str("address", details.Address).Msg("Successfully extracted property details")
 
-	data.PropertyDetails = details
-
-	// Check if we already have this address in the database
-	rawCol := BmaDB.Collection("raw_page_data")
-	filter := bson.M{"propertyDetails.address": details.Address}
-	update := bson.M{
-		"$set": bson.M{
-			"url":             data.URL,
-			"content":         data.Content,
-			"propertyDetails": details,
-		},
-	}
-	opts := options.Update().SetUpsert(true)
-
-	result, err := rawCol.UpdateOne(ctx, filter, update, opts)
+	stored, err := storeCapture(ctx, &data, details, provenance, usage)
 	if err != nil {
-		log.Error().Err(err).Str("address", details.Address).Msg("Failed to update raw page data")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
 
-	// If this was an insert (not an update), create a new Address record
-	if result.UpsertedID != nil {
-		addr := Address{
-			RawPageID:  result.UpsertedID.(primitive.ObjectID),
-			AddressStr: details.Address,
-			Enabled:    false, // default to false
-			Primary:    false,
-		}
-		addrCol := BmaDB.Collection("addresses")
-		_, err = addrCol.InsertOne(ctx, addr)
-		if err != nil {
-			log.Error().Err(err).Str("address", details.Address).Msg("Failed to create new address record")
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		}
-		log.Info().Str("address", details.Address).Msg("Created new address record")
-	} else {
-		log.Info().Str("address", details.Address).Msg("Updated existing address record")
-	}
-
 	return c.JSON(fiber.Map{
-		"message":  "Page data processed and property details extracted.",
-		"upserted": result.UpsertedID != nil,
+		"message":        "Page data processed and property details extracted.",
+		"upserted":       stored.Upserted,
+		"fieldsToVerify": FieldsToVerify(provenance),
+		"cached":         cached,
+		"extractor":      data.Extractor,
+		"photos":         len(data.Photos),
+		"needsReview":    len(stored.ReviewFields) > 0,
+		"reviewFields":   stored.ReviewFields,
+		"injectionRisk":  stored.InjectionRisk.Level,
 	})
 }
 
 // handleListAddresses returns all addresses with their property details.
 func handleListAddresses(c *fiber.Ctx) error {
-	ctx := context.Background()
+	ctx := c.UserContext()
 
 	addrCol := BmaDB.Collection("addresses")
 	rawCol := BmaDB.Collection("raw_page_data")
@@ -129,34 +197,131 @@ func handleListAddresses(c *fiber.Ctx) error {
 		AddressStr    string             `json:"addressStr"`
 		Enabled       bool               `json:"enabled"`
 		Primary       bool               `json:"primary"`
+		NeedsReview   bool               `json:"needsReview,omitempty"`
+		ReviewFields  []string           `json:"reviewFields,omitempty"`
+		InjectionRisk string             `json:"injectionRisk,omitempty"`
 		Price         *float64           `json:"price,omitempty"`
 		Bedrooms      *int               `json:"bedrooms,omitempty"`
 		Bathrooms     *float64           `json:"bathrooms,omitempty"`
 		SquareFootage *int               `json:"squareFootage,omitempty"`
 		PropertyType  *string            `json:"propertyType,omitempty"`
 		YearBuilt     *int               `json:"yearBuilt,omitempty"`
+		LotSize       *string            `json:"lotSize,omitempty"`
+		// Listing fields; omitted when the listing did not state them
+		ListingStatus  *string  `json:"listingStatus,omitempty"`
+		ListPrice      *float64 `json:"listPrice,omitempty"`
+		SoldPrice      *float64 `json:"soldPrice,omitempty"`
+		ListDate       *string  `json:"listDate,omitempty"`
+		SoldDate       *string  `json:"soldDate,omitempty"`
+		CloseDate      *string  `json:"closeDate,omitempty"`
+		HOADues        *float64 `json:"hoaDues,omitempty"`
+		AnnualTaxes    *float64 `json:"annualTaxes,omitempty"`
+		GarageSpaces   *int     `json:"garageSpaces,omitempty"`
+		Stories        *float64 `json:"stories,omitempty"`
+		Basement       *bool    `json:"basement,omitempty"`
+		Pool           *bool    `json:"pool,omitempty"`
+		LotSizeSqFt    *int     `json:"lotSizeSqFt,omitempty"`
+		Subdivision    *string  `json:"subdivision,omitempty"`
+		SchoolDistrict *string  `json:"schoolDistrict,omitempty"`
+		Latitude       *float64 `json:"latitude,omitempty"`
+		Longitude      *float64 `json:"longitude,omitempty"`
+		// Provenance explains each extracted field; FieldsToVerify lists the
+		// ones to check before presenting a BMA.
+		Provenance     map[string]FieldProvenance `json:"provenance,omitempty"`
+		FieldsToVerify []string                   `json:"fieldsToVerify,omitempty"`
 	}
 
 	// Get property details for each address
 	response := make([]AddressWithDetails, len(addresses))
 	for i, addr := range addresses {
 		response[i] = AddressWithDetails{
-			ID:         addr.ID,
-			AddressStr: addr.AddressStr,
-			Enabled:    addr.Enabled,
-			Primary:    addr.Primary,
+			ID:           addr.ID,
+			AddressStr:   addr.AddressStr,
+			Enabled:      addr.Enabled,
+			Primary:      addr.Primary,
+			NeedsReview:  addr.NeedsReview,
+			ReviewFields: addr.ReviewFields,
 		}
 
 		// Get property details from raw_page_data
 		var raw RawPageData
 		err := rawCol.FindOne(ctx, bson.M{"_id": addr.RawPageID}).Decode(&raw)
 		if err == nil && raw.PropertyDetails != nil {
-			response[i].Price = &raw.PropertyDetails.Price
-			response[i].Bedrooms = &raw.PropertyDetails.Bedrooms
-			response[i].Bathrooms = &raw.PropertyDetails.Bathrooms
-			response[i].SquareFootage = &raw.PropertyDetails.SquareFootage
-			response[i].PropertyType = &raw.PropertyDetails.PropertyType
-			response[i].YearBuilt = &raw.PropertyDetails.YearBuilt
+			// Leave out values the listing did not state instead of reporting zeros
+			known := func(field string) bool {
+				prov, ok := raw.Provenance[field]
+				return !ok || prov.Value != nil
+			}
+			if known("price") {
+				response[i].Price = &raw.PropertyDetails.Price
+			}
+			if known("bedrooms") {
+				response[i].Bedrooms = &raw.PropertyDetails.Bedrooms
+			}
+			if known("bathrooms") {
+				response[i].Bathrooms = &raw.PropertyDetails.Bathrooms
+			}
+			if known("squareFootage") {
+				response[i].SquareFootage = &raw.PropertyDetails.SquareFootage
+			}
+			if known("propertyType") {
+				response[i].PropertyType = &raw.PropertyDetails.PropertyType
+			}
+			if known("yearBuilt") {
+				response[i].YearBuilt = &raw.PropertyDetails.YearBuilt
+			}
+			d := raw.PropertyDetails
+			if known("lotSize") {
+				response[i].LotSize = &d.LotSize
+			}
+			if known("listingStatus") {
+				response[i].ListingStatus = &d.ListingStatus
+			}
+			if known("listPrice") {
+				response[i].ListPrice = &d.ListPrice
+			}
+			if known("soldPrice") {
+				response[i].SoldPrice = &d.SoldPrice
+			}
+			if known("listDate") {
+				response[i].ListDate = &d.ListDate
+			}
+			if known("soldDate") {
+				response[i].SoldDate = &d.SoldDate
+			}
+			if known("closeDate") {
+				response[i].CloseDate = &d.CloseDate
+			}
+			if known("hoaDues") {
+				response[i].HOADues = &d.HOADues
+			}
+			if known("annualTaxes") {
+				response[i].AnnualTaxes = &d.AnnualTaxes
+			}
+			if known("garageSpaces") {
+				response[i].GarageSpaces = &d.GarageSpaces
+			}
+			if known("stories") {
+				response[i].Stories = &d.Stories
+			}
+			response[i].Basement, response[i].Pool = d.Basement, d.Pool
+			if known("lotSizeSqFt") {
+				response[i].LotSizeSqFt = &d.LotSizeSqFt
+			}
+			if known("subdivision") {
+				response[i].Subdivision = &d.Subdivision
+			}
+			if known("schoolDistrict") {
+				response[i].SchoolDistrict = &d.SchoolDistrict
+			}
+			if known("latitude") && known("longitude") && (d.Latitude != 0 || d.Longitude != 0) {
+				response[i].Latitude, response[i].Longitude = &d.Latitude, &d.Longitude
+			}
+			response[i].Provenance = raw.Provenance
+			response[i].FieldsToVerify = FieldsToVerify(raw.Provenance)
+			if raw.InjectionRisk != nil && raw.InjectionRisk.Level != InjectionRiskNone {
+				response[i].InjectionRisk = raw.InjectionRisk.Level
+			}
 		}
 	}
 
@@ -165,7 +330,7 @@ func handleListAddresses(c *fiber.Ctx) error {
 
 // handleCreateAddress – if you ever want to manually add addresses via API
 func handleCreateAddress(c *fiber.Ctx) error {
-	ctx := context.Background()
+	ctx := c.UserContext()
 
 	var addr Address
 	if err := c.BodyParser(&addr); err != nil {
@@ -181,7 +346,7 @@ func handleCreateAddress(c *fiber.Ctx) error {
 
 // handleUpdateAddress can toggle enabled, set primary, etc.
 func handleUpdateAddress(c *fiber.Ctx) error {
-	ctx := context.Background()
+	ctx := c.UserContext()
 	idParam := c.Params("id")
 	objID, err := primitive.ObjectIDFromHex(idParam)
 	if err != nil {
@@ -228,9 +393,30 @@ func handleUpdateAddress(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"message": "Address updated"})
 }
 
+// handleMarkAddressReviewed clears the review flag set by consensus extraction
+// once someone has checked the address's details.
+func handleMarkAddressReviewed(c *fiber.Ctx) error {
+	objID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid address ID"})
+	}
+
+	result, err := addressesCollection.UpdateOne(c.UserContext(), bson.M{"_id": objID}, bson.M{
+		"$set":   bson.M{"needsReview": false},
+		"$unset": bson.M{"reviewFields": ""},
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if result.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Address not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Address marked as reviewed"})
+}
+
 // handleDeleteAddress deletes an address and its associated raw page data
 func handleDeleteAddress(c *fiber.Ctx) error {
-	ctx := context.Background()
+	ctx := c.UserContext()
 	idParam := c.Params("id")
 	objID, err := primitive.ObjectIDFromHex(idParam)
 	if err != nil {
@@ -263,238 +449,81 @@ func handleDeleteAddress(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"message": "Address deleted successfully"})
 }
 
-// handleBMAReport returns a mock BMA report if there's a primary address and at least one enabled comparison address
+// handleBMAReport returns a BMA report if there's a primary address and at least one enabled comparison address.
+// ?profile= selects the instruction profile by ID or name; the default profile is used otherwise.
+// ?locale= selects the language and number, currency and date formats, e.g. es-US.
 func handleBMAReport(c *fiber.Ctx) error {
-	ctx := context.Background()
-
-	var primaryAddr Address
-	var enabledAddrs []Address
-
-	addrCol := BmaDB.Collection("addresses")
-	rawCol := BmaDB.Collection("raw_page_data")
-	cachedCol := BmaDB.Collection("cached_bma_reports")
+	ctx := c.UserContext()
 
-	// Find primary
-	err := addrCol.FindOne(ctx, bson.M{"primary": true}).Decode(&primaryAddr)
-	if err != nil {
-		return c.JSON(BMAReport{
-			PrimaryAddress:  nil,
-			ComparisonAddrs: nil,
-			Opinion:         "No primary address set yet.",
-		})
+	in, placeholder, err := loadReportAddresses(ctx, reportOptionsFromQuery(c))
+	if errors.Is(err, ErrProfileNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Instruction profile not found"})
 	}
-
-	// Find enabled (but not primary)
-	cursor, err := addrCol.Find(ctx, bson.M{"enabled": true, "primary": false})
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	if errors.Is(err, ErrUnsupportedLocale) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-	defer cursor.Close(ctx)
-	if err := cursor.All(ctx, &enabledAddrs); err != nil {
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
-
-	if len(enabledAddrs) == 0 {
-		return c.JSON(BMAReport{
-			PrimaryAddress:  &primaryAddr,
-			ComparisonAddrs: nil,
-			Opinion:         "Need at least one enabled comparison address.",
-		})
+	if placeholder != nil {
+		return c.JSON(placeholder)
 	}
 
-	// Check for cached report
-	var comparisonIDs []primitive.ObjectID
-	for _, addr := range enabledAddrs {
-		comparisonIDs = append(comparisonIDs, addr.ID)
-	}
-	sort.Slice(comparisonIDs, func(i, j int) bool {
-		return comparisonIDs[i].Hex() < comparisonIDs[j].Hex()
-	})
-
-	var cachedReport CachedBMAReport
-	err = cachedCol.FindOne(ctx, bson.M{
-		"primaryAddressId":     primaryAddr.ID,
-		"comparisonAddressIds": comparisonIDs,
-	}).Decode(&cachedReport)
-
 	// If we have a cached report less than 24 hours old, use it
-	if err == nil && time.Since(cachedReport.GeneratedAt) < 24*time.Hour {
-		return c.JSON(cachedReport.Report)
+	if cached, ok := findCachedReport(ctx, in); ok {
+		return c.JSON(cached)
 	}
 
-	// Get property details for primary address
-	var primaryRaw RawPageData
-	err = rawCol.FindOne(ctx, bson.M{"_id": primaryAddr.RawPageID}).Decode(&primaryRaw)
-	if err != nil {
+	if err := loadReportDetails(ctx, in); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get primary property details"})
 	}
 
-	// Get property details for comparison addresses
-	var comparisonDetails []*PropertyDetails
-	for _, addr := range enabledAddrs {
-		var raw RawPageData
-		err = rawCol.FindOne(ctx, bson.M{"_id": addr.RawPageID}).Decode(&raw)
-		if err != nil {
-			continue
-		}
-		if raw.PropertyDetails != nil {
-			// Create a copy without the listing date
-			details := *raw.PropertyDetails
-			details.DaysOnMarket = 0
-			details.LastPriceChange = 0
-			comparisonDetails = append(comparisonDetails, &details)
-		}
-	}
-
 	// Generate detailed analysis
-	nonPtrComparisons := make([]PropertyDetails, len(comparisonDetails))
-	for i, comp := range comparisonDetails {
-		nonPtrComparisons[i] = *comp
-	}
-	detailedAnalysis, err := GenerateDetailedBMA(*primaryRaw.PropertyDetails, nonPtrComparisons)
+	report, err := generateReport(ctx, in, nil)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to generate detailed analysis")
+		if ctx.Err() != nil {
+			return c.Status(fiber.StatusGatewayTimeout).JSON(fiber.Map{"error": "Timed out generating analysis"})
+		}
+		if verr, ok := asValidationError(err); ok {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error":      "Generated analysis failed validation",
+				"validation": verr,
+			})
+		}
+		if ErrUpstreamUnavailable(err) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(upstreamRetryAfter(err)))
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "LLM provider is unavailable, try again shortly"})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate analysis"})
 	}
 
-	// Construct the report
-	var comparisonAddrs []*Address
-	for _, a := range enabledAddrs {
-		comparisonAddrs = append(comparisonAddrs, &a)
-	}
-
-	report := BMAReport{
-		PrimaryAddress:   &primaryAddr,
-		ComparisonAddrs:  comparisonAddrs,
-		Opinion:          detailedAnalysis.Recommendation,
-		DetailedAnalysis: &detailedAnalysis,
-	}
-
-	// Cache the report
-	cachedReport = CachedBMAReport{
-		PrimaryAddressID:     primaryAddr.ID,
-		ComparisonAddressIDs: comparisonIDs,
-		GeneratedAt:          time.Now(),
-		Report:               report,
-	}
-
-	_, err = cachedCol.UpdateOne(
-		ctx,
-		bson.M{
-			"primaryAddressId":     primaryAddr.ID,
-			"comparisonAddressIds": comparisonIDs,
-		},
-		bson.M{"$set": cachedReport},
-		options.Update().SetUpsert(true),
-	)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to cache BMA report")
-	}
-
 	return c.JSON(report)
 }
 
 // handleRefreshBMAReport forces a refresh of the BMA report by deleting the cache and regenerating
 func handleRefreshBMAReport(c *fiber.Ctx) error {
-	ctx := context.Background()
-
-	var primaryAddr Address
-	var enabledAddrs []Address
-
-	addrCol := BmaDB.Collection("addresses")
-	cachedCol := BmaDB.Collection("cached_bma_reports")
+	ctx := c.UserContext()
 
-	// Find primary
-	err := addrCol.FindOne(ctx, bson.M{"primary": true}).Decode(&primaryAddr)
-	if err != nil {
-		return c.JSON(BMAReport{
-			PrimaryAddress:  nil,
-			ComparisonAddrs: nil,
-			Opinion:         "No primary address set yet.",
-		})
+	in, placeholder, err := loadReportAddresses(ctx, reportOptionsFromQuery(c))
+	if errors.Is(err, ErrProfileNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Instruction profile not found"})
+	}
+	if errors.Is(err, ErrUnsupportedLocale) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-
-	// Find enabled (but not primary)
-	cursor, err := addrCol.Find(ctx, bson.M{"enabled": true, "primary": false})
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
-	defer cursor.Close(ctx)
-	if err := cursor.All(ctx, &enabledAddrs); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
-	}
-
-	if len(enabledAddrs) == 0 {
-		return c.JSON(BMAReport{
-			PrimaryAddress:  &primaryAddr,
-			ComparisonAddrs: nil,
-			Opinion:         "Need at least one enabled comparison address.",
-		})
+	if placeholder != nil {
+		return c.JSON(placeholder)
 	}
 
 	// Delete cached report if it exists
-	var comparisonIDs []primitive.ObjectID
-	for _, addr := range enabledAddrs {
-		comparisonIDs = append(comparisonIDs, addr.ID)
-	}
-	sort.Slice(comparisonIDs, func(i, j int) bool {
-		return comparisonIDs[i].Hex() < comparisonIDs[j].Hex()
-	})
-
-	_, err = cachedCol.DeleteOne(ctx, bson.M{
-		"primaryAddressId":     primaryAddr.ID,
-		"comparisonAddressIds": comparisonIDs,
-	})
-	if err != nil && err != mongo.ErrNoDocuments {
+	if err := deleteCachedReport(ctx, in); err != nil && err != mongo.ErrNoDocuments {
 		log.Error().Err(err).Msg("Failed to delete cached report")
 	}
 
 	// Now generate a fresh report
 	return handleBMAReport(c)
 }
-
-func handleGetLLMInstructions(c *fiber.Ctx) error {
-	var instructions LLMInstructions
-	err := llmInstructionsCollection.FindOne(context.Background(), bson.M{}).Decode(&instructions)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return c.JSON(fiber.Map{"instructions": ""})
-		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch instructions"})
-	}
-
-	return c.JSON(fiber.Map{"instructions": instructions.Instructions})
-}
-
-func handleUpdateLLMInstructions(c *fiber.Ctx) error {
-	var data struct {
-		Instructions string `json:"instructions"`
-	}
-	if err := c.BodyParser(&data); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
-	}
-
-	// Delete existing instructions if any
-	_, err := llmInstructionsCollection.DeleteMany(context.Background(), bson.M{})
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to clear existing instructions"})
-	}
-
-	// Insert new instructions
-	instructions := LLMInstructions{
-		Instructions: data.Instructions,
-		UpdatedAt:    time.Now(),
-	}
-	_, err = llmInstructionsCollection.InsertOne(context.Background(), instructions)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save instructions"})
-	}
-
-	// Delete cached BMA report to force regeneration
-	_, err = cachedBMAReportsCollection.DeleteMany(context.Background(), bson.M{})
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to clear cached reports"})
-	}
-
-	return c.JSON(fiber.Map{"status": "success"})
-}
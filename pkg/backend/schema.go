@@ -0,0 +1,352 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Schema describes the JSON a model must return. It is derived from Go structs
+// with SchemaFor and translated into each provider's structured-output format.
+type Schema struct {
+	Type       string
+	Nullable   bool
+	Properties map[string]*Schema
+	Required   []string
+	Items      *Schema
+	Enum       []string
+	Minimum    *float64
+	Maximum    *float64
+	NonEmpty   bool
+}
+
+// SchemaFor derives a schema from the JSON shape of v. Struct fields are
+// required unless tagged otherwise; the `llm` struct tag adds constraints:
+//
+//	llm:"-"            leave the field out of the schema
+//	llm:"optional"     the key may be missing
+//	llm:"nullable"     the value may be null
+//	llm:"nonempty"     strings and arrays must not be empty
+//	llm:"min=0,max=50" numeric range
+//	llm:"enum=a|b"     allowed string values
+func SchemaFor(v interface{}) *Schema {
+	return schemaForType(reflect.TypeOf(v))
+}
+
+func schemaForType(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaForType(t.Elem())}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			tag := field.Tag.Get("llm")
+			if tag == "-" {
+				continue
+			}
+
+			prop := schemaForType(field.Type)
+			required := true
+			for _, opt := range strings.Split(tag, ",") {
+				key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+				switch key {
+				case "optional":
+					required = false
+				case "nullable":
+					prop.Nullable = true
+				case "nonempty":
+					prop.NonEmpty = true
+				case "min":
+					if f, err := strconv.ParseFloat(value, 64); err == nil {
+						prop.Minimum = &f
+					}
+				case "max":
+					if f, err := strconv.ParseFloat(value, 64); err == nil {
+						prop.Maximum = &f
+					}
+				case "enum":
+					prop.Enum = strings.Split(value, "|")
+				}
+			}
+			s.Properties[name] = prop
+			if required {
+				s.Required = append(s.Required, name)
+			}
+		}
+		return s
+	default:
+		return &Schema{Type: "string"}
+	}
+}
+
+// JSONSchema returns the schema as a JSON Schema document, for providers that
+// accept one and for embedding in prompts.
+func (s *Schema) JSONSchema() map[string]interface{} {
+	out := map[string]interface{}{}
+	if s.Nullable {
+		out["type"] = []string{s.Type, "null"}
+	} else {
+		out["type"] = s.Type
+	}
+	if len(s.Properties) > 0 {
+		props := map[string]interface{}{}
+		for name, prop := range s.Properties {
+			props[name] = prop.JSONSchema()
+		}
+		out["properties"] = props
+	}
+	if len(s.Required) > 0 {
+		out["required"] = s.Required
+	}
+	if s.Items != nil {
+		out["items"] = s.Items.JSONSchema()
+	}
+	if len(s.Enum) > 0 {
+		out["enum"] = s.Enum
+	}
+	if s.Minimum != nil {
+		out["minimum"] = *s.Minimum
+	}
+	if s.Maximum != nil {
+		out["maximum"] = *s.Maximum
+	}
+	if s.NonEmpty {
+		if s.Type == "string" {
+			out["minLength"] = 1
+		} else if s.Type == "array" {
+			out["minItems"] = 1
+		}
+	}
+	return out
+}
+
+// String renders the JSON Schema document as indented JSON.
+func (s *Schema) String() string {
+	b, _ := json.MarshalIndent(s.JSONSchema(), "", "  ")
+	return string(b)
+}
+
+// toGenai converts the schema to Gemini's response schema. Gemini has no
+// numeric ranges, so those are only enforced by ValidateJSON.
+func (s *Schema) toGenai() *genai.Schema {
+	if s == nil {
+		return nil
+	}
+	out := &genai.Schema{
+		Nullable: s.Nullable,
+		Enum:     s.Enum,
+		Required: s.Required,
+		Items:    s.Items.toGenai(),
+	}
+	switch s.Type {
+	case "object":
+		out.Type = genai.TypeObject
+	case "array":
+		out.Type = genai.TypeArray
+	case "integer":
+		out.Type = genai.TypeInteger
+	case "number":
+		out.Type = genai.TypeNumber
+	case "boolean":
+		out.Type = genai.TypeBoolean
+	default:
+		out.Type = genai.TypeString
+	}
+	if len(s.Properties) > 0 {
+		out.Properties = map[string]*genai.Schema{}
+		for name, prop := range s.Properties {
+			out.Properties[name] = prop.toGenai()
+		}
+	}
+	return out
+}
+
+// FieldError is a single schema violation at a JSON path such as "comparison[2].value".
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) String() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// ValidationError is returned when a model's answer still violates the schema
+// after every repair attempt.
+type ValidationError struct {
+	Task     LLMTask      `json:"task"`
+	Attempts int          `json:"attempts"`
+	Errors   []FieldError `json:"errors"`
+	Response string       `json:"response,omitempty"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.String()
+	}
+	return fmt.Sprintf("%s response failed validation after %d attempt(s): %s", e.Task, e.Attempts, strings.Join(msgs, "; "))
+}
+
+// ValidateJSON checks data against the schema and returns every violation found.
+func ValidateJSON(s *Schema, data []byte) []FieldError {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return []FieldError{{Message: fmt.Sprintf("invalid JSON: %v", err)}}
+	}
+	var errs []FieldError
+	validateValue(s, v, "", &errs)
+	return errs
+}
+
+func validateValue(s *Schema, v interface{}, path string, errs *[]FieldError) {
+	add := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if v == nil {
+		if !s.Nullable {
+			add("must not be null")
+		}
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			add("expected object, got %s", jsonTypeName(v))
+			return
+		}
+		for _, name := range s.Required {
+			if _, present := obj[name]; !present {
+				*errs = append(*errs, FieldError{Path: joinPath(path, name), Message: "required key is missing"})
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if value, present := obj[name]; present {
+				validateValue(s.Properties[name], value, joinPath(path, name), errs)
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			add("expected array, got %s", jsonTypeName(v))
+			return
+		}
+		if s.NonEmpty && len(arr) == 0 {
+			add("must not be empty")
+		}
+		for i, item := range arr {
+			validateValue(s.Items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			add("expected string, got %s", jsonTypeName(v))
+			return
+		}
+		if s.NonEmpty && strings.TrimSpace(str) == "" {
+			add("must not be empty")
+		}
+		if len(s.Enum) > 0 {
+			for _, allowed := range s.Enum {
+				if str == allowed {
+					return
+				}
+			}
+			add("must be one of %s, got %q", strings.Join(s.Enum, ", "), str)
+		}
+	case "integer", "number":
+		num, ok := v.(json.Number)
+		if !ok {
+			add("expected %s, got %s", s.Type, jsonTypeName(v))
+			return
+		}
+		f, err := num.Float64()
+		if err != nil {
+			add("invalid number %q", num.String())
+			return
+		}
+		if s.Type == "integer" && f != math.Trunc(f) {
+			add("expected integer, got %s", num.String())
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			add("must be at least %v, got %v", *s.Minimum, f)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			add("must be at most %v, got %v", *s.Maximum, f)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			add("expected boolean, got %s", jsonTypeName(v))
+		}
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
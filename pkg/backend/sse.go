@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// readSSEData reads a server-sent event stream and calls fn with the data of
+// each event, joining multi-line data fields as the SSE spec requires.
+func readSSEData(r io.Reader, fn func(data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	var data []string
+	flush := func() error {
+		if len(data) == 0 {
+			return nil
+		}
+		payload := strings.Join(data, "\n")
+		data = data[:0]
+		return fn(payload)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read event stream: %v", err)
+	}
+	return flush()
+}
+
+// sseWriter writes named server-sent events with JSON payloads.
+type sseWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// send writes one event and flushes it to the client. After the first write
+// error, typically because the client went away, every call returns that error.
+func (s *sseWriter) send(event string, payload interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %v", event, err)
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		s.err = err
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
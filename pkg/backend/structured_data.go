@@ -0,0 +1,580 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Sources of the values in FieldProvenance.Source.
+const (
+	SourceJSONLD    = "json-ld"
+	SourceMicrodata = "microdata"
+	SourceLLM       = "llm"
+)
+
+// residenceTypes are the schema.org types that describe the home itself.
+var residenceTypes = map[string]bool{
+	"SingleFamilyResidence":   true,
+	"House":                   true,
+	"Residence":               true,
+	"Apartment":               true,
+	"Accommodation":           true,
+	"ApartmentComplex":        true,
+	"GatedResidenceCommunity": true,
+}
+
+// residencePropertyTypes name the property type of the specific residence types.
+var residencePropertyTypes = map[string]string{
+	"SingleFamilyResidence": "Single Family",
+	"House":                 "House",
+	"Apartment":             "Apartment",
+}
+
+// squareFeetPerSquareMeter converts floor sizes given in square meters.
+const squareFeetPerSquareMeter = 10.7639
+
+// structuredValue is one PropertyDetails value read from structured data,
+// with the property path it came from.
+type structuredValue struct {
+	value interface{}
+	path  string
+}
+
+// parseStructuredData reads the listing's PropertyDetails fields from the
+// schema.org JSON-LD and microdata embedded in the page HTML. JSON-LD wins
+// over microdata for fields both state. Values that break the PropertyDetails
+// schema are dropped. It returns nil when the page states nothing usable.
+func parseStructuredData(page string) map[string]FieldProvenance {
+	if strings.TrimSpace(page) == "" {
+		return nil
+	}
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		return nil
+	}
+
+	fromJSONLD, fromMicrodata := structuredListings(doc)
+
+	schema := SchemaFor(PropertyDetails{})
+	provenance := map[string]FieldProvenance{}
+	for _, source := range []struct {
+		name   string
+		values map[string]structuredValue
+	}{{SourceJSONLD, fromJSONLD}, {SourceMicrodata, fromMicrodata}} {
+		for name, v := range source.values {
+			if _, ok := provenance[name]; ok {
+				continue
+			}
+			prop, ok := schema.Properties[name]
+			if !ok {
+				continue
+			}
+			raw, _ := json.Marshal(v.value)
+			if errs := ValidateJSON(prop, raw); len(errs) > 0 {
+				continue
+			}
+			provenance[name] = FieldProvenance{
+				Value:      v.value,
+				Confidence: 1,
+				Evidence:   fmt.Sprintf("%s: %s", v.path, raw),
+				Source:     source.name,
+			}
+		}
+	}
+	if len(provenance) == 0 {
+		return nil
+	}
+	return provenance
+}
+
+// structuredListings reads the values of the listed home from the JSON-LD and
+// the microdata of a parsed page. Microdata about another home is dropped.
+func structuredListings(doc *html.Node) (fromJSONLD, fromMicrodata map[string]structuredValue) {
+	var jsonLD, microdata []map[string]interface{}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if n.Data == "script" && strings.EqualFold(strings.TrimSpace(attr(n, "type")), "application/ld+json") {
+				var data interface{}
+				if n.FirstChild != nil && json.Unmarshal([]byte(n.FirstChild.Data), &data) == nil {
+					jsonLD = append(jsonLD, typedNodes(data)...)
+				}
+				return
+			}
+			if hasAttr(n, "itemscope") && !hasAttr(n, "itemprop") {
+				microdata = append(microdata, typedNodes(microdataItem(n))...)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	fromJSONLD, fromMicrodata = listingValues(jsonLD), listingValues(microdata)
+	// Microdata about another home, e.g. in a carousel, must not fill gaps
+	if a, b := fromJSONLD["address"], fromMicrodata["address"]; a.value != nil && b.value != nil && !sameAddress(a.value, b.value) {
+		fromMicrodata = nil
+	}
+	return fromJSONLD, fromMicrodata
+}
+
+// sameAddress tells whether two addresses name the same home, one possibly
+// without the city or ZIP code.
+func sameAddress(a, b interface{}) bool {
+	ka, kb := addressKey(fmt.Sprint(a)), addressKey(fmt.Sprint(b))
+	return strings.HasPrefix(ka, kb) || strings.HasPrefix(kb, ka)
+}
+
+// missingFields lists the PropertyDetails fields the structured data does not
+// state, or nil when there is no structured data and every field is missing.
+func missingFields(structured map[string]FieldProvenance) []string {
+	if len(structured) == 0 {
+		return nil
+	}
+	fields := []string{}
+	for name := range SchemaFor(PropertyDetails{}).Properties {
+		if prov, ok := structured[name]; !ok || prov.Value == nil {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// withStructuredData overlays the structured values on the extracted ones.
+func withStructuredData(structured, extracted map[string]FieldProvenance) map[string]FieldProvenance {
+	if len(structured) == 0 {
+		return extracted
+	}
+	merged := map[string]FieldProvenance{}
+	for name, prov := range extracted {
+		merged[name] = prov
+	}
+	for name, prov := range structured {
+		merged[name] = prov
+	}
+	return merged
+}
+
+// typedNodes returns every object with an @type in decoded JSON-LD, including
+// nested ones and those of an @graph, each after the object it is part of.
+func typedNodes(data interface{}) []map[string]interface{} {
+	var out []map[string]interface{}
+	switch v := data.(type) {
+	case map[string]interface{}:
+		if _, ok := v["@type"]; ok {
+			out = append(out, v)
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out = append(out, typedNodes(v[k])...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			out = append(out, typedNodes(item)...)
+		}
+	}
+	return out
+}
+
+// nodeTypes returns the schema.org types of a node without their URL prefix.
+func nodeTypes(node map[string]interface{}) []string {
+	var types []string
+	switch t := node["@type"].(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+	for i, t := range types {
+		types[i] = t[strings.LastIndex(t, "/")+1:]
+	}
+	return types
+}
+
+func hasType(node map[string]interface{}, types map[string]bool) bool {
+	for _, t := range nodeTypes(node) {
+		if types[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// listingValues finds the listed home among the nodes and reads its fields.
+// A RealEstateListing, or an Offer or Product for a residence, supplies the
+// offer; otherwise the first residence is the listing, so homes in carousels
+// further down the page are ignored.
+func listingValues(nodes []map[string]interface{}) map[string]structuredValue {
+	var residence, offerHolder map[string]interface{}
+	for _, node := range nodes {
+		types := map[string]bool{}
+		for _, t := range nodeTypes(node) {
+			types[t] = true
+		}
+		if types["RealEstateListing"] || types["Product"] || types["Offer"] {
+			for _, key := range []string{"mainEntity", "about", "itemOffered"} {
+				if inner, ok := firstObject(node[key]); ok && hasType(inner, residenceTypes) {
+					residence, offerHolder = inner, node
+					break
+				}
+			}
+			if residence != nil {
+				break
+			}
+		}
+	}
+	if residence == nil {
+		for _, node := range nodes {
+			if hasType(node, residenceTypes) {
+				residence = node
+				break
+			}
+		}
+	}
+	if residence == nil {
+		return nil
+	}
+
+	values := map[string]structuredValue{}
+	set := func(field string, value interface{}, path string) {
+		if _, ok := values[field]; !ok && value != nil {
+			values[field] = structuredValue{value, path}
+		}
+	}
+
+	set("address", postalAddress(residence["address"]), "address")
+	if geo, ok := firstObject(residence["geo"]); ok {
+		set("latitude", numberValue(geo["latitude"]), "geo.latitude")
+		set("longitude", numberValue(geo["longitude"]), "geo.longitude")
+	}
+	set("bedrooms", integer(residence["numberOfBedrooms"]), "numberOfBedrooms")
+	if total, ok := number(residence["numberOfBathroomsTotal"]); ok {
+		set("bathrooms", total, "numberOfBathroomsTotal")
+	} else if full, ok := number(residence["numberOfFullBathrooms"]); ok {
+		if partial, ok := number(residence["numberOfPartialBathrooms"]); ok {
+			full += partial / 2
+		}
+		set("bathrooms", full, "numberOfFullBathrooms")
+	}
+	set("squareFootage", floorSize(residence["floorSize"]), "floorSize")
+	set("yearBuilt", integer(residence["yearBuilt"]), "yearBuilt")
+	if description, ok := residence["description"].(string); ok && strings.TrimSpace(description) != "" {
+		set("description", strings.TrimSpace(description), "description")
+	}
+	for _, t := range nodeTypes(residence) {
+		if pt, ok := residencePropertyTypes[t]; ok {
+			set("propertyType", pt, "@type "+t)
+			break
+		}
+	}
+	set("mlsNumber", mlsIdentifier(residence["identifier"]), "identifier")
+	// Not a PropertyDetails field; read by listingPhotos
+	set("photos", imageURLs(residence["image"], offerHolder["image"]), "image")
+
+	for _, holder := range []map[string]interface{}{residence, offerHolder} {
+		if holder == nil {
+			continue
+		}
+		offer, ok := firstObject(holder["offers"])
+		if !ok && hasType(holder, map[string]bool{"Offer": true}) {
+			offer, ok = holder, true
+		}
+		if ok {
+			set("price", offerPrice(offer), "offers.price")
+		}
+	}
+	if offerHolder != nil {
+		set("listDate", dateValue(offerHolder["datePosted"]), "datePosted")
+	}
+	return values
+}
+
+// dateValue reads the date of an ISO 8601 date or date-time as YYYY-MM-DD.
+func dateValue(v interface{}) interface{} {
+	s, _ := v.(string)
+	if len(s) < len(time.DateOnly) {
+		return nil
+	}
+	if _, err := time.Parse(time.DateOnly, s[:len(time.DateOnly)]); err != nil {
+		return nil
+	}
+	return s[:len(time.DateOnly)]
+}
+
+// firstObject returns v, or the first object of v when it is an array.
+func firstObject(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case []interface{}:
+		for _, item := range v {
+			if m, ok := item.(map[string]interface{}); ok {
+				return m, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// imageURLs returns the URLs of image values, which are URLs, ImageObjects or
+// arrays of them, or nil when there are none.
+func imageURLs(values ...interface{}) interface{} {
+	var urls []string
+	var add func(v interface{})
+	add = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			if v = strings.TrimSpace(v); v != "" && !slices.Contains(urls, v) {
+				urls = append(urls, v)
+			}
+		case []interface{}:
+			for _, item := range v {
+				add(item)
+			}
+		case map[string]interface{}:
+			if u, ok := v["contentUrl"]; ok {
+				add(u)
+			} else {
+				add(v["url"])
+			}
+		}
+	}
+	for _, v := range values {
+		add(v)
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	return urls
+}
+
+// postalAddress formats a PostalAddress as "123 Main St, Springfield, IL 62701".
+func postalAddress(v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		if s = strings.TrimSpace(s); s != "" {
+			return s
+		}
+		return nil
+	}
+	a, ok := firstObject(v)
+	if !ok {
+		return nil
+	}
+	str := func(key string) string {
+		s, _ := a[key].(string)
+		return strings.TrimSpace(s)
+	}
+	if str("streetAddress") == "" {
+		return nil
+	}
+	parts := []string{str("streetAddress")}
+	if city := str("addressLocality"); city != "" {
+		parts = append(parts, city)
+	}
+	if region := strings.TrimSpace(str("addressRegion") + " " + str("postalCode")); region != "" {
+		parts = append(parts, region)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// number reads a JSON number or a numeric string such as "$512,000".
+func number(v interface{}) (float64, bool) {
+	var f float64
+	switch v := v.(type) {
+	case float64:
+		f = v
+	case string:
+		digits := strings.Map(func(r rune) rune {
+			if (r >= '0' && r <= '9') || r == '.' || r == '-' {
+				return r
+			}
+			if r == ',' || r == '$' || r == ' ' {
+				return -1
+			}
+			return 'x'
+		}, strings.TrimSpace(v))
+		parsed, err := strconv.ParseFloat(digits, 64)
+		if err != nil {
+			return 0, false
+		}
+		f = parsed
+	case map[string]interface{}:
+		// QuantitativeValue
+		return number(v["value"])
+	default:
+		return 0, false
+	}
+	return f, !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// numberValue is number as a field value, nil when v is not a number.
+func numberValue(v interface{}) interface{} {
+	if f, ok := number(v); ok {
+		return f
+	}
+	return nil
+}
+
+// integer is numberValue for fields stored as whole numbers.
+func integer(v interface{}) interface{} {
+	f, ok := number(v)
+	if !ok || f != math.Trunc(f) {
+		return nil
+	}
+	return f
+}
+
+// floorSize reads a QuantitativeValue in square feet, converting square meters.
+func floorSize(v interface{}) interface{} {
+	size, ok := firstObject(v)
+	if !ok {
+		return integer(v)
+	}
+	f, ok := number(size["value"])
+	if !ok {
+		return nil
+	}
+	unit := strings.ToUpper(fmt.Sprint(size["unitCode"], size["unitText"]))
+	if strings.Contains(unit, "MTK") || strings.Contains(unit, "M2") || strings.Contains(unit, "SQM") || strings.Contains(unit, "M²") {
+		return math.Round(f * squareFeetPerSquareMeter)
+	}
+	return math.Round(f)
+}
+
+// offerPrice reads the price of an Offer in US dollars.
+func offerPrice(offer map[string]interface{}) interface{} {
+	price, currency := offer["price"], offer["priceCurrency"]
+	if spec, ok := firstObject(offer["priceSpecification"]); ok && price == nil {
+		price, currency = spec["price"], spec["priceCurrency"]
+	}
+	if c, ok := currency.(string); ok && c != "" && !strings.EqualFold(c, "USD") {
+		return nil
+	}
+	return numberValue(price)
+}
+
+// mlsIdentifier reads an MLS number from a PropertyValue identifier.
+func mlsIdentifier(v interface{}) interface{} {
+	var ids []interface{}
+	if list, ok := v.([]interface{}); ok {
+		ids = list
+	} else {
+		ids = []interface{}{v}
+	}
+	for _, id := range ids {
+		m, ok := id.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name := fmt.Sprint(m["propertyID"], " ", m["name"])
+		if value, ok := m["value"].(string); ok && strings.Contains(strings.ToUpper(name), "MLS") && value != "" {
+			return value
+		}
+	}
+	return nil
+}
+
+// microdataItem converts an itemscope element to a JSON-LD like object.
+func microdataItem(n *html.Node) map[string]interface{} {
+	item := map[string]interface{}{}
+	if types := strings.Fields(attr(n, "itemtype")); len(types) > 0 {
+		item["@type"] = types[0]
+	}
+	var collect func(parent *html.Node)
+	collect = func(parent *html.Node) {
+		for c := parent.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			scoped := hasAttr(c, "itemscope")
+			if props := strings.Fields(attr(c, "itemprop")); len(props) > 0 {
+				var value interface{}
+				if scoped {
+					value = microdataItem(c)
+				} else {
+					value = microdataValue(c)
+				}
+				for _, prop := range props {
+					if _, ok := item[prop]; !ok {
+						item[prop] = value
+					}
+				}
+			}
+			if !scoped {
+				collect(c)
+			}
+		}
+	}
+	collect(n)
+	return item
+}
+
+// microdataValue is the value of an itemprop element per the HTML microdata rules.
+func microdataValue(n *html.Node) string {
+	switch n.Data {
+	case "meta":
+		return attr(n, "content")
+	case "a", "area", "link":
+		return attr(n, "href")
+	case "img", "audio", "embed", "iframe", "source", "track", "video":
+		return attr(n, "src")
+	case "data", "meter":
+		return attr(n, "value")
+	case "time":
+		if dt := attr(n, "datetime"); dt != "" {
+			return dt
+		}
+	}
+	if hasAttr(n, "content") {
+		return attr(n, "content")
+	}
+	return strings.Join(strings.Fields(nodeText(n)), " ")
+}
+
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(nodeText(c))
+		b.WriteString(" ")
+	}
+	return b.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
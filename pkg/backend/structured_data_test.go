@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStructuredData(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want map[string]interface{}
+		// sources are checked for the fields listed
+		sources map[string]string
+	}{
+		{
+			name: "JSON-LD residence",
+			page: `<html><head><script type="application/ld+json">{
+				"@context": "https://schema.org",
+				"@type": "SingleFamilyResidence",
+				"address": {"@type": "PostalAddress", "streetAddress": "123 Maple St", "addressLocality": "Columbus", "addressRegion": "OH", "postalCode": "43004"},
+				"numberOfBedrooms": 3,
+				"numberOfBathroomsTotal": "2.5",
+				"floorSize": {"@type": "QuantitativeValue", "value": 1820, "unitCode": "FTK"},
+				"yearBuilt": 1995,
+				"identifier": {"@type": "PropertyValue", "propertyID": "MLS", "value": "224012345"},
+				"offers": {"@type": "Offer", "price": "$349,900", "priceCurrency": "USD"}
+			}</script></head><body></body></html>`,
+			want: map[string]interface{}{
+				"address":       "123 Maple St, Columbus, OH 43004",
+				"bedrooms":      3.0,
+				"bathrooms":     2.5,
+				"squareFootage": 1820.0,
+				"yearBuilt":     1995.0,
+				"propertyType":  "Single Family",
+				"mlsNumber":     "224012345",
+				"price":         349900.0,
+			},
+			sources: map[string]string{"address": SourceJSONLD, "price": SourceJSONLD},
+		},
+		{
+			name: "listing in an @graph array",
+			page: `<script type="application/ld+json">{"@context": "https://schema.org", "@graph": [
+				{"@type": "WebPage", "name": "77 Birch Ave"},
+				{"@type": ["RealEstateListing"], "datePosted": "2024-05-01T10:00:00Z",
+				 "offers": {"@type": "Offer", "price": 449000, "priceCurrency": "USD"},
+				 "mainEntity": {"@type": "https://schema.org/House", "address": "77 Birch Ave, Austin, TX 78701", "numberOfBedrooms": 4,
+				  "floorSize": {"value": 100, "unitCode": "MTK"}}},
+				{"@type": "House", "address": "80 Birch Ave, Austin, TX 78701", "numberOfBedrooms": 5}
+			]}</script>`,
+			want: map[string]interface{}{
+				"address":       "77 Birch Ave, Austin, TX 78701",
+				"bedrooms":      4.0,
+				"squareFootage": 1076.0,
+				"propertyType":  "House",
+				"price":         449000.0,
+				"listDate":      "2024-05-01",
+			},
+		},
+		{
+			name: "malformed JSON-LD is skipped",
+			page: `<script type="application/ld+json">{"@type": "House", "address": "9 Elm Rd", "numberOfBedrooms": </script>
+				<script type="application/ld+json">{"@type": "House", "address": "12 Oak St, Dayton, OH", "numberOfBedrooms": 2}</script>`,
+			want: map[string]interface{}{
+				"address":      "12 Oak St, Dayton, OH",
+				"bedrooms":     2.0,
+				"propertyType": "House",
+			},
+		},
+		{
+			name: "only malformed JSON-LD",
+			page: `<script type="application/ld+json">{"@type": "House",, }</script>`,
+		},
+		{
+			name: "microdata",
+			page: `<div itemscope itemtype="https://schema.org/SingleFamilyResidence">
+				<h1 itemprop="address" itemscope itemtype="https://schema.org/PostalAddress">
+					<span itemprop="streetAddress">12 Oak St</span>, <span itemprop="addressLocality">Dayton</span>
+				</h1>
+				<span itemprop="numberOfBedrooms">3</span> beds
+				<meta itemprop="yearBuilt" content="1950">
+				<div itemprop="geo" itemscope itemtype="https://schema.org/GeoCoordinates">
+					<meta itemprop="latitude" content="39.76"><meta itemprop="longitude" content="-84.19">
+				</div>
+			</div>`,
+			want: map[string]interface{}{
+				"address":      "12 Oak St, Dayton",
+				"bedrooms":     3.0,
+				"yearBuilt":    1950.0,
+				"latitude":     39.76,
+				"longitude":    -84.19,
+				"propertyType": "Single Family",
+			},
+			sources: map[string]string{"address": SourceMicrodata},
+		},
+		{
+			name: "JSON-LD wins and microdata of the same home fills gaps",
+			page: `<script type="application/ld+json">{"@type": "House", "address": "12 Oak St, Dayton, OH", "numberOfBedrooms": 2}</script>
+				<div itemscope itemtype="https://schema.org/House">
+					<span itemprop="address">12 Oak St</span><span itemprop="numberOfBedrooms">3</span><span itemprop="yearBuilt">1950</span>
+				</div>`,
+			want: map[string]interface{}{
+				"address":      "12 Oak St, Dayton, OH",
+				"bedrooms":     2.0,
+				"yearBuilt":    1950.0,
+				"propertyType": "House",
+			},
+			sources: map[string]string{"bedrooms": SourceJSONLD, "yearBuilt": SourceMicrodata},
+		},
+		{
+			name: "microdata of another home is dropped",
+			page: `<script type="application/ld+json">{"@type": "House", "address": "12 Oak St, Dayton, OH"}</script>
+				<div itemscope itemtype="https://schema.org/House">
+					<span itemprop="address">40 Pine Ct</span><span itemprop="yearBuilt">2010</span>
+				</div>`,
+			want: map[string]interface{}{
+				"address":      "12 Oak St, Dayton, OH",
+				"propertyType": "House",
+			},
+		},
+		{
+			name: "values breaking the schema are dropped",
+			page: `<script type="application/ld+json">{"@type": "Residence", "address": "12 Oak St",
+				"numberOfBedrooms": 2.5, "yearBuilt": -4, "offers": {"price": 300000, "priceCurrency": "EUR"}}</script>`,
+			want: map[string]interface{}{
+				"address": "12 Oak St",
+			},
+		},
+		{
+			name: "no residence",
+			page: `<script type="application/ld+json">{"@type": "Organization", "name": "Portal Inc."}</script>`,
+		},
+		{
+			name: "empty page",
+			page: " ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provenance := parseStructuredData(tt.page)
+			var got map[string]interface{}
+			for name, prov := range provenance {
+				if got == nil {
+					got = map[string]interface{}{}
+				}
+				got[name] = prov.Value
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for name, source := range tt.sources {
+				if provenance[name].Source != source {
+					t.Errorf("%s came from %q, want %q", name, provenance[name].Source, source)
+				}
+			}
+		})
+	}
+}
+
+func TestMissingFields(t *testing.T) {
+	if got := missingFields(nil); got != nil {
+		t.Errorf("missingFields(nil) = %v, want nil", got)
+	}
+	structured := map[string]FieldProvenance{"address": {Value: "12 Oak St"}, "bedrooms": {Value: nil}}
+	got := missingFields(structured)
+	if len(got) != len(SchemaFor(PropertyDetails{}).Properties)-1 {
+		t.Errorf("missingFields = %v, want every field but the address", got)
+	}
+	for _, name := range got {
+		if name == "address" {
+			t.Error("the stated address is missing")
+		}
+	}
+}
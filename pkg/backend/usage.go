@@ -0,0 +1,295 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LLMUsage is one model invocation recorded in the llm_usage collection.
+type LLMUsage struct {
+	ID               primitive.ObjectID  `bson:"_id,omitempty" json:"id,omitempty"`
+	Task             LLMTask             `bson:"task" json:"task"`
+	Provider         string              `bson:"provider" json:"provider"`
+	Model            string              `bson:"model" json:"model"`
+	PromptTokens     int                 `bson:"promptTokens" json:"promptTokens"`
+	CompletionTokens int                 `bson:"completionTokens" json:"completionTokens"`
+	TotalTokens      int                 `bson:"totalTokens" json:"totalTokens"`
+	CostUSD          float64             `bson:"costUsd" json:"costUsd"`
+	LatencyMs        int64               `bson:"latencyMs" json:"latencyMs"`
+	Success          bool                `bson:"success" json:"success"`
+	Error            string              `bson:"error,omitempty" json:"error,omitempty"`
+	RequestID        string              `bson:"requestId,omitempty" json:"requestId,omitempty"`
+	URL              string              `bson:"url,omitempty" json:"url,omitempty"`
+	AddressID        *primitive.ObjectID `bson:"addressId,omitempty" json:"addressId,omitempty"`
+	ReportID         *primitive.ObjectID `bson:"reportId,omitempty" json:"reportId,omitempty"`
+	CreatedAt        time.Time           `bson:"createdAt" json:"createdAt"`
+}
+
+// ModelPrice is the cost of a model in US dollars per million tokens.
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// defaultModelPrices are list prices for the default hosted models. Models not
+// listed here, such as local ones, cost nothing unless LLM_PRICING says otherwise.
+var defaultModelPrices = map[string]ModelPrice{
+	"gemini-1.5-flash":  {Input: 0.075, Output: 0.30},
+	"gemini-1.5-pro":    {Input: 1.25, Output: 5.00},
+	"gpt-4o-mini":       {Input: 0.15, Output: 0.60},
+	"gpt-4o":            {Input: 2.50, Output: 10.00},
+	"claude-3-5-haiku":  {Input: 0.80, Output: 4.00},
+	"claude-3-5-sonnet": {Input: 3.00, Output: 15.00},
+}
+
+// modelPrice looks the model up in LLM_PRICING (a JSON object of model name to
+// ModelPrice) and then in the defaults. Versioned names such as
+// "gpt-4o-2024-08-06" use the price of their longest listed prefix.
+func modelPrice(model string) ModelPrice {
+	prices := defaultModelPrices
+	if raw := os.Getenv("LLM_PRICING"); raw != "" {
+		var custom map[string]ModelPrice
+		if err := json.Unmarshal([]byte(raw), &custom); err != nil {
+			log.Warn().Err(err).Msg("Ignoring invalid LLM_PRICING")
+		} else {
+			prices = make(map[string]ModelPrice, len(defaultModelPrices)+len(custom))
+			for name, price := range defaultModelPrices {
+				prices[name] = price
+			}
+			for name, price := range custom {
+				prices[name] = price
+			}
+		}
+	}
+
+	if price, ok := prices[model]; ok {
+		return price
+	}
+	best := ""
+	for name := range prices {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	return prices[best]
+}
+
+func costUSD(model string, promptTokens, completionTokens int) float64 {
+	price := modelPrice(model)
+	return (float64(promptTokens)*price.Input + float64(completionTokens)*price.Output) / 1e6
+}
+
+// usageScope links the LLM calls made while serving one request to what they were for.
+type usageScope struct {
+	RequestID string
+	URL       string
+	AddressID *primitive.ObjectID
+	ReportID  *primitive.ObjectID
+}
+
+type usageScopeKey struct{}
+
+// withUsageScope attaches a new usage scope to ctx and returns it so the caller
+// can link the recorded calls once the address or report is known.
+func withUsageScope(ctx context.Context, url string, addressID *primitive.ObjectID) (context.Context, *usageScope) {
+	scope := &usageScope{
+		RequestID: primitive.NewObjectID().Hex(),
+		URL:       url,
+		AddressID: addressID,
+	}
+	return context.WithValue(ctx, usageScopeKey{}, scope), scope
+}
+
+func usageScopeFrom(ctx context.Context) *usageScope {
+	scope, _ := ctx.Value(usageScopeKey{}).(*usageScope)
+	return scope
+}
+
+// recordUsage stores one invocation in the ledger. It runs even when the
+// request was cancelled, since the provider may still bill for the call.
+func recordUsage(ctx context.Context, task LLMTask, provider string, req LLMRequest, resp *LLMResponse, callErr error, latency time.Duration) {
+	if llmUsageCollection == nil {
+		return
+	}
+
+	entry := LLMUsage{
+		Task:      task,
+		Provider:  provider,
+		Model:     req.Model,
+		LatencyMs: latency.Milliseconds(),
+		Success:   callErr == nil,
+		CreatedAt: time.Now(),
+	}
+	if callErr != nil {
+		entry.Error = callErr.Error()
+	}
+	if resp != nil {
+		if resp.Model != "" {
+			entry.Model = resp.Model
+		}
+		entry.PromptTokens = resp.PromptTokens
+		entry.CompletionTokens = resp.CompletionTokens
+		entry.TotalTokens = resp.PromptTokens + resp.CompletionTokens
+		entry.CostUSD = costUSD(entry.Model, resp.PromptTokens, resp.CompletionTokens)
+	}
+	if scope := usageScopeFrom(ctx); scope != nil {
+		entry.RequestID = scope.RequestID
+		entry.URL = scope.URL
+		entry.AddressID = scope.AddressID
+		entry.ReportID = scope.ReportID
+	}
+
+	insertCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if _, err := llmUsageCollection.InsertOne(insertCtx, entry); err != nil {
+		log.Error().Err(err).Str("task", string(task)).Msg("Failed to record LLM usage")
+	}
+}
+
+// linkUsage sets fields such as addressId or reportId on every call recorded for the scope.
+func linkUsage(ctx context.Context, scope *usageScope, fields bson.M) {
+	if llmUsageCollection == nil || scope == nil || len(fields) == 0 {
+		return
+	}
+	_, err := llmUsageCollection.UpdateMany(ctx, bson.M{"requestId": scope.RequestID}, bson.M{"$set": fields})
+	if err != nil {
+		log.Error().Err(err).Str("requestId", scope.RequestID).Msg("Failed to link LLM usage")
+	}
+}
+
+// usageGroupFields maps the groupBy values accepted by /api/usage to ledger fields.
+var usageGroupFields = map[string]interface{}{
+	"day":      bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$createdAt"}},
+	"model":    "$model",
+	"task":     "$task",
+	"provider": "$provider",
+	"address":  "$addressId",
+	"report":   "$reportId",
+}
+
+// handleGetUsage aggregates the usage ledger.
+//
+// Query parameters: groupBy (comma-separated: day, model, task, provider,
+// address, report; default day), from and to (YYYY-MM-DD, inclusive), and the
+// filters task, model, addressId and reportId.
+func handleGetUsage(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	match := bson.M{}
+	dateRange := bson.M{}
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid from date, expected YYYY-MM-DD"})
+		}
+		dateRange["$gte"] = t
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid to date, expected YYYY-MM-DD"})
+		}
+		dateRange["$lt"] = t.AddDate(0, 0, 1)
+	}
+	if len(dateRange) > 0 {
+		match["createdAt"] = dateRange
+	}
+	if task := c.Query("task"); task != "" {
+		match["task"] = task
+	}
+	if model := c.Query("model"); model != "" {
+		match["model"] = model
+	}
+	for param, field := range map[string]string{"addressId": "addressId", "reportId": "reportId"} {
+		if hex := c.Query(param); hex != "" {
+			id, err := primitive.ObjectIDFromHex(hex)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid " + param})
+			}
+			match[field] = id
+		}
+	}
+
+	var groupBy []string
+	groupKey := bson.M{}
+	sortKey := bson.D{}
+	for _, g := range strings.Split(c.Query("groupBy", "day"), ",") {
+		g = strings.TrimSpace(g)
+		groupBy = append(groupBy, g)
+		field, ok := usageGroupFields[g]
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid groupBy value: " + g})
+		}
+		groupKey[g] = field
+		sortKey = append(sortKey, bson.E{Key: "_id." + g, Value: 1})
+	}
+
+	totals := bson.M{
+		"calls":            bson.M{"$sum": 1},
+		"failures":         bson.M{"$sum": bson.M{"$cond": bson.A{"$success", 0, 1}}},
+		"promptTokens":     bson.M{"$sum": "$promptTokens"},
+		"completionTokens": bson.M{"$sum": "$completionTokens"},
+		"totalTokens":      bson.M{"$sum": "$totalTokens"},
+		"costUsd":          bson.M{"$sum": "$costUsd"},
+		"avgLatencyMs":     bson.M{"$avg": "$latencyMs"},
+	}
+	groupStage := bson.M{"_id": groupKey}
+	totalStage := bson.M{"_id": nil}
+	for k, v := range totals {
+		groupStage[k] = v
+		totalStage[k] = v
+	}
+
+	pipeline := bson.A{
+		bson.M{"$match": match},
+		bson.M{"$facet": bson.M{
+			"groups": bson.A{bson.M{"$group": groupStage}, bson.M{"$sort": sortKey}},
+			"totals": bson.A{bson.M{"$group": totalStage}},
+		}},
+	}
+
+	cursor, err := llmUsageCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Groups []bson.M `bson:"groups"`
+		Totals []bson.M `bson:"totals"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	groups := []fiber.Map{}
+	totalsOut := fiber.Map{"calls": 0, "failures": 0, "promptTokens": 0, "completionTokens": 0, "totalTokens": 0, "costUsd": 0.0}
+	if len(results) > 0 {
+		for _, g := range results[0].Groups {
+			entry := fiber.Map{"key": g["_id"]}
+			for k := range totals {
+				entry[k] = g[k]
+			}
+			groups = append(groups, entry)
+		}
+		if len(results[0].Totals) > 0 {
+			for k := range totals {
+				totalsOut[k] = results[0].Totals[0][k]
+			}
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"groupBy": groupBy,
+		"groups":  groups,
+		"totals":  totalsOut,
+	})
+}